@@ -2,26 +2,46 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
+	"slices"
+	"syscall"
 	"time"
 
 	"github.com/kanootoko/stable-diffusion-telegram-bot/internal"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/api"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/archive"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/chatsettings"
 	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/config"
 	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/consts"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/gallery"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/gpustatus"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/health"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/history"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/httpserver"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/logging"
 	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/logic"
 	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/logic/userservice"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/metrics"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/moderation"
 	reqqueue "github.com/kanootoko/stable-diffusion-telegram-bot/internal/req_queue"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/safety"
 	sdapi "github.com/kanootoko/stable-diffusion-telegram-bot/internal/sd_api"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/stats"
 	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/telegram"
 	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/utils"
 )
 
+func fatal(err error) {
+	slog.Error(err.Error())
+	os.Exit(1)
+}
+
 func main() {
-	fmt.Println("stable-diffusion-telegram-bot starting...")
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	if _, isEnvFileSet := os.LookupEnv("ENVFILE"); isEnvFileSet {
 		utils.ReadEnvFile(os.Getenv("ENVFILE"))
 	} else {
@@ -31,38 +51,163 @@ func main() {
 	var params config.AppParams
 
 	if err := params.Init(); err != nil {
-		fmt.Println("error:", err)
-		os.Exit(1)
+		fatal(err)
+	}
+	if err := logging.Setup(os.Stdout, params.LogLevel, params.LogFormat); err != nil {
+		fatal(err)
 	}
 
-	log.Println("Using params", params)
+	slog.Info("stable-diffusion-telegram-bot starting", "version", internal.Version)
+	slog.Info("using params", "params", params.String())
 	var cancel context.CancelFunc
+	// Interrupt stops the bot right away, SIGTERM drains the queue first. The users of the unfinished requests
+	// are notified either way, see ReqQueue.Shutdown.
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
 
 	sdApi := sdapi.SdAPIType{SdHost: params.StableDiffusionApiHost}
-	log.Println("sdApi.SdHost", sdApi.SdHost)
-	reqQueue := reqqueue.ReqQueue{ProcessTimeout: params.ProcessTimeout}
+	historyStore, err := history.NewStore(params.HistoryFile, consts.HistoryKeepCount)
+	if err != nil {
+		fatal(err)
+	}
+	reqQueue := reqqueue.ReqQueue{ProcessTimeout: params.ProcessTimeout, History: historyStore, MaintenanceHold: params.MaintenanceHold}
+	if reqQueue.Stats, err = stats.NewStore(params.StatsFile, stats.MaxPeriod); err != nil {
+		fatal(err)
+	}
+	if params.ArchiveDir != "" {
+		if reqQueue.Archive, err = archive.New(params.ArchiveDir, params.ArchiveMaxSize, params.ArchiveMaxAge); err != nil {
+			fatal(err)
+		}
+		go reqQueue.Archive.RunPruner(ctx, consts.ArchivePruneInterval)
+	}
+	chatSettings, err := chatsettings.NewStore(params.ChatSettingsFile)
+	if err != nil {
+		fatal(err)
+	}
+	reqQueue.Moderation, err = moderation.New(params.Moderation.Blocklist, func(chatID int64) ([]string, string) {
+		settings := chatSettings.Get(chatID)
+		return settings.Blocklist, settings.ForcedNegativePrompt
+	})
+	if err != nil {
+		fatal(err)
+	}
+	if params.Moderation.HookURL != "" {
+		reqQueue.Moderation.Hook = &moderation.Hook{URL: params.Moderation.HookURL}
+	}
+	if reqQueue.Moderation.Audit, err = moderation.NewAudit(params.Moderation.AuditFile, consts.ModerationAuditKeepCount); err != nil {
+		fatal(err)
+	}
+	userService := userservice.NewUserServiceStatic(params.AllowedUserIDs, params.AllowedGroupIDs, params.AdminUserIDs)
 	cmdHandler := logic.NewCmdHandler(
 		&sdApi,
 		&reqQueue,
 		params.Defaults,
-		userservice.NewUserServiceStatic(params.AllowedUserIDs, params.AllowedGroupIDs, params.AdminUserIDs),
+		userService,
+		chatSettings,
 	)
+	cmdHandler.Inline = params.Inline
+	cmdHandler.AllowedTopics = params.AllowedTopics
+	cmdHandler.KnownChatIDs = append(append(slices.Clone(params.AllowedUserIDs), params.AllowedGroupIDs...), params.AdminUserIDs...)
+	cmdHandler.GPUStatus = gpustatus.BackendSource{SdAPI: &sdApi}
+	if len(params.GPUStatusCommand) > 0 {
+		cmdHandler.GPUStatus = gpustatus.SMISource{Command: params.GPUStatusCommand}
+	}
+	if params.Safety.Enabled() {
+		var classifiers []safety.Classifier
+		if params.Safety.InfotextParam != "" {
+			classifiers = append(classifiers, safety.InfotextClassifier{Param: params.Safety.InfotextParam, Threshold: params.Safety.Threshold})
+		}
+		if params.Safety.ClassifierURL != "" {
+			classifiers = append(classifiers, safety.HTTPClassifier{URL: params.Safety.ClassifierURL, Threshold: params.Safety.Threshold})
+		}
+		reqQueue.Safety = safety.New(params.Safety.Keywords, classifiers, params.Safety.Policy, func(chatID int64) safety.Policy {
+			return safety.Policy(chatSettings.Get(chatID).SafetyPolicy)
+		})
+		reqQueue.AdminUserIDs = params.AdminUserIDs
+		cmdHandler.Safety = reqQueue.Safety
+	}
+
+	var httpServer *httpserver.Server
+	if params.ListenAddr != "" {
+		httpServer = httpserver.New(params.ListenAddr)
+		if params.WebhookKey != "" {
+			httpServer.SetTLS(params.WebhookCert, params.WebhookKey)
+		}
+		httpServer.Handle("/metrics", metrics.Handler())
+	}
+	if httpServer != nil && reqQueue.Archive != nil {
+		secret := []byte(params.GallerySecret)
+		if len(secret) == 0 {
+			slog.Warn("gallery secret is not set, gallery links will expire on restart")
+			secret = make([]byte, 32)
+			_, _ = rand.Read(secret)
+		}
+		cmdHandler.Gallery = gallery.New(reqQueue.Archive, params.PublicURL, secret, userService.IsAdmin, func(userID int64) bool {
+			return userService.IsUsageAllowed(userID, userID)
+		})
+		httpServer.Handle(gallery.BasePath, cmdHandler.Gallery)
+	}
+	if httpServer != nil && len(params.APIKeys) > 0 {
+		apiHandler := api.New(&reqQueue, cmdHandler, params.APIKeys, func(userID int64) bool {
+			return userService.IsUsageAllowed(userID, userID)
+		})
+		go apiHandler.RunJobCleaner(ctx, consts.APIJobCleanInterval)
+		httpServer.Handle(api.BasePath, apiHandler)
+	}
 
 	telegramBot, err := telegram.NewBot(params.BotToken, cmdHandler.GetDefaultHandler())
 
 	if nil != err {
-		panic(fmt.Sprint("can't init telegram bot: ", err.Error()))
+		fatal(fmt.Errorf("can't init telegram bot: %w", err))
 	}
-	log.Println("telegramBot", telegramBot)
 	cmdHandler.AddHandlers(telegramBot)
 
+	webhookSecret := params.WebhookSecret
+	if params.WebhookURL != "" {
+		if webhookSecret == "" {
+			secret := make([]byte, 32)
+			_, _ = rand.Read(secret)
+			webhookSecret = hex.EncodeToString(secret)
+		}
+		httpServer.Handle(params.WebhookPath, telegramBot.WebhookHandler(webhookSecret))
+	}
+
 	reqQueue.Init(ctx, &sdApi, telegramBot)
+	go func() {
+		sigterm := make(chan os.Signal, 1)
+		signal.Notify(sigterm, syscall.SIGTERM)
+		select {
+		case <-sigterm:
+			slog.Info("got SIGTERM, draining the queue")
+			reqQueue.Drain(ctx)
+		case <-reqQueue.Drained():
+		case <-ctx.Done():
+			return
+		}
+		cancel()
+	}()
+
+	if httpServer != nil {
+		httpServer.Handle("/healthz", health.Handler(map[string]health.Check{
+			"processor": func(context.Context) error { return reqQueue.Alive() },
+		}, nil, consts.HealthCheckTimeout))
+		// The backend being down doesn't make the bot unready, it's served from the same server as the
+		// webhook, and it keeps answering and queueing the requests, for example during maintenance.
+		httpServer.Handle("/readyz", health.Handler(map[string]health.Check{
+			"telegram": telegramBot.GetMe,
+		}, map[string]health.Check{
+			"sd": sdApi.Ping,
+		}, consts.HealthCheckTimeout))
+		go func() {
+			if err := httpServer.Run(ctx); err != nil {
+				slog.Error("http server stopped", "error", err)
+			}
+		}()
+	}
 
 	verStr, _ := sdapi.VersionCheckGetStr(ctx, params.StableDiffusionApiHost)
 	telegramBot.SendTextToAdmins(ctx, params.AdminUserIDs, consts.BotStartedToAdminsStr+internal.Version+", "+verStr)
-	log.Println("Bot started")
+	slog.Info("bot started")
 	go func() {
 		for {
 			time.Sleep(24 * time.Hour)
@@ -71,5 +216,17 @@ func main() {
 			}
 		}
 	}()
-	telegramBot.Start(ctx)
+	if params.WebhookURL != "" {
+		err = telegramBot.StartWebhook(ctx, telegram.WebhookParams{
+			URL:         params.WebhookURL,
+			SecretToken: webhookSecret,
+			CertFile:    params.WebhookCert,
+		})
+		if err != nil {
+			fatal(err)
+		}
+	} else {
+		telegramBot.Start(ctx)
+	}
+	reqQueue.Shutdown()
 }
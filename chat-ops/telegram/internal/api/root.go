@@ -0,0 +1,292 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/consts"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/moderation"
+	reqqueue "github.com/kanootoko/stable-diffusion-telegram-bot/internal/req_queue"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/reqparams"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/telegram"
+)
+
+// BasePath is where the API is served on the HTTP server.
+const BasePath = "/v1/"
+
+const (
+	// Finished jobs are kept for this long for fetching the results.
+	finishedJobKeepTime = time.Hour
+	maxRequestSize      = 64 * 1024 * 1024
+)
+
+// Returns the username recorded for the jobs of the user in the history, archive, stats and the moderation
+// audit, so they show both the user and that the job came from the API.
+func apiUsername(userID int64) string {
+	return "api:" + strconv.FormatInt(userID, 10)
+}
+
+// ParamsParser parses the request params the same way as the bot commands.
+type ParamsParser interface {
+	RenderParamsFromText(ctx context.Context, chatID int64, text string) (reqparams.ReqParamsRender, error)
+	UpscaleParamsFromText(ctx context.Context, chatID int64, text string) (reqparams.ReqParamsUpscale, error)
+}
+
+// API is the HTTP JSON frontend of the request queue. Requests are authenticated with API keys mapped to
+// Telegram user IDs, they are processed as if the user sent them to the bot in a private chat.
+type API struct {
+	reqQueue  *reqqueue.ReqQueue
+	parser    ParamsParser
+	keys      map[string]int64
+	isAllowed func(userID int64) bool
+
+	mutex sync.Mutex
+	jobs  map[uint64]*reqqueue.Job
+}
+
+func New(reqQueue *reqqueue.ReqQueue, parser ParamsParser, keys map[string]int64, isAllowed func(userID int64) bool) *API {
+	return &API{
+		reqQueue:  reqQueue,
+		parser:    parser,
+		keys:      keys,
+		isAllowed: isAllowed,
+		jobs:      make(map[uint64]*reqqueue.Job),
+	}
+}
+
+type renderRequest struct {
+	// The prompt with the optional negative prompt on the next line and the render params at the end, like
+	// in the bot's /sd command.
+	Prompt string `json:"prompt"`
+}
+
+type upscaleRequest struct {
+	// Base64 encoded image.
+	Image    string `json:"image"`
+	Filename string `json:"filename"`
+	// Upscale params, like "-u 4 -upscaler LDSR".
+	Params string `json:"params"`
+}
+
+type jobResponse struct {
+	ID         string   `json:"id"`
+	State      string   `json:"state"`
+	Progress   int      `json:"progress"`
+	ETASeconds float64  `json:"eta_seconds,omitempty"`
+	Error      string   `json:"error,omitempty"`
+	Filenames  []string `json:"filenames,omitempty"`
+	// Base64 encoded result images, set when the job is done.
+	Images []string `json:"images,omitempty"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	userID, ok := a.authenticate(r)
+	if !ok {
+		writeJSON(w, http.StatusUnauthorized, errorResponse{Error: "invalid api key"})
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, BasePath)
+	switch {
+	case path == "render" && r.Method == http.MethodPost:
+		a.render(w, r, userID)
+	case path == "upscale" && r.Method == http.MethodPost:
+		a.upscale(w, r, userID)
+	case strings.HasPrefix(path, "jobs/") && r.Method == http.MethodGet:
+		a.getJob(w, userID, strings.TrimPrefix(path, "jobs/"))
+	case strings.HasPrefix(path, "jobs/") && r.Method == http.MethodDelete:
+		a.cancelJob(w, userID, strings.TrimPrefix(path, "jobs/"))
+	default:
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "not found"})
+	}
+}
+
+// The key is accepted as a bearer token or in the X-API-Key header.
+func (a *API) authenticate(r *http.Request) (userID int64, ok bool) {
+	key := r.Header.Get("X-API-Key")
+	if auth := r.Header.Get("Authorization"); key == "" && strings.HasPrefix(auth, "Bearer ") {
+		key = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if key == "" {
+		return 0, false
+	}
+	userID, ok = a.keys[key]
+	return userID, ok && a.isAllowed(userID)
+}
+
+func (a *API) render(w http.ResponseWriter, r *http.Request, userID int64) {
+	var req renderRequest
+	if err := readJSON(r, &req); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+	reqParams, err := a.parser.RenderParamsFromText(r.Context(), userID, strings.TrimSpace(req.Prompt))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+	a.addJob(w, reqqueue.ReqTypeRender, reqqueue.NewJob(userID, apiUsername(userID)), reqParams, nil)
+}
+
+func (a *API) upscale(w http.ResponseWriter, r *http.Request, userID int64) {
+	var req upscaleRequest
+	if err := readJSON(r, &req); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+	img, err := base64.StdEncoding.DecodeString(req.Image)
+	if err != nil || len(img) == 0 {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid image"})
+		return
+	}
+	if req.Filename == "" {
+		req.Filename = "image.png"
+	}
+	reqParams, err := a.parser.UpscaleParamsFromText(r.Context(), userID, req.Params)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+	a.addJob(w, reqqueue.ReqTypeUpscale, reqqueue.NewJob(userID, apiUsername(userID)), reqParams, &telegram.ImageFileData{Data: img, Filename: req.Filename})
+}
+
+func (a *API) addJob(w http.ResponseWriter, reqType reqqueue.ReqType, job *reqqueue.Job, reqParams reqparams.ReqParams, image *telegram.ImageFileData) {
+	taskID, err := a.reqQueue.Add(reqqueue.ReqQueueReq{
+		Type:     reqType,
+		Params:   reqParams,
+		Delivery: job,
+		UserID:   job.UserID,
+		Username: job.Username,
+		Image:    image,
+	})
+	if err != nil {
+		status := addErrorStatus(err)
+		if status == http.StatusServiceUnavailable {
+			w.Header().Set("Retry-After", strconv.Itoa(int(consts.APIRetryAfter.Seconds())))
+		}
+		writeJSON(w, status, errorResponse{Error: err.Error()})
+		return
+	}
+	slog.Info("api job queued", "task_id", taskID, "user_id", job.UserID)
+
+	a.mutex.Lock()
+	a.jobs[taskID] = job
+	a.mutex.Unlock()
+
+	writeJSON(w, http.StatusAccepted, jobResponse{ID: strconv.FormatUint(taskID, 10), State: string(reqqueue.JobStateQueued)})
+}
+
+func (a *API) removeOldJobs() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for id, job := range a.jobs {
+		if finished := job.Snapshot().Finished; !finished.IsZero() && time.Since(finished) > finishedJobKeepTime {
+			delete(a.jobs, id)
+		}
+	}
+}
+
+// RunJobCleaner removes the finished jobs older than finishedJobKeepTime periodically until the context is
+// done, so their results are released even if they are never fetched.
+func (a *API) RunJobCleaner(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.removeOldJobs()
+		}
+	}
+}
+
+// Returns the HTTP status of the error of a rejected job. The job can be retried later in maintenance and
+// while the bot is restarting.
+func addErrorStatus(err error) int {
+	var rejectedErr *moderation.RejectedError
+	var maintenanceErr *reqqueue.MaintenanceError
+	switch {
+	case errors.As(err, &rejectedErr):
+		return http.StatusForbidden
+	case errors.As(err, &maintenanceErr), errors.Is(err, reqqueue.ErrRestarting):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// Returns the job if it belongs to the user.
+func (a *API) getUserJob(userID int64, idStr string) (taskID uint64, job *reqqueue.Job, found bool) {
+	taskID, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		return 0, nil, false
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	job, found = a.jobs[taskID]
+	return taskID, job, found && job.UserID == userID
+}
+
+func (a *API) getJob(w http.ResponseWriter, userID int64, idStr string) {
+	taskID, job, found := a.getUserJob(userID, idStr)
+	if !found {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "job not found"})
+		return
+	}
+
+	s := job.Snapshot()
+	res := jobResponse{
+		ID:         strconv.FormatUint(taskID, 10),
+		State:      string(s.State),
+		Progress:   s.Progress,
+		ETASeconds: s.ETA.Seconds(),
+		Error:      s.Error,
+		Filenames:  s.Filenames,
+	}
+	for _, img := range s.Results {
+		res.Images = append(res.Images, base64.StdEncoding.EncodeToString(img))
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (a *API) cancelJob(w http.ResponseWriter, userID int64, idStr string) {
+	taskID, job, found := a.getUserJob(userID, idStr)
+	if !found {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "job not found"})
+		return
+	}
+	if err := a.reqQueue.CancelEntry(taskID); err != nil {
+		writeJSON(w, http.StatusConflict, errorResponse{Error: "job is already " + string(job.Snapshot().State)})
+		return
+	}
+	writeJSON(w, http.StatusOK, jobResponse{ID: idStr, State: string(reqqueue.JobStateCanceled)})
+}
+
+func readJSON(r *http.Request, v any) error {
+	if err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxRequestSize)).Decode(v); err != nil {
+		return fmt.Errorf("invalid request body: %w", err)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("api response write error", "error", err)
+	}
+}
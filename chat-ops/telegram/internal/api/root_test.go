@@ -0,0 +1,28 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/moderation"
+	reqqueue "github.com/kanootoko/stable-diffusion-telegram-bot/internal/req_queue"
+)
+
+func TestAddErrorStatus(t *testing.T) {
+	for _, tt := range []struct {
+		err    error
+		status int
+	}{
+		{&moderation.RejectedError{Reason: "no"}, http.StatusForbidden},
+		{&reqqueue.MaintenanceError{Message: "new GPU"}, http.StatusServiceUnavailable},
+		{reqqueue.ErrRestarting, http.StatusServiceUnavailable},
+		{fmt.Errorf("wrapped: %w", reqqueue.ErrRestarting), http.StatusServiceUnavailable},
+		{errors.New("other"), http.StatusInternalServerError},
+	} {
+		if status := addErrorStatus(tt.err); status != tt.status {
+			t.Errorf("%v got status %d", tt.err, status)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sidecarExt = ".json"
+	// Cached thumbnails are saved next to the images with this extension.
+	thumbExt = ".thumb"
+)
+
+// Metadata is saved next to each archived image as a JSON sidecar file.
+type Metadata struct {
+	Time     time.Time `json:"time"`
+	TaskID   uint64    `json:"task_id"`
+	UserID   int64     `json:"user_id"`
+	Username string    `json:"username,omitempty"`
+	ChatID   int64     `json:"chat_id"`
+	Type     string    `json:"type"`
+	Prompt   string    `json:"prompt"`
+	Model    string    `json:"model,omitempty"`
+	Infotext string    `json:"infotext,omitempty"`
+	Params   any       `json:"params,omitempty"`
+}
+
+// Archive saves the result images under dir/YYYY/MM/DD/<user ID>/. Files older than maxAge are pruned and
+// the oldest ones are removed when the total size exceeds maxSize, zero values disable the limits.
+type Archive struct {
+	mutex   sync.Mutex
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+
+	// Metadata of the archived images, oldest first.
+	index []Entry
+	// The same entries by path.
+	byPath map[string]Entry
+}
+
+// Entry is an archived image, the path is relative to the archive dir and uses forward slashes.
+type Entry struct {
+	Metadata
+	Path string
+}
+
+func New(dir string, maxSize int64, maxAge time.Duration) (*Archive, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("can't create archive dir: %w", err)
+	}
+	a := &Archive{
+		dir:     dir,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		byPath:  make(map[string]Entry),
+	}
+	if err := a.loadIndex(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reads the sidecars of the images already in the archive.
+func (a *Archive) loadIndex() error {
+	err := filepath.WalkDir(a.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, sidecarExt) {
+			return err
+		}
+		imgPath := strings.TrimSuffix(path, sidecarExt)
+		if _, err = os.Stat(imgPath); err != nil {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var e Entry
+		if err = json.Unmarshal(data, &e.Metadata); err != nil {
+			slog.Warn("skipping invalid archive sidecar", "path", path, "error", err)
+			return nil
+		}
+		if e.Path, err = filepath.Rel(a.dir, imgPath); err != nil {
+			return err
+		}
+		e.Path = filepath.ToSlash(e.Path)
+		a.index = append(a.index, e)
+		a.byPath[e.Path] = e
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("can't read archive dir: %w", err)
+	}
+	sort.SliceStable(a.index, func(i, j int) bool { return a.index[i].Time.Before(a.index[j].Time) })
+	return nil
+}
+
+// List returns the archived images for which filter returns true, newest first. The filter is optional.
+func (a *Archive) List(filter func(e Entry) bool) (res []Entry) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for i := len(a.index) - 1; i >= 0; i-- {
+		if filter == nil || filter(a.index[i]) {
+			res = append(res, a.index[i])
+		}
+	}
+	return
+}
+
+// Get returns the archived image with the given path.
+func (a *Archive) Get(path string) (e Entry, found bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	e, found = a.byPath[path]
+	return
+}
+
+// ReadImage returns the data of an archived image. Only paths returned by List or Get are accepted, so it
+// can't be used for reading files outside the archive.
+func (a *Archive) ReadImage(path string) ([]byte, error) {
+	if _, found := a.Get(path); !found {
+		return nil, os.ErrNotExist
+	}
+	return os.ReadFile(filepath.Join(a.dir, filepath.FromSlash(path)))
+}
+
+// ReadThumbnail returns the thumbnail of an archived image. It's created from the image data with create
+// on the first call and cached next to the image, it's removed together with the image.
+func (a *Archive) ReadThumbnail(path string, create func(img []byte) ([]byte, error)) ([]byte, error) {
+	if _, found := a.Get(path); !found {
+		return nil, os.ErrNotExist
+	}
+	filename := filepath.Join(a.dir, filepath.FromSlash(path))
+	if data, err := os.ReadFile(filename + thumbExt); err == nil {
+		return data, nil
+	}
+	img, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	data, err := create(img)
+	if err != nil {
+		return nil, err
+	}
+
+	// Locked, so the image is not pruned while the thumbnail is written.
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if _, found := a.byPath[path]; !found {
+		return data, nil
+	}
+	// Renamed, so the thumbnail is never read half-written.
+	tmpFilename := filename + thumbExt + ".tmp"
+	if err = os.WriteFile(tmpFilename, data, 0o644); err == nil {
+		err = os.Rename(tmpFilename, filename+thumbExt)
+	}
+	if err != nil {
+		_ = os.Remove(tmpFilename)
+		slog.Warn("can't cache archive thumbnail", "path", path, "error", err)
+	}
+	return data, nil
+}
+
+// Save writes the images with their sidecar files. The infotexts belong to the images with the same index,
+// the last one is used for the images without an own one.
+func (a *Archive) Save(meta Metadata, imgs [][]byte, filenames []string, infotexts []string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	relDir := filepath.Join(meta.Time.Format("2006"), meta.Time.Format("01"), meta.Time.Format("02"), fmt.Sprint(meta.UserID))
+	dir := filepath.Join(a.dir, relDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("can't create archive dir: %w", err)
+	}
+
+	for i := range imgs {
+		m := meta
+		if len(infotexts) > 0 {
+			m.Infotext = infotexts[min(i, len(infotexts)-1)]
+		}
+		sidecar, err := json.MarshalIndent(m, "", "  ")
+		if err != nil {
+			return fmt.Errorf("can't encode archive metadata: %w", err)
+		}
+
+		filename := filepath.Join(dir, filepath.Base(filenames[i]))
+		if err = os.WriteFile(filename, imgs[i], 0o644); err != nil {
+			return fmt.Errorf("can't write archive file: %w", err)
+		}
+		if err = os.WriteFile(filename+sidecarExt, sidecar, 0o644); err != nil {
+			return fmt.Errorf("can't write archive file: %w", err)
+		}
+		e := Entry{Metadata: m, Path: filepath.ToSlash(filepath.Join(relDir, filepath.Base(filenames[i])))}
+		a.index = append(a.index, e)
+		a.byPath[e.Path] = e
+	}
+	return nil
+}
+
+type archivedFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// Prune removes the files exceeding the retention limits, sidecars and thumbnails are removed together with
+// their images.
+func (a *Archive) Prune() error {
+	if a.maxSize <= 0 && a.maxAge <= 0 {
+		return nil
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	var files []archivedFile
+	// Sizes of the sidecars and thumbnails by their image.
+	extraSizes := make(map[string]int64)
+	err := filepath.WalkDir(a.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(path, sidecarExt) {
+			extraSizes[strings.TrimSuffix(path, sidecarExt)] += info.Size()
+			return nil
+		}
+		if i := strings.LastIndex(path, thumbExt); i >= 0 {
+			extraSizes[path[:i]] += info.Size()
+			return nil
+		}
+		files = append(files, archivedFile{path: path, size: info.Size(), modTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("can't list archive dir: %w", err)
+	}
+
+	var totalSize int64
+	for i := range files {
+		files[i].size += extraSizes[files[i].path]
+		totalSize += files[i].size
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+
+	var removedCount int
+	for _, f := range files {
+		expired := a.maxAge > 0 && time.Since(f.modTime) > a.maxAge
+		if !expired && (a.maxSize <= 0 || totalSize <= a.maxSize) {
+			break
+		}
+		if err = os.Remove(f.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("can't remove archive file: %w", err)
+		}
+		_ = os.Remove(f.path + sidecarExt)
+		_ = os.Remove(f.path + thumbExt)
+		_ = os.Remove(f.path + thumbExt + ".tmp")
+		totalSize -= f.size
+		removedCount++
+	}
+	if removedCount > 0 {
+		slog.Info("archive pruned", "files", removedCount)
+		a.removeEmptyDirs()
+		a.index = slices.DeleteFunc(a.index, func(e Entry) bool {
+			_, err := os.Stat(filepath.Join(a.dir, filepath.FromSlash(e.Path)))
+			if err != nil {
+				delete(a.byPath, e.Path)
+			}
+			return err != nil
+		})
+	}
+	return nil
+}
+
+// Removes the day and user dirs left empty after pruning, deepest first.
+func (a *Archive) removeEmptyDirs() {
+	var dirs []string
+	_ = filepath.WalkDir(a.dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() && path != a.dir {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0; i-- {
+		// Fails for non-empty dirs.
+		_ = os.Remove(dirs[i])
+	}
+}
+
+// RunPruner prunes the archive periodically until the context is done.
+func (a *Archive) RunPruner(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := a.Prune(); err != nil {
+			slog.ErrorContext(ctx, "archive prune error", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
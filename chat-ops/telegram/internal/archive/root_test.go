@@ -0,0 +1,69 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadThumbnail(t *testing.T) {
+	a, err := New(t.TempDir(), 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Save(Metadata{Time: time.Now(), UserID: 1}, [][]byte{[]byte("image")}, []string{"a.png"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	entries := a.List(nil)
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries", len(entries))
+	}
+	path := entries[0].Path
+	if _, found := a.Get(path); !found {
+		t.Fatal("saved image not found")
+	}
+
+	creates := 0
+	create := func(img []byte) ([]byte, error) {
+		creates++
+		return append([]byte("thumb of "), img...), nil
+	}
+	for i := 0; i < 2; i++ {
+		data, err := a.ReadThumbnail(path, create)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "thumb of image" {
+			t.Errorf("got thumbnail %q", data)
+		}
+	}
+	if creates != 1 {
+		t.Errorf("thumbnail created %d times", creates)
+	}
+	if _, err = a.ReadThumbnail("../a.png", create); !os.IsNotExist(err) {
+		t.Errorf("thumbnail of a path outside the archive got %v", err)
+	}
+
+	// The thumbnail is not an archived image on its own, it's pruned together with the image.
+	filename := filepath.Join(a.dir, filepath.FromSlash(path))
+	old := time.Now().Add(-2 * time.Hour)
+	for _, name := range []string{filename, filename + sidecarExt, filename + thumbExt} {
+		if err = os.Chtimes(name, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = a.Prune(); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := a.Get(path); found {
+		t.Error("pruned image found")
+	}
+	files, err := os.ReadDir(a.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("archive dir not empty after pruning: %v", files)
+	}
+}
@@ -0,0 +1,98 @@
+package chatsettings
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+)
+
+// Settings of a chat, zero values mean that the bot defaults are used.
+type Settings struct {
+	OutputFormat  string `json:"output_format,omitempty"`
+	OutputQuality int    `json:"output_quality,omitempty"`
+	Grid          bool   `json:"grid,omitempty"`
+	SafetyPolicy  string `json:"safety_policy,omitempty"`
+	// Moderation rules of the chat, see moderation.ParseRule.
+	Blocklist            []string `json:"blocklist,omitempty"`
+	ForcedNegativePrompt string   `json:"forced_negative_prompt,omitempty"`
+}
+
+func (s Settings) isEmpty() bool {
+	return reflect.DeepEqual(s, Settings{})
+}
+
+// Store keeps the per-chat settings. If filename is set, the settings are saved to the file on each change
+// and loaded on startup, otherwise they are kept in memory only.
+type Store struct {
+	mutex    sync.Mutex
+	filename string
+	settings map[int64]Settings
+}
+
+func NewStore(filename string) (*Store, error) {
+	s := &Store{
+		filename: filename,
+		settings: make(map[int64]Settings),
+	}
+	if filename == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("can't read chat settings file: %w", err)
+	}
+	if err = json.Unmarshal(data, &s.settings); err != nil {
+		return nil, fmt.Errorf("can't parse chat settings file: %w", err)
+	}
+	return s, nil
+}
+
+func (s *Store) Get(chatID int64) Settings {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.settings[chatID]
+}
+
+// Update changes the settings of the given chat with the given function and saves them.
+func (s *Store) Update(chatID int64, fn func(settings *Settings)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	settings := s.settings[chatID]
+	fn(&settings)
+	if len(settings.Blocklist) == 0 {
+		settings.Blocklist = nil
+	}
+	if settings.isEmpty() {
+		delete(s.settings, chatID)
+	} else {
+		s.settings[chatID] = settings
+	}
+	return s.save()
+}
+
+func (s *Store) save() error {
+	if s.filename == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.settings, "", "  ")
+	if err != nil {
+		return fmt.Errorf("can't encode chat settings: %w", err)
+	}
+	// Writing to a temp file first, so a crash can't leave a truncated file behind.
+	tmpFilename := s.filename + ".tmp"
+	if err = os.WriteFile(tmpFilename, data, 0o644); err != nil {
+		return fmt.Errorf("can't write chat settings file: %w", err)
+	}
+	if err = os.Rename(tmpFilename, s.filename); err != nil {
+		return fmt.Errorf("can't write chat settings file: %w", err)
+	}
+	return nil
+}
@@ -1,13 +1,21 @@
 package config
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"log/slog"
+	"net/url"
 	"os"
+	"regexp"
 	"slices"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/imgenc"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/logging"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/safety"
 )
 
 type GenerationDefaults struct {
@@ -27,11 +35,12 @@ type GenerationDefaults struct {
 	KukaNegativePrompt string
 	KukaCFGScale       float64
 	KukaSteps          int
+	Output             imgenc.Options
 }
 
 func (d GenerationDefaults) String() string {
 	return fmt.Sprintf(
-		"{model: %s, sampler: %s, cnt: %d, batch: %d, steps: %d, width: %d, height: %d, widthXL: %d, heightXL: %d, stepsXL: %d, cfg: %.2f}",
+		"{model: %s, sampler: %s, cnt: %d, batch: %d, steps: %d, width: %d, height: %d, widthXL: %d, heightXL: %d, stepsXL: %d, cfg: %.2f, output: %v}",
 		d.Model,
 		d.Sampler,
 		d.Cnt,
@@ -43,9 +52,44 @@ func (d GenerationDefaults) String() string {
 		d.HeightSDXL,
 		d.StepsSDXL,
 		d.CFGScale,
+		d.Output,
 	)
 }
 
+// InlineParams are used for the renders requested with inline queries.
+type InlineParams struct {
+	// Render params applied after the ones in the query.
+	Preset string
+	// The images are uploaded to this chat for getting their file IDs, to the user's private chat if not set.
+	CacheChatID int64
+}
+
+// SafetyParams configure the NSFW checks, they are disabled if no keywords or classifiers are set.
+type SafetyParams struct {
+	Keywords []string
+	// Name of the infotext param set by a WebUI extension with the NSFW score of the image.
+	InfotextParam string
+	// URL of an external classifier the images are posted to.
+	ClassifierURL string
+	Threshold     float64
+	// Policy of the chats which have no policy set.
+	Policy safety.Policy
+}
+
+func (s SafetyParams) Enabled() bool {
+	return len(s.Keywords) > 0 || s.InfotextParam != "" || s.ClassifierURL != ""
+}
+
+// ModerationParams configure the checks of the prompts before queueing.
+type ModerationParams struct {
+	// Blocklist rules for all chats, see moderation.ParseRule.
+	Blocklist []string
+	// URL of an external moderation service the prompts are posted to.
+	HookURL string
+	// Rejected prompts are appended to this file if set.
+	AuditFile string
+}
+
 type AppParams struct {
 	StableDiffusionApiHost string
 
@@ -53,20 +97,74 @@ type AppParams struct {
 	AllowedUserIDs  []int64
 	AdminUserIDs    []int64
 	AllowedGroupIDs []int64
-	ProcessTimeout  time.Duration
+	// Forum topic IDs the bot is restricted to in groups, groups not in the map aren't restricted.
+	AllowedTopics  map[int64][]int
+	ProcessTimeout time.Duration
+	// Requests added in maintenance are queued until it's over if set, rejected otherwise.
+	MaintenanceHold bool
+
+	ChatSettingsFile string
+	HistoryFile      string
+	StatsFile        string
+
+	ArchiveDir     string
+	ArchiveMaxSize int64
+	ArchiveMaxAge  time.Duration
+
+	ListenAddr    string
+	PublicURL     string
+	GallerySecret string
+
+	// API keys mapped to user IDs.
+	APIKeys map[string]int64
+
+	// Updates are received with long polling if the webhook URL is not set.
+	WebhookURL    string
+	WebhookPath   string
+	WebhookSecret string
+	WebhookCert   string
+	WebhookKey    string
+
+	Inline     InlineParams
+	Safety     SafetyParams
+	Moderation ModerationParams
+
+	// Command running nvidia-smi for the GPU status, the WebUI API is used if not set.
+	GPUStatusCommand []string
+
+	LogLevel  slog.Level
+	LogFormat string
 
 	Defaults GenerationDefaults
 }
 
 func (p AppParams) String() string {
 	return fmt.Sprintf(
-		"{sdAPI: %s, token: ...%s, admins: %v, allowedUsers: %v, allowedGroups: %v, processTimeout: %v, defaults: %v}",
+		"{sdAPI: %s, token: ...%s, admins: %v, allowedUsers: %v, allowedGroups: %v, allowedTopics: %v, processTimeout: %v, maintenanceHold: %v, chatSettingsFile: %s, historyFile: %s, statsFile: %s, archiveDir: %s, archiveMaxSize: %dMB, archiveMaxAge: %v, listenAddr: %s, publicURL: %s, apiKeys: %d, webhookURL: %s, inline: %+v, safety: %+v, moderation: %+v, gpuStatusCommand: %q, logLevel: %v, logFormat: %s, defaults: %v}",
 		p.StableDiffusionApiHost,
 		p.BotToken[max(len(p.BotToken)-4, 0):],
 		p.AdminUserIDs,
 		p.AllowedUserIDs,
 		p.AllowedGroupIDs,
+		p.AllowedTopics,
 		p.ProcessTimeout,
+		p.MaintenanceHold,
+		p.ChatSettingsFile,
+		p.HistoryFile,
+		p.StatsFile,
+		p.ArchiveDir,
+		p.ArchiveMaxSize/1024/1024,
+		p.ArchiveMaxAge,
+		p.ListenAddr,
+		p.PublicURL,
+		len(p.APIKeys),
+		p.WebhookURL,
+		p.Inline,
+		p.Safety,
+		p.Moderation,
+		p.GPUStatusCommand,
+		p.LogLevel,
+		p.LogFormat,
 		p.Defaults,
 	)
 }
@@ -83,7 +181,11 @@ func (p *AppParams) Init() error {
 	flag.StringVar(&adminUserIDs, "admin-user-ids", defaults.AdminUserIDs, "admin telegram user ids")
 	var allowedGroupIDs string
 	flag.StringVar(&allowedGroupIDs, "allowed-group-ids", defaults.AllowedGroupIDs, "allowed telegram group ids")
+	var allowedTopics string
+	flag.StringVar(&allowedTopics, "allowed-topics", defaults.AllowedTopics, "forum topics the bot is restricted to, like groupID1:topicID1,groupID1:topicID2, use 0 for the General topic")
 	flag.DurationVar(&p.ProcessTimeout, "process-timeout", defaults.ProcessTimeout, "maximum time before generation auto-cancel")
+	var maintenanceQueue string
+	flag.StringVar(&maintenanceQueue, "maintenance-queue", defaults.MaintenanceQueue, "what happens with the requests added in maintenance mode (hold or reject)")
 	flag.StringVar(&p.Defaults.Model, "default-model", defaults.Model, "default model name")
 	flag.StringVar(&p.Defaults.Sampler, "default-sampler", defaults.Sampler, "default sampler name")
 	flag.IntVar(&p.Defaults.Cnt, "default-cnt", defaults.Cnt, "default images count")
@@ -98,7 +200,45 @@ func (p *AppParams) Init() error {
 	flag.StringVar(&p.Defaults.KukaModel, "default-kuka-model", defaults.KukaModel, "default Kuka model name")
 	flag.StringVar(&p.Defaults.KukaPrompt, "default-kuka-prompt", defaults.KukaPrompt, "default Kuka prompt")
 	flag.StringVar(&p.Defaults.KukaNegativePrompt, "default-kuka-negative-prompt", defaults.KukaNegativePrompt, "default Kuka negative prompt")
+	var outputFormat string
+	flag.StringVar(&outputFormat, "default-output-format", defaults.OutputFormat, "default output image format (jpeg, png or webp)")
+	flag.IntVar(&p.Defaults.Output.Quality, "default-output-quality", defaults.OutputQuality, "default output image quality (1-100, 100 is lossless for webp)")
+	flag.StringVar(&p.ChatSettingsFile, "chat-settings-file", defaults.ChatSettingsFile, "file for storing per-chat settings, they are kept in memory only if not set")
+	flag.StringVar(&p.HistoryFile, "history-file", defaults.HistoryFile, "file for storing the request history, it's kept in memory only if not set")
+	flag.StringVar(&p.StatsFile, "stats-file", defaults.StatsFile, "file for storing the request outcomes for /stats, they are kept in memory only if not set")
+	flag.StringVar(&p.ArchiveDir, "archive-dir", defaults.ArchiveDir, "dir for archiving the original images, archiving is disabled if not set")
+	var archiveMaxSizeMB int64
+	flag.Int64Var(&archiveMaxSizeMB, "archive-max-size", defaults.ArchiveMaxSizeMB, "maximum archive size in megabytes, the oldest images are removed when it's exceeded (0 is unlimited)")
+	flag.DurationVar(&p.ArchiveMaxAge, "archive-max-age", defaults.ArchiveMaxAge, "archived images older than this are removed (0 is unlimited)")
+	flag.StringVar(&p.ListenAddr, "listen-addr", defaults.ListenAddr, "address of the HTTP server (for example :8080), it's disabled if not set")
+	flag.StringVar(&p.PublicURL, "public-url", defaults.PublicURL, "URL of the HTTP server as seen by the users, used for the gallery links")
+	flag.StringVar(&p.GallerySecret, "gallery-secret", defaults.GallerySecret, "secret for signing the gallery links, a random one is used if not set, so links expire on restart")
+	var apiKeys string
+	flag.StringVar(&apiKeys, "api-keys", defaults.APIKeys, "API keys with the user IDs they belong to, like key1:userID1,key2:userID2, the API is disabled if not set")
+	flag.StringVar(&p.WebhookURL, "webhook-url", defaults.WebhookURL, "public HTTPS URL Telegram sends the updates to, served on -listen-addr, long polling is used if not set")
+	flag.StringVar(&p.WebhookSecret, "webhook-secret", defaults.WebhookSecret, "secret token Telegram sends with the webhook updates (A-Z, a-z, 0-9, _ and -), a random one is used if not set")
+	flag.StringVar(&p.WebhookCert, "webhook-cert", defaults.WebhookCert, "self-signed certificate (PEM) uploaded to Telegram when setting the webhook")
+	flag.StringVar(&p.WebhookKey, "webhook-key", defaults.WebhookKey, "private key of -webhook-cert, if set the HTTP server serves HTTPS with them")
+	flag.StringVar(&p.Inline.Preset, "inline-preset", defaults.InlinePreset, "render params of inline mode renders, they override the ones in the query")
+	flag.Int64Var(&p.Inline.CacheChatID, "inline-cache-chat-id", defaults.InlineCacheChatID, "chat the inline mode renders are uploaded to, the user's private chat is used if not set")
+	var nsfwKeywords string
+	flag.StringVar(&nsfwKeywords, "nsfw-keywords", defaults.NSFWKeywords, "comma separated words which flag a prompt as NSFW")
+	flag.StringVar(&p.Safety.InfotextParam, "nsfw-infotext-param", defaults.NSFWInfotextParam, "infotext param with the NSFW score of the image, set by a WebUI extension")
+	flag.StringVar(&p.Safety.ClassifierURL, "nsfw-classifier-url", defaults.NSFWClassifierURL, "URL of an NSFW classifier the rendered images are posted to")
+	flag.Float64Var(&p.Safety.Threshold, "nsfw-threshold", defaults.NSFWThreshold, "NSFW score from which images are flagged")
+	var safetyPolicy string
+	flag.StringVar(&safetyPolicy, "safety-policy", defaults.SafetyPolicy, "what happens with NSFW results by default (allow, spoiler or block), can be changed per chat with /safety")
+	var blocklist string
+	flag.StringVar(&blocklist, "blocklist", defaults.Blocklist, "comma separated words or /regexes/ rejected in the prompts of all chats")
+	flag.StringVar(&p.Moderation.HookURL, "moderation-hook-url", defaults.ModerationHookURL, "URL of an external moderation service the prompts are posted to before queueing")
+	flag.StringVar(&p.Moderation.AuditFile, "moderation-audit-file", defaults.ModerationAuditFile, "file for storing the rejected prompts, they are kept in memory only if not set")
+	var gpuStatusCommand string
+	flag.StringVar(&gpuStatusCommand, "gpu-status-command", defaults.GPUStatusCommand, "command running nvidia-smi on the GPU host for /smi, like \"ssh gpu-host nvidia-smi\", the WebUI API is used if not set")
+	var logLevel string
+	flag.StringVar(&logLevel, "log-level", defaults.LogLevel, "log level (debug, info, warn or error)")
+	flag.StringVar(&p.LogFormat, "log-format", defaults.LogFormat, "log format (text or json)")
 	flag.Parse()
+	p.ArchiveMaxSize = archiveMaxSizeMB * 1024 * 1024
 	if value, isSet := os.LookupEnv("DEFAULT_KUKA_PROMPT"); isSet {
 		defaults.KukaPrompt = value
 	}
@@ -133,6 +273,14 @@ func (p *AppParams) Init() error {
 		return fmt.Errorf("bot token not set")
 	}
 
+	var err error
+	if p.Defaults.Output.Format, err = imgenc.ParseFormat(outputFormat); err != nil {
+		return fmt.Errorf("default output format: %w", err)
+	}
+	if err = p.Defaults.Output.Validate(); err != nil {
+		return fmt.Errorf("default output options: %w", err)
+	}
+
 	sa := strings.Split(allowedUserIDs, ",")
 	for _, idStr := range sa {
 		if idStr == "" {
@@ -160,6 +308,85 @@ func (p *AppParams) Init() error {
 		}
 	}
 
+	p.APIKeys = make(map[string]int64)
+	for _, keyStr := range strings.Split(apiKeys, ",") {
+		if keyStr == "" {
+			continue
+		}
+		key, idStr, found := strings.Cut(keyStr, ":")
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if !found || key == "" || err != nil {
+			return fmt.Errorf("api keys contains invalid key, it should be key:userID")
+		}
+		p.APIKeys[key] = id
+	}
+
+	if p.WebhookURL != "" {
+		if p.ListenAddr == "" {
+			return fmt.Errorf("webhook url is set without listen addr")
+		}
+		u, err := url.Parse(p.WebhookURL)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("webhook url should be an https URL")
+		}
+		p.WebhookPath = u.Path
+		if p.WebhookPath == "" {
+			p.WebhookPath = "/"
+		}
+		if p.WebhookSecret != "" && !regexp.MustCompile(`^[A-Za-z0-9_-]{1,256}$`).MatchString(p.WebhookSecret) {
+			return fmt.Errorf("webhook secret can only contain A-Z, a-z, 0-9, _ and - characters")
+		}
+	}
+	if p.WebhookKey != "" && p.WebhookCert == "" {
+		return fmt.Errorf("webhook key is set without webhook cert")
+	}
+
+	for _, keyword := range strings.Split(nsfwKeywords, ",") {
+		if keyword = strings.TrimSpace(keyword); keyword != "" {
+			p.Safety.Keywords = append(p.Safety.Keywords, keyword)
+		}
+	}
+	if p.Safety.Policy, err = safety.ParsePolicy(safetyPolicy); err != nil {
+		return err
+	}
+	p.GPUStatusCommand = strings.Fields(gpuStatusCommand)
+	switch maintenanceQueue {
+	case "hold":
+		p.MaintenanceHold = true
+	case "reject":
+	default:
+		return fmt.Errorf("invalid maintenance queue, valid values are hold and reject")
+	}
+	if p.LogLevel, err = logging.ParseLevel(logLevel); err != nil {
+		return err
+	}
+	if p.LogFormat = strings.ToLower(p.LogFormat); p.LogFormat != "text" && p.LogFormat != "json" {
+		return fmt.Errorf("invalid log format, valid values are text and json")
+	}
+
+	for _, rule := range strings.Split(blocklist, ",") {
+		if rule = strings.TrimSpace(rule); rule != "" {
+			p.Moderation.Blocklist = append(p.Moderation.Blocklist, rule)
+		}
+	}
+
+	p.AllowedTopics = make(map[int64][]int)
+	for _, topicStr := range strings.Split(allowedTopics, ",") {
+		if topicStr == "" {
+			continue
+		}
+		groupIDStr, topicIDStr, found := strings.Cut(topicStr, ":")
+		groupID, err := strconv.ParseInt(groupIDStr, 10, 64)
+		if !found || err != nil {
+			return errors.New("allowed topics contains invalid group ID: " + topicStr)
+		}
+		topicID, err := strconv.Atoi(topicIDStr)
+		if err != nil {
+			return errors.New("allowed topics contains invalid topic ID: " + topicStr)
+		}
+		p.AllowedTopics[groupID] = append(p.AllowedTopics[groupID], topicID)
+	}
+
 	sa = strings.Split(allowedGroupIDs, ",")
 	for _, idStr := range sa {
 		if idStr == "" {
@@ -190,12 +417,43 @@ type defaultsFromEnv struct {
 	AllowedUserIDs         string
 	AdminUserIDs           string
 	AllowedGroupIDs        string
+	AllowedTopics          string
 	ProcessTimeout         time.Duration
 	KukaPrompt             string
 	KukaNegativePrompt     string
 	KukaModel              string
 	KukaCFGScale           float64
 	KukaSteps              int
+	OutputFormat           string
+	OutputQuality          int
+	ChatSettingsFile       string
+	HistoryFile            string
+	ArchiveDir             string
+	ArchiveMaxSizeMB       int64
+	ArchiveMaxAge          time.Duration
+	ListenAddr             string
+	PublicURL              string
+	GallerySecret          string
+	APIKeys                string
+	WebhookURL             string
+	WebhookSecret          string
+	WebhookCert            string
+	WebhookKey             string
+	InlinePreset           string
+	InlineCacheChatID      int64
+	NSFWKeywords           string
+	NSFWInfotextParam      string
+	NSFWClassifierURL      string
+	NSFWThreshold          float64
+	SafetyPolicy           string
+	Blocklist              string
+	ModerationHookURL      string
+	ModerationAuditFile    string
+	MaintenanceQueue       string
+	StatsFile              string
+	GPUStatusCommand       string
+	LogLevel               string
+	LogFormat              string
 }
 
 func getDefaultsFromEnv() (defaults defaultsFromEnv) {
@@ -309,12 +567,132 @@ func getDefaultsFromEnv() (defaults defaultsFromEnv) {
 	} else {
 		defaults.CFGScale = 7.0
 	}
+	if value, isSet := os.LookupEnv("DEFAULT_OUTPUT_FORMAT"); isSet {
+		defaults.OutputFormat = value
+	} else {
+		defaults.OutputFormat = string(imgenc.FormatJPEG)
+	}
+	if value, isSet := os.LookupEnv("DEFAULT_OUTPUT_QUALITY"); isSet {
+		if intValue, err := strconv.Atoi(value); err == nil {
+			defaults.OutputQuality = intValue
+		} else {
+			defaults.OutputQuality = 80
+		}
+	} else {
+		defaults.OutputQuality = 80
+	}
+	if value, isSet := os.LookupEnv("CHAT_SETTINGS_FILE"); isSet {
+		defaults.ChatSettingsFile = value
+	}
+	if value, isSet := os.LookupEnv("HISTORY_FILE"); isSet {
+		defaults.HistoryFile = value
+	}
+	if value, isSet := os.LookupEnv("ARCHIVE_DIR"); isSet {
+		defaults.ArchiveDir = value
+	}
+	if value, isSet := os.LookupEnv("ARCHIVE_MAX_SIZE"); isSet {
+		if intValue, err := strconv.ParseInt(value, 10, 64); err == nil {
+			defaults.ArchiveMaxSizeMB = intValue
+		}
+	}
+	if value, isSet := os.LookupEnv("ARCHIVE_MAX_AGE"); isSet {
+		if duration, err := time.ParseDuration(value); err == nil {
+			defaults.ArchiveMaxAge = duration
+		}
+	}
+	if value, isSet := os.LookupEnv("LISTEN_ADDR"); isSet {
+		defaults.ListenAddr = value
+	}
+	if value, isSet := os.LookupEnv("PUBLIC_URL"); isSet {
+		defaults.PublicURL = value
+	}
+	if value, isSet := os.LookupEnv("GALLERY_SECRET"); isSet {
+		defaults.GallerySecret = value
+	}
+	if value, isSet := os.LookupEnv("API_KEYS"); isSet {
+		defaults.APIKeys = value
+	}
+	if value, isSet := os.LookupEnv("WEBHOOK_URL"); isSet {
+		defaults.WebhookURL = value
+	}
+	if value, isSet := os.LookupEnv("WEBHOOK_SECRET"); isSet {
+		defaults.WebhookSecret = value
+	}
+	if value, isSet := os.LookupEnv("WEBHOOK_CERT"); isSet {
+		defaults.WebhookCert = value
+	}
+	if value, isSet := os.LookupEnv("WEBHOOK_KEY"); isSet {
+		defaults.WebhookKey = value
+	}
+	if value, isSet := os.LookupEnv("INLINE_PRESET"); isSet {
+		defaults.InlinePreset = value
+	} else {
+		defaults.InlinePreset = "-o 1 -t 15"
+	}
+	if value, isSet := os.LookupEnv("INLINE_CACHE_CHAT_ID"); isSet {
+		if intValue, err := strconv.ParseInt(value, 10, 64); err == nil {
+			defaults.InlineCacheChatID = intValue
+		}
+	}
+	if value, isSet := os.LookupEnv("NSFW_KEYWORDS"); isSet {
+		defaults.NSFWKeywords = value
+	}
+	if value, isSet := os.LookupEnv("NSFW_INFOTEXT_PARAM"); isSet {
+		defaults.NSFWInfotextParam = value
+	}
+	if value, isSet := os.LookupEnv("NSFW_CLASSIFIER_URL"); isSet {
+		defaults.NSFWClassifierURL = value
+	}
+	defaults.NSFWThreshold = 0.5
+	if value, isSet := os.LookupEnv("NSFW_THRESHOLD"); isSet {
+		if floatValue, err := strconv.ParseFloat(value, 64); err == nil {
+			defaults.NSFWThreshold = floatValue
+		}
+	}
+	if value, isSet := os.LookupEnv("SAFETY_POLICY"); isSet {
+		defaults.SafetyPolicy = value
+	} else {
+		defaults.SafetyPolicy = string(safety.PolicyAllow)
+	}
+	if value, isSet := os.LookupEnv("BLOCKLIST"); isSet {
+		defaults.Blocklist = value
+	}
+	if value, isSet := os.LookupEnv("MODERATION_HOOK_URL"); isSet {
+		defaults.ModerationHookURL = value
+	}
+	if value, isSet := os.LookupEnv("MODERATION_AUDIT_FILE"); isSet {
+		defaults.ModerationAuditFile = value
+	}
+	if value, isSet := os.LookupEnv("MAINTENANCE_QUEUE"); isSet {
+		defaults.MaintenanceQueue = value
+	} else {
+		defaults.MaintenanceQueue = "hold"
+	}
+	if value, isSet := os.LookupEnv("STATS_FILE"); isSet {
+		defaults.StatsFile = value
+	}
+	if value, isSet := os.LookupEnv("GPU_STATUS_COMMAND"); isSet {
+		defaults.GPUStatusCommand = value
+	}
+	if value, isSet := os.LookupEnv("LOG_LEVEL"); isSet {
+		defaults.LogLevel = value
+	} else {
+		defaults.LogLevel = "info"
+	}
+	if value, isSet := os.LookupEnv("LOG_FORMAT"); isSet {
+		defaults.LogFormat = value
+	} else {
+		defaults.LogFormat = "text"
+	}
 	if value, isSet := os.LookupEnv("ALLOWED_USER_IDS"); isSet {
 		defaults.AllowedUserIDs = value
 	}
 	if value, isSet := os.LookupEnv("ALLOWED_GROUP_IDS"); isSet {
 		defaults.AllowedGroupIDs = value
 	}
+	if value, isSet := os.LookupEnv("ALLOWED_TOPICS"); isSet {
+		defaults.AllowedTopics = value
+	}
 	if value, isSet := os.LookupEnv("ADMIN_USER_IDS"); isSet {
 		defaults.AdminUserIDs = value
 	}
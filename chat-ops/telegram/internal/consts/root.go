@@ -17,6 +17,108 @@ const StartStr = "🤖 Welcome! This is a Telegram Bot " +
 const BotStartedToAdminsStr = "🤖 Bot started, version "
 const UsageNotAllowedStr = "You need to contact bot hoster to enable the functionality"
 const EmptyRequestErrorStr = "Request is empty, generation skipped"
+const InfotextUnsupportedParamsStr = "⚠ These parameters can't be used by the bot and are ignored:"
+const PNGInfoImageReqStr = "🩻 Please send the PNG, JPEG or WebP image as a file (not as a photo) to read its generation parameters."
+const PNGInfoRenderButtonStr = "🔁 Render again with these parameters"
+const PNGInfoRenderCallbackData = "pnginfo-render"
+
+// The file for /pnginfo is waited for this long.
+const PNGInfoWaitTimeout = 3 * time.Minute
+const FormatUsageStr = "Usage: /format [jpeg|png|webp] [-q quality], or /format reset to use the bot defaults"
+const FormatSetStr = "🖼 Output format for this chat: "
+const ChatSettingsAdminOnlyStr = "Only bot admins can change the settings of a group"
+
+// Telegram upload limits, photos exceeding them are sent as documents, bigger documents get downscaled.
+const TelegramPhotoMaxSize = 10 * 1024 * 1024
+const TelegramPhotoMaxDimensionsSum = 10000
+const TelegramPhotoMaxAspectRatio = 20
+const TelegramDocumentMaxSize = 50 * 1024 * 1024
+const TelegramMediaGroupMaxItems = 10
+const TelegramCaptionMaxLength = 1024
+
+const PreviewJPEGQuality = 70
+
+const HistoryKeepCount = 1000
+const HistoryDefaultListCount = 10
+const HistoryMaxListCount = 25
+const HistoryEmptyStr = "📜 No requests in the history yet"
+const HistoryEntryNotFoundStr = "history entry not found"
+
+const ModerationAuditKeepCount = 1000
+const ModerationAuditDefaultListCount = 10
+const ModerationAuditMaxListCount = 25
+const ModerationAuditEmptyStr = "📋 No rejected prompts yet"
+const ModerationAdminOnlyStr = "Only bot admins can change the moderation rules"
+const BlocklistStr = "🚫 Blocklist of this chat:"
+const BlocklistEmptyStr = "🚫 The blocklist of this chat is empty"
+const BlocklistUsageStr = "Usage: /blocklist [add|remove] word or /regex/, /blocklist reset"
+const ForcedNegativeStr = "➖ Forced negative prompt of this chat: "
+const ForcedNegativeEmptyStr = "➖ No forced negative prompt in this chat"
+const ForcedNegativeUsageStr = "Usage: /negative [prompt|reset]"
+const AgainUsageStr = "Usage: /again [id] [params], without id the last request of yours is repeated"
+const AgainNotRenderStr = "only render requests can be repeated"
+
+const StatsDefaultPeriod = "week"
+const StatsTopCount = 10
+const StatsTitleStr = "📊 Usage of the last "
+const StatsEmptyStr = "📊 No requests in this period"
+const StatsUsageStr = "Usage: /stats [day|week|month] [chart]"
+
+const MaintenanceStr = "🛠 The bot is under maintenance: "
+const MaintenanceDefaultMessageStr = "it will be back soon"
+const MaintenanceRejectedStr = "the bot is under maintenance: "
+const MaintenanceHeldStr = "Your request is queued until the maintenance is over."
+const MaintenanceOnStr = "🛠 Maintenance mode is on, no new requests are processed after the current one"
+const MaintenanceOffStr = "✅ Maintenance mode is off, the queue is resumed"
+const MaintenanceIsOffStr = "Maintenance mode is off"
+const MaintenanceUsageStr = "Usage: /maintenance on [message], /maintenance off"
+const QueuePausedStr = "⏸ The queue is paused, your request will be processed when it's resumed"
+const QueuePauseStr = "⏸ The queue is paused, no new requests are processed after the current one"
+const QueueResumeStr = "▶️ The queue is resumed"
+const QueueDrainStr = "⏏️ Draining the queue, the bot stops after the current request"
+const RestartingStr = "🔄 The bot is restarting, please send the request again later"
+const BroadcastUsageStr = "Usage: /broadcast message"
+const BroadcastSentStr = "📢 Broadcast sent to %d chats, %d failed"
+const BroadcastInterval = 50 * time.Millisecond
+
+const ArchivePruneInterval = time.Hour
+
+const APIJobCleanInterval = 10 * time.Minute
+
+// API clients are asked to retry after this in maintenance and while the bot is restarting.
+const APIRetryAfter = time.Minute
+
+const GPUStatusNoGPUsStr = "No GPUs found"
+const GPUStatusTimeout = 10 * time.Second
+
+const GalleryDisabledStr = "The gallery is not enabled on this bot"
+const GalleryPrivateOnlyStr = "The gallery link is personal, ask for it in a private chat with the bot"
+const GalleryLinkStr = "🖼 Your gallery, don't share this link: "
+
+const InlineRenderTitleStr = "🎨 Render"
+const InlineRenderingStr = "⏳ Rendering..."
+const InlineRenderAgainButtonStr = "🔁 Render again"
+const InlineNotAllowedStr = "Inline mode is not allowed for you"
+const InlineStartBotStr = "can't upload the images, start a private chat with the bot first"
+const InlineQueryCacheTime = 1
+const InlineCacheKeepCount = 100
+const InlineMaxResults = 10
+const InlineJPEGQuality = 85
+
+const GridCallbackDataPrefix = "grid:"
+const GridZipCallbackDataSuffix = "zip"
+const GridZipButtonStr = "📦 All originals as zip"
+const GridButtonsPerRow = 5
+const GridResultsKeepCount = 20
+const GridMaxDimensionsSum = 4096
+const GridResultExpiredStr = "These images are no longer available, render them again"
+const GridSetStr = "🔲 Contact sheet grid for this chat: "
+const GridUsageStr = "Usage: /grid [on|off]"
+
+const SafetySetStr = "🔞 NSFW safety policy for this chat: "
+const SafetyUsageStr = "Usage: /safety [allow|spoiler|block|reset]"
+const SafetyDisabledStr = "NSFW safety checks are not configured"
+const SafetyBlockedAdminStr = "🔞 Blocked request"
 
 const HelpCommandStr = "🤖 Stable Diffusion Telegram Bot\n\n" +
 	"Available commands:\n\n" +
@@ -31,8 +133,23 @@ const HelpCommandStr = "🤖 Stable Diffusion Telegram Bot\n\n" +
 	"/loras - list available LoRAs\n" +
 	"/upscalers - list available upscalers\n" +
 	"/vaes - list available VAEs\n" +
-	"/smi - get the output of nvidia-smi\n" +
+	"/smi - show the GPU status of the backend\n" +
 	"/help - show this help\n\n" +
+	"/pnginfo - read generation parameters from a PNG file\n" +
+	"/format - show or set the output image format of the chat\n" +
+	"/history [n] - list the last requests of the chat\n" +
+	"/again [id] [params] - repeat a render from the history, optionally with changed params\n" +
+	"/gallery - get the link of your web gallery of archived images\n" +
+	"/grid - show or set sending multiple images as a contact sheet grid in the chat\n" +
+	"/safety - show or set the NSFW safety policy of the chat\n" +
+	"/blocklist - show or change the prompt blocklist of the chat\n" +
+	"/negative - show or set the negative prompt forced in the chat\n" +
+	"/audit [n] - list the last rejected prompts (admins only)\n" +
+	"/stats [day|week|month] [chart] - show the usage statistics (admins only)\n" +
+	"/maintenance on [message], /maintenance off - pause the bot for maintenance (admins only)\n" +
+	"/broadcast message - send a message to all known users and groups (admins only)\n" +
+	"/pause, /resume - stop or resume starting new requests (admins only)\n" +
+	"/drain - finish the current request and stop the bot (admins only)\n" +
 	"/kuka - img2img with prompt with teaks and model kuka\n" +
 
 	"Available render parameters at the end of the prompt:\n\n" +
@@ -43,6 +160,9 @@ const HelpCommandStr = "🤖 Stable Diffusion Telegram Bot\n\n" +
 	"-steps/t - set the number of steps\n" +
 	"-cnt/o - set count of output images\n" +
 	"-batch/b - set batch size of output images\n" +
+	"-grid/g, -nogrid - send multiple images as a contact sheet grid or as an album\n" +
+	"-format/f - set output format: jpeg, png or webp\n" +
+	"-quality/q - set output quality (1-100, 100 is lossless for webp)\n" +
 	"-png - upload PNGs instead of JPEGs\n" +
 	"-cfg/c - set CFG scale\n" +
 	"-sampler/r - set sampler, get valid values with /samplers\n" +
@@ -54,13 +174,29 @@ const HelpCommandStr = "🤖 Stable Diffusion Telegram Bot\n\n" +
 	"-hr-upscaler/hru - set highres mode upscaler, get valid values with /upscalers\n" +
 	"-hr-steps/hrt - set the number of highres mode second pass steps\n\n" +
 
+	"Generation parameters copied from AUTOMATIC1111 or Civitai (\"Steps: 30, Sampler: ...\")" +
+	" can also be pasted as the prompt.\n\n" +
+
 	"Available upscale parameters:\n\n" +
 
 	"-upscale/u - upscale output image with ratio\n" +
 	"-upscaler - set upscaler method, get valid values with /upscalers\n" +
+	"-format/f - set output format: jpeg, png or webp\n" +
+	"-quality/q - set output quality (1-100, 100 is lossless for webp)\n" +
 	"-png - upload PNGs instead of JPEGs\n\n" +
 
 	"For more information see https://github.com/kanootoko/stable-diffusion-telegram-bot"
 
 const GroupChatProgressUpdateInterval = 5 * time.Second
 const PrivateChatProgressUpdateInterval = 3 * time.Second
+
+// The processor beats at least this often while it's idle or rendering. It's reported as stalled if it didn't
+// beat for the process timeout plus the grace, which covers waiting for images and uploading the results.
+const ProcessorHeartbeatInterval = 10 * time.Second
+const ProcessorStallGrace = 5 * time.Minute
+const HealthCheckTimeout = 5 * time.Second
+
+// On shutdown, results which are being uploaded get this long to finish, and the interrupted request gets
+// ShutdownNotifyTimeout to tell its user.
+const ShutdownUploadTimeout = 30 * time.Second
+const ShutdownNotifyTimeout = 5 * time.Second
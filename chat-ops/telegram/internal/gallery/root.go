@@ -0,0 +1,261 @@
+package gallery
+
+import (
+	"bytes"
+	"html/template"
+	"image"
+	_ "image/png"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/archive"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/imgenc"
+)
+
+// BasePath is where the gallery is served on the HTTP server.
+const BasePath = "/gallery/"
+
+const (
+	pageSize     = 24
+	thumbMaxSize = 384
+	tokenCookie  = "gallery_token"
+	tokenTTL     = 30 * 24 * time.Hour
+	dateFormat   = "2006-01-02"
+)
+
+// Gallery serves the archived images over HTTP. Users open it with a link containing their token, they see
+// their own images only, admins see all images.
+type Gallery struct {
+	archive   *archive.Archive
+	publicURL string
+	secret    []byte
+	isAdmin   func(userID int64) bool
+	isAllowed func(userID int64) bool
+}
+
+// New creates the gallery, publicURL is the address of the HTTP server as seen by the users, it's used for
+// the links sent by the bot. Users for whom isAllowed returns false can't open the gallery, even with a
+// valid link.
+func New(a *archive.Archive, publicURL string, secret []byte, isAdmin, isAllowed func(userID int64) bool) *Gallery {
+	return &Gallery{
+		archive:   a,
+		publicURL: strings.TrimSuffix(publicURL, "/"),
+		secret:    secret,
+		isAdmin:   isAdmin,
+		isAllowed: isAllowed,
+	}
+}
+
+// Link returns the gallery link of the user, it expires after tokenTTL.
+func (g *Gallery) Link(userID int64) string {
+	return g.publicURL + BasePath + "?t=" + url.QueryEscape(g.token(userID, time.Now().Add(tokenTTL)))
+}
+
+func (g *Gallery) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The token from the link is moved to a cookie, so it doesn't stay in the address bar and the history.
+	if t := r.URL.Query().Get("t"); t != "" {
+		_, expires, ok := g.checkToken(t)
+		if !ok {
+			http.Error(w, "invalid or expired gallery link, get a new one with /gallery", http.StatusForbidden)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     tokenCookie,
+			Value:    t,
+			Path:     BasePath,
+			MaxAge:   int(time.Until(expires).Seconds()),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		query := r.URL.Query()
+		query.Del("t")
+		http.Redirect(w, r, r.URL.Path+"?"+query.Encode(), http.StatusSeeOther)
+		return
+	}
+
+	cookie, err := r.Cookie(tokenCookie)
+	if err != nil {
+		http.Error(w, "open the gallery with the link from /gallery", http.StatusUnauthorized)
+		return
+	}
+	userID, _, ok := g.checkToken(cookie.Value)
+	if !ok {
+		http.Error(w, "invalid or expired gallery link, get a new one with /gallery", http.StatusForbidden)
+		return
+	}
+	if !g.isAllowed(userID) {
+		http.Error(w, "you are not allowed to use the bot anymore", http.StatusForbidden)
+		return
+	}
+	v := viewer{userID: userID, admin: g.isAdmin(userID)}
+
+	path := strings.TrimPrefix(r.URL.Path, BasePath)
+	switch {
+	case path == "":
+		g.serveList(w, r, v)
+	case strings.HasPrefix(path, "view/"):
+		g.serveDetail(w, v, strings.TrimPrefix(path, "view/"))
+	case strings.HasPrefix(path, "image/"):
+		g.serveImage(w, v, strings.TrimPrefix(path, "image/"), false)
+	case strings.HasPrefix(path, "thumb/"):
+		g.serveImage(w, v, strings.TrimPrefix(path, "thumb/"), true)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type viewer struct {
+	userID int64
+	admin  bool
+}
+
+func (v viewer) canSee(e archive.Entry) bool {
+	return v.admin || e.UserID == v.userID
+}
+
+type listFilter struct {
+	Query string
+	User  string
+	Model string
+	From  string
+	To    string
+}
+
+func (f listFilter) match(e archive.Entry) bool {
+	if f.Query != "" {
+		prompt := strings.ToLower(e.Prompt)
+		for _, word := range strings.Fields(strings.ToLower(f.Query)) {
+			if !strings.Contains(prompt, word) {
+				return false
+			}
+		}
+	}
+	if f.User != "" {
+		user := strings.TrimPrefix(f.User, "@")
+		if !strings.EqualFold(e.Username, user) && strconv.FormatInt(e.UserID, 10) != user {
+			return false
+		}
+	}
+	if f.Model != "" && !strings.Contains(strings.ToLower(e.Model), strings.ToLower(f.Model)) {
+		return false
+	}
+	day := e.Time.Format(dateFormat)
+	if f.From != "" && day < f.From {
+		return false
+	}
+	if f.To != "" && day > f.To {
+		return false
+	}
+	return true
+}
+
+func (f listFilter) query(page int) template.URL {
+	query := url.Values{}
+	for k, v := range map[string]string{"q": f.Query, "user": f.User, "model": f.Model, "from": f.From, "to": f.To} {
+		if v != "" {
+			query.Set(k, v)
+		}
+	}
+	if page > 1 {
+		query.Set("page", strconv.Itoa(page))
+	}
+	return template.URL(BasePath + "?" + query.Encode())
+}
+
+func (g *Gallery) serveList(w http.ResponseWriter, r *http.Request, v viewer) {
+	query := r.URL.Query()
+	f := listFilter{
+		Query: strings.TrimSpace(query.Get("q")),
+		Model: strings.TrimSpace(query.Get("model")),
+		From:  query.Get("from"),
+		To:    query.Get("to"),
+	}
+	if v.admin {
+		f.User = strings.TrimSpace(query.Get("user"))
+	}
+	page, _ := strconv.Atoi(query.Get("page"))
+	page = max(page, 1)
+
+	entries := g.archive.List(func(e archive.Entry) bool { return v.canSee(e) && f.match(e) })
+	pageCount := max((len(entries)+pageSize-1)/pageSize, 1)
+	page = min(page, pageCount)
+
+	data := listPageData{
+		Filter:    f,
+		Admin:     v.admin,
+		Total:     len(entries),
+		Page:      page,
+		PageCount: pageCount,
+		Entries:   entries[(page-1)*pageSize : min(page*pageSize, len(entries))],
+	}
+	if page > 1 {
+		data.PrevURL = f.query(page - 1)
+	}
+	if page < pageCount {
+		data.NextURL = f.query(page + 1)
+	}
+	g.render(w, listTemplate, data)
+}
+
+func (g *Gallery) serveDetail(w http.ResponseWriter, v viewer, path string) {
+	e, found := g.archive.Get(path)
+	if !found || !v.canSee(e) {
+		http.Error(w, "image not found", http.StatusNotFound)
+		return
+	}
+	g.render(w, detailTemplate, detailPageData{Entry: e, Admin: v.admin})
+}
+
+func (g *Gallery) serveImage(w http.ResponseWriter, v viewer, path string, thumb bool) {
+	e, found := g.archive.Get(path)
+	if !found || !v.canSee(e) {
+		http.Error(w, "image not found", http.StatusNotFound)
+		return
+	}
+	var data []byte
+	var err error
+	contentType := "image/png"
+	if thumb {
+		data, err = g.archive.ReadThumbnail(path, thumbnail)
+		contentType = "image/jpeg"
+	} else {
+		data, err = g.archive.ReadImage(path)
+	}
+	if err != nil {
+		slog.Error("gallery image read error", "error", err)
+		http.Error(w, "image not found", http.StatusNotFound)
+		return
+	}
+	// Archived images never change.
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Header().Set("Content-Type", contentType)
+	_, _ = w.Write(data)
+}
+
+func thumbnail(data []byte) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	b := img.Bounds()
+	if b.Dx() > thumbMaxSize || b.Dy() > thumbMaxSize {
+		scale := float64(thumbMaxSize) / float64(max(b.Dx(), b.Dy()))
+		img = imgenc.Downscale(img, max(int(float64(b.Dx())*scale), 1), max(int(float64(b.Dy())*scale), 1))
+	}
+	return imgenc.EncodeImage(img, imgenc.Options{Format: imgenc.FormatJPEG, Quality: 80}, "")
+}
+
+func (g *Gallery) render(w http.ResponseWriter, t *template.Template, data any) {
+	buf := new(bytes.Buffer)
+	if err := t.Execute(buf, data); err != nil {
+		slog.Error("gallery template error", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(buf.Bytes())
+}
@@ -0,0 +1,80 @@
+package gallery
+
+import (
+	"html/template"
+
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/archive"
+)
+
+type listPageData struct {
+	Filter    listFilter
+	Admin     bool
+	Total     int
+	Page      int
+	PageCount int
+	Entries   []archive.Entry
+	PrevURL   template.URL
+	NextURL   template.URL
+}
+
+type detailPageData struct {
+	Entry archive.Entry
+	Admin bool
+}
+
+const styleHTML = `<style>
+body { font-family: sans-serif; margin: 1em; background: #181818; color: #ddd; }
+a { color: #8ab4f8; }
+form input { margin: 0 .5em .5em 0; }
+.grid { display: flex; flex-wrap: wrap; gap: 8px; }
+.tile { width: 192px; }
+.tile img { width: 192px; height: 192px; object-fit: cover; display: block; }
+.tile div { font-size: 12px; overflow: hidden; white-space: nowrap; text-overflow: ellipsis; }
+.pages { margin: 1em 0; }
+.detail img { max-width: 100%; max-height: 80vh; }
+td { padding: 2px 1em 2px 0; vertical-align: top; }
+pre { white-space: pre-wrap; }
+</style>`
+
+var listTemplate = template.Must(template.New("list").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Gallery</title>` + styleHTML + `</head><body>
+<form method="get" action="` + BasePath + `">
+<input name="q" placeholder="prompt" value="{{.Filter.Query}}">
+{{if .Admin}}<input name="user" placeholder="user name or ID" value="{{.Filter.User}}">{{end}}
+<input name="model" placeholder="model" value="{{.Filter.Model}}">
+<input name="from" type="date" value="{{.Filter.From}}">
+<input name="to" type="date" value="{{.Filter.To}}">
+<input type="submit" value="Search">
+</form>
+<p>{{.Total}} images</p>
+<div class="grid">
+{{range .Entries}}<a class="tile" href="` + BasePath + `view/{{.Path}}" title="{{.Prompt}}">
+<img src="` + BasePath + `thumb/{{.Path}}" loading="lazy" alt="">
+<div>{{.Time.Format "2006-01-02 15:04"}}{{if $.Admin}} @{{.Username}}{{end}}</div>
+<div>{{.Prompt}}</div>
+</a>
+{{end}}</div>
+<div class="pages">
+{{if .PrevURL}}<a href="{{.PrevURL}}">&larr; newer</a>{{end}}
+page {{.Page}} of {{.PageCount}}
+{{if .NextURL}}<a href="{{.NextURL}}">older &rarr;</a>{{end}}
+</div>
+</body></html>`))
+
+var detailTemplate = template.Must(template.New("detail").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Gallery</title>` + styleHTML + `</head><body class="detail">
+<p><a href="` + BasePath + `">&larr; gallery</a></p>
+{{with .Entry}}<a href="` + BasePath + `image/{{.Path}}"><img src="` + BasePath + `image/{{.Path}}" alt=""></a>
+<table>
+<tr><td>Time</td><td>{{.Time.Format "2006-01-02 15:04:05"}}</td></tr>
+{{if $.Admin}}<tr><td>User</td><td>@{{.Username}} #{{.UserID}}</td></tr>
+<tr><td>Chat</td><td>{{.ChatID}}</td></tr>{{end}}
+<tr><td>Type</td><td>{{.Type}}</td></tr>
+{{if .Model}}<tr><td>Model</td><td>{{.Model}}</td></tr>{{end}}
+<tr><td>Prompt</td><td>{{.Prompt}}</td></tr>
+</table>
+{{if .Infotext}}<h4>Parameters</h4><pre>{{.Infotext}}</pre>{{end}}
+<p><a href="` + BasePath + `image/{{.Path}}" download>Download original</a></p>
+{{end}}</body></html>`))
@@ -0,0 +1,45 @@
+package gallery
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The token is "<user ID>.<expiry>.<signature>", so it can't be forged for other users or extended without
+// the secret.
+func (g *Gallery) token(userID int64, expires time.Time) string {
+	payload := strconv.FormatInt(userID, 10) + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + g.sign(payload)
+}
+
+func (g *Gallery) sign(s string) string {
+	mac := hmac.New(sha256.New, g.secret)
+	mac.Write([]byte(s))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:18])
+}
+
+// Returns the user ID and the expiry of a valid token which is not expired yet.
+func (g *Gallery) checkToken(token string) (userID int64, expires time.Time, ok bool) {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 || !hmac.Equal([]byte(token[i+1:]), []byte(g.sign(token[:i]))) {
+		return 0, time.Time{}, false
+	}
+	idStr, expiresStr, found := strings.Cut(token[:i], ".")
+	if !found {
+		return 0, time.Time{}, false
+	}
+	userID, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	expiresUnix, err := strconv.ParseInt(expiresStr, 10, 64)
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	expires = time.Unix(expiresUnix, 0)
+	return userID, expires, time.Now().Before(expires)
+}
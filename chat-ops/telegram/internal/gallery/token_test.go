@@ -0,0 +1,24 @@
+package gallery
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckToken(t *testing.T) {
+	g := &Gallery{secret: []byte("secret")}
+	token := g.token(42, time.Now().Add(time.Hour))
+	if userID, _, ok := g.checkToken(token); !ok || userID != 42 {
+		t.Errorf("valid token checked as %d, %v", userID, ok)
+	}
+	if _, _, ok := g.checkToken(g.token(42, time.Now().Add(-time.Second))); ok {
+		t.Error("expired token accepted")
+	}
+	if _, _, ok := g.checkToken("43" + token[2:]); ok {
+		t.Error("token of another user accepted")
+	}
+	other := &Gallery{secret: []byte("other")}
+	if _, _, ok := other.checkToken(token); ok {
+		t.Error("token signed with another secret accepted")
+	}
+}
@@ -0,0 +1,107 @@
+// Package gpustatus gets the status of the GPUs of the Stable Diffusion backend, either from the WebUI API
+// or from nvidia-smi.
+package gpustatus
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"net/url"
+	"strings"
+
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/consts"
+	sdapi "github.com/kanootoko/stable-diffusion-telegram-bot/internal/sd_api"
+)
+
+// GPU is the status of a GPU. The float values are negative if they are unknown, the WebUI API only tells
+// the VRAM usage of the GPU it uses.
+type GPU struct {
+	Index int
+	Name  string
+	// Percents.
+	Utilization float64
+	// MiB.
+	MemoryUsed  float64
+	MemoryTotal float64
+	// Celsius.
+	Temperature float64
+	// Watts.
+	PowerDraw  float64
+	PowerLimit float64
+}
+
+func unknownGPU(index int, name string) GPU {
+	return GPU{Index: index, Name: name, Utilization: -1, MemoryUsed: -1, MemoryTotal: -1, Temperature: -1, PowerDraw: -1, PowerLimit: -1}
+}
+
+type Source interface {
+	// Name is shown as the title of the status.
+	Name() string
+	GPUs(ctx context.Context) ([]GPU, error)
+}
+
+// BackendSource gets the GPU names from the system info of the WebUI and the VRAM usage from its memory
+// endpoint.
+type BackendSource struct {
+	SdAPI *sdapi.SdAPIType
+}
+
+func (s BackendSource) Name() string {
+	if u, err := url.Parse(s.SdAPI.SdHost); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return s.SdAPI.SdHost
+}
+
+func (s BackendSource) GPUs(ctx context.Context) ([]GPU, error) {
+	mem, err := s.SdAPI.GetGPUMemory(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("can't get memory usage: %w", err)
+	}
+	// The names are optional, older WebUI versions don't serve the system info.
+	names, _ := s.SdAPI.GetGPUModels(ctx)
+	if len(names) == 0 {
+		names = []string{"GPU"}
+	}
+
+	var gpus []GPU
+	for i, name := range names {
+		gpus = append(gpus, unknownGPU(i, name))
+	}
+	// The memory is of the device the WebUI uses, which is the first one by default.
+	gpus[0].MemoryUsed = float64(mem.Used) / (1 << 20)
+	gpus[0].MemoryTotal = float64(mem.Total) / (1 << 20)
+	return gpus, nil
+}
+
+// Format returns the status of each GPU in a compact HTML text.
+func Format(source Source, gpus []GPU) string {
+	var b strings.Builder
+	b.WriteString("🖥 <b>" + html.EscapeString(source.Name()) + "</b>")
+	if len(gpus) == 0 {
+		b.WriteString("\n" + consts.GPUStatusNoGPUsStr)
+	}
+	for _, gpu := range gpus {
+		fmt.Fprintf(&b, "\n<b>#%d</b> %s", gpu.Index, html.EscapeString(gpu.Name))
+
+		var values []string
+		if gpu.Utilization >= 0 {
+			values = append(values, fmt.Sprintf("util %.0f%%", gpu.Utilization))
+		}
+		if gpu.MemoryUsed >= 0 && gpu.MemoryTotal > 0 {
+			values = append(values, fmt.Sprintf("VRAM %.1f/%.1f GiB (%.0f%%)", gpu.MemoryUsed/1024, gpu.MemoryTotal/1024, gpu.MemoryUsed/gpu.MemoryTotal*100))
+		}
+		if gpu.Temperature >= 0 {
+			values = append(values, fmt.Sprintf("%.0f°C", gpu.Temperature))
+		}
+		if gpu.PowerDraw >= 0 && gpu.PowerLimit > 0 {
+			values = append(values, fmt.Sprintf("%.0f/%.0f W", gpu.PowerDraw, gpu.PowerLimit))
+		} else if gpu.PowerDraw >= 0 {
+			values = append(values, fmt.Sprintf("%.0f W", gpu.PowerDraw))
+		}
+		if len(values) > 0 {
+			b.WriteString("\n  " + strings.Join(values, " · "))
+		}
+	}
+	return b.String()
+}
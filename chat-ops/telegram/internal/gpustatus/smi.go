@@ -0,0 +1,83 @@
+package gpustatus
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+var smiQueryArgs = []string{
+	"--query-gpu=index,name,utilization.gpu,memory.used,memory.total,temperature.gpu,power.draw,power.limit",
+	"--format=csv,noheader,nounits",
+}
+
+// SMISource runs nvidia-smi with the query arguments appended to the command. The command can run it on
+// the GPU host, like "ssh gpu-host nvidia-smi".
+type SMISource struct {
+	Command []string
+}
+
+func (s SMISource) Name() string {
+	return strings.Join(s.Command, " ")
+}
+
+func (s SMISource) GPUs(ctx context.Context) ([]GPU, error) {
+	if len(s.Command) == 0 {
+		return nil, fmt.Errorf("no nvidia-smi command set")
+	}
+
+	cmd := exec.CommandContext(ctx, s.Command[0], append(s.Command[1:], smiQueryArgs...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, err
+	}
+	return parseSMI(out)
+}
+
+func parseSMIValue(s string) float64 {
+	// Unsupported values are shown like "[N/A]" or "[Not Supported]".
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return -1
+	}
+	return v
+}
+
+func parseSMI(out []byte) (gpus []GPU, err error) {
+	r := csv.NewReader(bytes.NewReader(out))
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("can't parse nvidia-smi output: %w", err)
+	}
+
+	for _, record := range records {
+		if len(record) != 8 {
+			return nil, fmt.Errorf("can't parse nvidia-smi output: got %d fields instead of 8", len(record))
+		}
+		index, err := strconv.Atoi(record[0])
+		if err != nil {
+			return nil, fmt.Errorf("can't parse nvidia-smi output: invalid gpu index %q", record[0])
+		}
+		gpus = append(gpus, GPU{
+			Index:       index,
+			Name:        record[1],
+			Utilization: parseSMIValue(record[2]),
+			MemoryUsed:  parseSMIValue(record[3]),
+			MemoryTotal: parseSMIValue(record[4]),
+			Temperature: parseSMIValue(record[5]),
+			PowerDraw:   parseSMIValue(record[6]),
+			PowerLimit:  parseSMIValue(record[7]),
+		})
+	}
+	return gpus, nil
+}
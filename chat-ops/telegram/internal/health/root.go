@@ -0,0 +1,63 @@
+// Package health serves the liveness and readiness probes of the bot.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Check returns an error if the checked component is not healthy.
+type Check func(ctx context.Context) error
+
+type response struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// Handler runs the checks concurrently on each request, it responds with 503 if any of them fails. The
+// results of the informational checks are only reported in the response, their failures don't fail it.
+func Handler(checks, informational map[string]Check, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		res := response{Status: "ok", Checks: map[string]string{}}
+		var mutex sync.Mutex
+		var wg sync.WaitGroup
+		run := func(name string, check Check, required bool) {
+			defer wg.Done()
+			status := "ok"
+			if err := check(ctx); err != nil {
+				status = err.Error()
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			res.Checks[name] = status
+			if status != "ok" && required {
+				res.Status = "failed"
+			}
+		}
+		for name, check := range checks {
+			wg.Add(1)
+			go run(name, check, true)
+		}
+		for name, check := range informational {
+			wg.Add(1)
+			go run(name, check, false)
+		}
+		wg.Wait()
+
+		code := http.StatusOK
+		if res.Status != "ok" {
+			slog.WarnContext(r.Context(), "health check failed", "path", r.URL.Path, "checks", res.Checks)
+			code = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(res)
+	})
+}
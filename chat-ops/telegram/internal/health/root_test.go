@@ -0,0 +1,42 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	ok := func(context.Context) error { return nil }
+	failing := func(context.Context) error { return errors.New("down") }
+
+	for _, tt := range []struct {
+		name          string
+		checks        map[string]Check
+		informational map[string]Check
+		code          int
+	}{
+		{"ok", map[string]Check{"a": ok}, map[string]Check{"b": ok}, http.StatusOK},
+		{"failed", map[string]Check{"a": failing}, map[string]Check{"b": ok}, http.StatusServiceUnavailable},
+		{"informational failed", map[string]Check{"a": ok}, map[string]Check{"b": failing}, http.StatusOK},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			Handler(tt.checks, tt.informational, time.Second).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if w.Code != tt.code {
+				t.Errorf("got status %d", w.Code)
+			}
+			var res response
+			if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+				t.Fatal(err)
+			}
+			if len(res.Checks) != 2 {
+				t.Errorf("got checks %v", res.Checks)
+			}
+		})
+	}
+}
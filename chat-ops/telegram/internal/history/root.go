@@ -0,0 +1,84 @@
+package history
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/jsonl"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/reqparams"
+)
+
+// Entry is a completed request.
+type Entry struct {
+	ID       uint64        `json:"id"`
+	Time     time.Time     `json:"time"`
+	UserID   int64         `json:"user_id"`
+	Username string        `json:"username,omitempty"`
+	ChatID   int64         `json:"chat_id"`
+	Type     string        `json:"type"`
+	Prompt   string        `json:"prompt"`
+	Seed     uint32        `json:"seed,omitempty"`
+	Model    string        `json:"model,omitempty"`
+	Duration time.Duration `json:"duration"`
+	FileIDs  []string      `json:"file_ids,omitempty"`
+
+	// Set for render requests only, these can be repeated with /again.
+	RenderParams *reqparams.ReqParamsRender `json:"render_params,omitempty"`
+}
+
+// Store keeps the last keepCount entries in memory. If filename is set, entries are appended to the file as
+// JSON lines and the last ones are loaded on startup.
+type Store struct {
+	mutex   sync.Mutex
+	entries *jsonl.Store[Entry]
+	lastID  uint64
+}
+
+func NewStore(filename string, keepCount int) (*Store, error) {
+	entries, err := jsonl.Open[Entry]("history", filename, jsonl.Options[Entry]{KeepCount: keepCount})
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{entries: entries}
+	entries.View(func(entries []Entry) {
+		for _, e := range entries {
+			s.lastID = max(s.lastID, e.ID)
+		}
+	})
+	return s, nil
+}
+
+// Add assigns an ID to the entry and stores it.
+func (s *Store) Add(e Entry) (Entry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.lastID++
+	e.ID = s.lastID
+	return e, s.entries.Add(e)
+}
+
+func (s *Store) Get(id uint64) (res Entry, found bool) {
+	s.entries.View(func(entries []Entry) {
+		for _, e := range entries {
+			if e.ID == id {
+				res, found = e, true
+				return
+			}
+		}
+	})
+	return
+}
+
+// List returns the last n entries of the chat for which filter returns true, newest first. The filter is
+// optional.
+func (s *Store) List(chatID int64, n int, filter func(e Entry) bool) (res []Entry) {
+	s.entries.View(func(entries []Entry) {
+		for i := len(entries) - 1; i >= 0 && len(res) < n; i-- {
+			if entries[i].ChatID == chatID && (filter == nil || filter(entries[i])) {
+				res = append(res, entries[i])
+			}
+		}
+	})
+	return
+}
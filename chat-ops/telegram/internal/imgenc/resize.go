@@ -0,0 +1,46 @@
+package imgenc
+
+import (
+	"image"
+	"image/draw"
+)
+
+// Downscale resizes the image to the given size by averaging the source pixels covered by each destination
+// pixel. It's meant for shrinking only, the given size should not exceed the source size.
+func Downscale(img image.Image, width, height int) *image.NRGBA {
+	src := image.NewNRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(src, src.Bounds(), img, img.Bounds().Min, draw.Src)
+	srcW, srcH := src.Bounds().Dx(), src.Bounds().Dy()
+
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		sy0 := y * srcH / height
+		sy1 := max((y+1)*srcH/height, sy0+1)
+		for x := 0; x < width; x++ {
+			sx0 := x * srcW / width
+			sx1 := max((x+1)*srcW/width, sx0+1)
+
+			var r, g, b, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := sx0; sx < sx1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					// Weighting the colors with alpha, so transparent pixels don't darken the edges.
+					r += uint64(p[0]) * uint64(p[3])
+					g += uint64(p[1]) * uint64(p[3])
+					b += uint64(p[2]) * uint64(p[3])
+					a += uint64(p[3])
+					n++
+				}
+			}
+			d := dst.Pix[y*dst.Stride+x*4:]
+			if a > 0 {
+				d[0] = uint8(r / a)
+				d[1] = uint8(g / a)
+				d[2] = uint8(b / a)
+			}
+			d[3] = uint8(a / n)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,179 @@
+package imgenc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"log/slog"
+	"math"
+	"strings"
+
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/imgmeta"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/infotext"
+)
+
+type Format string
+
+const (
+	FormatJPEG Format = "jpeg"
+	FormatPNG  Format = "png"
+	FormatWebP Format = "webp"
+)
+
+const MaxQuality = 100
+
+// ErrWebPUnsupported is returned for the webp format when the bot is built without cgo.
+var ErrWebPUnsupported = errors.New("webp output is not supported, the bot was built without cgo")
+
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "jpeg", "jpg":
+		return FormatJPEG, nil
+	case "png":
+		return FormatPNG, nil
+	case "webp":
+		if !WebPSupported {
+			return "", ErrWebPUnsupported
+		}
+		return FormatWebP, nil
+	}
+	if !WebPSupported {
+		return "", fmt.Errorf("invalid output format, valid values are jpeg and png")
+	}
+	return "", fmt.Errorf("invalid output format, valid values are jpeg, png and webp")
+}
+
+// Options of the output image encoding. Quality is used by JPEG and WebP, for WebP 100 means lossless,
+// lower values are lossy.
+type Options struct {
+	Format  Format
+	Quality int
+}
+
+func (o Options) Validate() error {
+	if _, err := ParseFormat(string(o.Format)); err != nil {
+		return err
+	}
+	if o.Quality < 1 || o.Quality > MaxQuality {
+		return fmt.Errorf("invalid output quality, valid values are 1-%d", MaxQuality)
+	}
+	return nil
+}
+
+func (o Options) Ext() string {
+	if o.Format == FormatJPEG {
+		return "jpg"
+	}
+	return string(o.Format)
+}
+
+// IsPhoto returns true if the images can be sent as Telegram photos. Other formats are sent as documents,
+// as Telegram would recompress them.
+func (o Options) IsPhoto() bool {
+	return o.Format == FormatJPEG
+}
+
+func (o Options) String() string {
+	switch o.Format {
+	case FormatPNG:
+		return "PNG"
+	case FormatWebP:
+		if o.Quality >= MaxQuality {
+			return "WebP lossless"
+		}
+		return fmt.Sprintf("WebP q%d", o.Quality)
+	}
+	return fmt.Sprintf("JPEG q%d", o.Quality)
+}
+
+// Encode converts the PNG image returned by Stable Diffusion to the output format and embeds the infotext
+// into it. Failing to write the metadata is not fatal, as the image is still usable.
+func Encode(pngData []byte, o Options, text string) ([]byte, error) {
+	if o.Format == FormatPNG {
+		if text == "" {
+			return pngData, nil
+		}
+		res, err := imgmeta.WritePNGTextChunk(pngData, infotext.PNGKeyword, text)
+		if err != nil {
+			slog.Warn("metadata write error", "error", err)
+			return pngData, nil
+		}
+		return res, nil
+	}
+
+	img, err := png.Decode(bytes.NewReader(pngData))
+	if err != nil {
+		slog.Error("png decode error", "error", err)
+		return nil, fmt.Errorf("png decode error: %w", err)
+	}
+	return EncodeImage(img, o, text)
+}
+
+// EncodeWithMaxSize is like Encode, but downscales the image until the result fits into maxSize bytes.
+func EncodeWithMaxSize(pngData []byte, o Options, text string, maxSize int) ([]byte, error) {
+	res, err := Encode(pngData, o, text)
+	if err != nil || len(res) <= maxSize {
+		return res, err
+	}
+
+	img, err := png.Decode(bytes.NewReader(pngData))
+	if err != nil {
+		slog.Error("png decode error", "error", err)
+		return nil, fmt.Errorf("png decode error: %w", err)
+	}
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	for len(res) > maxSize {
+		// The encoded size is roughly proportional to the pixel count.
+		scale := math.Sqrt(float64(maxSize)/float64(len(res))) * 0.95
+		width, height = max(int(float64(width)*scale), 1), max(int(float64(height)*scale), 1)
+		slog.Info("image is too big, downscaling", "bytes", len(res), "width", width, "height", height)
+		if res, err = EncodeImage(Downscale(img, width, height), o, text); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// EncodeImage encodes the image to the output format, see Encode.
+func EncodeImage(img image.Image, o Options, text string) ([]byte, error) {
+	switch o.Format {
+	case FormatWebP:
+		var exif, xmp []byte
+		if text != "" {
+			exif = imgmeta.BuildEXIFUserComment(text)
+			xmp = imgmeta.BuildXMPUserComment(text)
+		}
+		res, err := EncodeWebP(img, o.Quality, exif, xmp)
+		if err != nil {
+			slog.Error("webp encode error", "error", err)
+			return nil, fmt.Errorf("webp encode error: %w", err)
+		}
+		return res, nil
+	case FormatPNG:
+		buf := new(bytes.Buffer)
+		if err := png.Encode(buf, img); err != nil {
+			slog.Error("png encode error", "error", err)
+			return nil, fmt.Errorf("png encode error: %w", err)
+		}
+		return Encode(buf.Bytes(), o, text)
+	}
+
+	buf := new(bytes.Buffer)
+	err := jpeg.Encode(buf, img, &jpeg.Options{Quality: o.Quality})
+	if err != nil {
+		slog.Error("jpg encode error", "error", err)
+		return nil, fmt.Errorf("jpg encode error: %w", err)
+	}
+	if text == "" {
+		return buf.Bytes(), nil
+	}
+	res, err := imgmeta.WriteJPEGUserComment(buf.Bytes(), text)
+	if err != nil {
+		slog.Warn("metadata write error", "error", err)
+		return buf.Bytes(), nil
+	}
+	return res, nil
+}
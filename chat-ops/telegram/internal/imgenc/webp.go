@@ -0,0 +1,29 @@
+//go:build cgo
+
+package imgenc
+
+import (
+	"image"
+
+	"github.com/chai2010/webp"
+)
+
+// WebPSupported is true when the bot is built with cgo and libwebp.
+const WebPSupported = true
+
+// EncodeWebP encodes the image as a WebP file with libwebp, lossless if the quality is MaxQuality, lossy
+// (VP8) otherwise. The exif and xmp metadata are stored in their chunks if they are not empty.
+func EncodeWebP(img image.Image, quality int, exif, xmp []byte) (res []byte, err error) {
+	if quality >= MaxQuality {
+		res, err = webp.EncodeLosslessRGBA(img)
+	} else {
+		res, err = webp.EncodeRGBA(img, float32(quality))
+	}
+	if err == nil && len(exif) > 0 {
+		res, err = webp.SetMetadata(res, exif, "EXIF")
+	}
+	if err == nil && len(xmp) > 0 {
+		res, err = webp.SetMetadata(res, xmp, "XMP")
+	}
+	return res, err
+}
@@ -0,0 +1,13 @@
+//go:build !cgo
+
+package imgenc
+
+import "image"
+
+// WebPSupported is false when the bot is built without cgo, as libwebp can't be linked then.
+const WebPSupported = false
+
+// EncodeWebP always fails without cgo, ParseFormat rejects the webp format in such builds.
+func EncodeWebP(img image.Image, quality int, exif, xmp []byte) ([]byte, error) {
+	return nil, ErrWebPUnsupported
+}
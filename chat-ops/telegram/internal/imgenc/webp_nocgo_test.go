@@ -0,0 +1,21 @@
+//go:build !cgo
+
+package imgenc
+
+import (
+	"errors"
+	"image"
+	"testing"
+)
+
+func TestWebPUnsupported(t *testing.T) {
+	if _, err := ParseFormat("webp"); !errors.Is(err, ErrWebPUnsupported) {
+		t.Fatalf("ParseFormat(webp) error = %v, want %v", err, ErrWebPUnsupported)
+	}
+	if err := (Options{Format: "webp", Quality: 90}).Validate(); err == nil {
+		t.Fatal("webp options validated without cgo")
+	}
+	if _, err := EncodeWebP(image.NewRGBA(image.Rect(0, 0, 1, 1)), MaxQuality, nil, nil); !errors.Is(err, ErrWebPUnsupported) {
+		t.Fatalf("EncodeWebP error = %v, want %v", err, ErrWebPUnsupported)
+	}
+}
@@ -0,0 +1,117 @@
+//go:build cgo
+
+package imgenc
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/imgmeta"
+	"golang.org/x/image/webp"
+)
+
+// Returns a gradient with some noise, which compresses roughly like a render.
+func testImage(width, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	r := rand.New(rand.NewSource(1))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(x * 255 / width),
+				G: uint8(y * 255 / height),
+				B: uint8(128 + r.Intn(16)),
+				A: 0xff,
+			})
+		}
+	}
+	return img
+}
+
+func decodeWebP(t *testing.T, data []byte) image.Image {
+	t.Helper()
+	img, err := webp.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	return img
+}
+
+// Returns the mean absolute difference of the RGB channels.
+func meanDiff(a, b image.Image) float64 {
+	var sum, count float64
+	bounds := a.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			ca := color.NRGBAModel.Convert(a.At(x, y)).(color.NRGBA)
+			cb := color.NRGBAModel.Convert(b.At(x, y)).(color.NRGBA)
+			for _, d := range []int{int(ca.R) - int(cb.R), int(ca.G) - int(cb.G), int(ca.B) - int(cb.B)} {
+				sum += float64(max(d, -d))
+				count++
+			}
+		}
+	}
+	return sum / count
+}
+
+func TestEncodeWebPLossless(t *testing.T) {
+	img := testImage(200, 150)
+	data, err := EncodeWebP(img, MaxQuality, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := decodeWebP(t, data)
+	if decoded.Bounds().Size() != img.Bounds().Size() {
+		t.Fatalf("decoded size is %v", decoded.Bounds().Size())
+	}
+	if d := meanDiff(img, decoded); d != 0 {
+		t.Errorf("lossless image differs by %f", d)
+	}
+}
+
+func TestEncodeWebPLossy(t *testing.T) {
+	img := testImage(512, 512)
+	lossless, err := EncodeWebP(img, MaxQuality, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lossy, err := EncodeWebP(img, 80, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lossy)*3 > len(lossless) {
+		t.Errorf("lossy image is %d bytes, lossless is %d", len(lossy), len(lossless))
+	}
+	decoded := decodeWebP(t, lossy)
+	if decoded.Bounds().Size() != img.Bounds().Size() {
+		t.Fatalf("decoded size is %v", decoded.Bounds().Size())
+	}
+	if d := meanDiff(img, decoded); d > 8 {
+		t.Errorf("lossy image differs by %f", d)
+	}
+}
+
+func TestEncodeImageWebPMetadata(t *testing.T) {
+	const text = "a cat\nSteps: 20, Sampler: Euler a, CFG scale: 7, Seed: 1, Size: 64x48"
+	for _, quality := range []int{MaxQuality, 80} {
+		data, err := EncodeImage(testImage(64, 48), Options{Format: FormatWebP, Quality: quality}, text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img := decodeWebP(t, data); img.Bounds().Dx() != 64 || img.Bounds().Dy() != 48 {
+			t.Errorf("q%d: decoded size is %v", quality, img.Bounds().Size())
+		}
+		comment, err := imgmeta.ReadWebPUserComment(data)
+		if err != nil {
+			t.Fatalf("q%d: %v", quality, err)
+		}
+		if comment != text {
+			t.Errorf("q%d: got comment %q", quality, comment)
+		}
+		if !bytes.Contains(data, []byte("XMP ")) || !bytes.Contains(data, []byte("<exif:UserComment>")) {
+			t.Errorf("q%d: no xmp chunk", quality)
+		}
+	}
+}
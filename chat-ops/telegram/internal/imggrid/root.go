@@ -0,0 +1,100 @@
+package imggrid
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/imgenc"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const tileGap = 4
+const labelPadding = 3
+
+var backgroundColor = color.NRGBA{R: 0x20, G: 0x20, B: 0x20, A: 0xff}
+var labelBackgroundColor = color.NRGBA{A: 0xa0}
+
+// Renders the text with the built-in bitmap font, white on transparent background.
+func renderText(s string) *image.NRGBA {
+	face := basicfont.Face7x13
+	width := font.MeasureString(face, s).Ceil()
+	height := face.Metrics().Height.Ceil()
+	img := image.NewNRGBA(image.Rect(0, 0, width+2*labelPadding, height+2*labelPadding))
+	draw.Draw(img, img.Bounds(), image.NewUniform(labelBackgroundColor), image.Point{}, draw.Src)
+	d := font.Drawer{
+		Dst:  img,
+		Src:  image.White,
+		Face: face,
+		Dot:  fixed.P(labelPadding, labelPadding+face.Metrics().Ascent.Ceil()),
+	}
+	d.DrawString(s)
+	return img
+}
+
+// Draws the label to the top left corner of the rect, scaled up by the given integer factor so it stays
+// readable on big tiles.
+func drawLabel(dst *image.NRGBA, at image.Point, label string, scale int) {
+	text := renderText(label)
+	bounds := text.Bounds()
+	for y := 0; y < bounds.Dy()*scale; y++ {
+		for x := 0; x < bounds.Dx()*scale; x++ {
+			p := image.Pt(at.X+x, at.Y+y)
+			if !p.In(dst.Bounds()) {
+				continue
+			}
+			src := text.NRGBAAt(x/scale, y/scale)
+			dstColor := dst.NRGBAAt(p.X, p.Y)
+			a := uint32(src.A)
+			dst.SetNRGBA(p.X, p.Y, color.NRGBA{
+				R: uint8((uint32(src.R)*a + uint32(dstColor.R)*(255-a)) / 255),
+				G: uint8((uint32(src.G)*a + uint32(dstColor.G)*(255-a)) / 255),
+				B: uint8((uint32(src.B)*a + uint32(dstColor.B)*(255-a)) / 255),
+				A: 0xff,
+			})
+		}
+	}
+}
+
+// Compose arranges the images into a grid as square as possible, and draws the labels to the top left
+// corners of the tiles. Tiles are downscaled if the grid's width + height would exceed maxDimensionsSum.
+func Compose(imgs []image.Image, labels []string, maxDimensionsSum int) *image.NRGBA {
+	cols := int(math.Ceil(math.Sqrt(float64(len(imgs)))))
+	rows := (len(imgs) + cols - 1) / cols
+
+	var tileWidth, tileHeight int
+	for _, img := range imgs {
+		tileWidth = max(tileWidth, img.Bounds().Dx())
+		tileHeight = max(tileHeight, img.Bounds().Dy())
+	}
+	gridDimensionsSum := cols*tileWidth + rows*tileHeight + (cols+rows+2)*tileGap
+	scale := min(1, float64(maxDimensionsSum)/float64(gridDimensionsSum))
+	tileWidth = max(int(float64(tileWidth)*scale), 1)
+	tileHeight = max(int(float64(tileHeight)*scale), 1)
+
+	grid := image.NewNRGBA(image.Rect(0, 0, cols*(tileWidth+tileGap)+tileGap, rows*(tileHeight+tileGap)+tileGap))
+	draw.Draw(grid, grid.Bounds(), image.NewUniform(backgroundColor), image.Point{}, draw.Src)
+
+	labelScale := max(1, tileHeight/256)
+	for i, img := range imgs {
+		at := image.Pt(tileGap+(i%cols)*(tileWidth+tileGap), tileGap+(i/cols)*(tileHeight+tileGap))
+
+		// Smaller images are centered in their tiles.
+		tile := img
+		w, h := img.Bounds().Dx(), img.Bounds().Dy()
+		if scale < 1 {
+			w, h = max(int(float64(w)*scale), 1), max(int(float64(h)*scale), 1)
+			tile = imgenc.Downscale(img, w, h)
+		}
+		tileAt := at.Add(image.Pt((tileWidth-w)/2, (tileHeight-h)/2))
+		draw.Draw(grid, image.Rectangle{Min: tileAt, Max: tileAt.Add(image.Pt(w, h))}, tile, tile.Bounds().Min, draw.Over)
+
+		if i < len(labels) && labels[i] != "" {
+			drawLabel(grid, at, labels[i], labelScale)
+		}
+	}
+	return grid
+}
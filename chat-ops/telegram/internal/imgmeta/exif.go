@@ -0,0 +1,118 @@
+package imgmeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"unicode/utf16"
+)
+
+const (
+	exifTagExifIFDPointer = 0x8769
+	exifTagUserComment    = 0x9286
+
+	exifTypeLong      = 4
+	exifTypeUndefined = 7
+)
+
+var (
+	exifUserCommentUnicodePrefix = []byte("UNICODE\x00")
+	exifUserCommentASCIIPrefix   = []byte("ASCII\x00\x00\x00")
+)
+
+// BuildEXIFUserComment returns a big-endian TIFF structure containing only the given user comment, the same
+// way as AUTOMATIC1111 (piexif) stores the infotext in JPEG and WebP images.
+func BuildEXIFUserComment(comment string) []byte {
+	const ifd0Offset = 8
+	const exifIFDOffset = ifd0Offset + 2 + 12 + 4
+	const commentOffset = exifIFDOffset + 2 + 12 + 4
+
+	commentData := append([]byte{}, exifUserCommentUnicodePrefix...)
+	for _, c := range utf16.Encode([]rune(comment)) {
+		commentData = binary.BigEndian.AppendUint16(commentData, c)
+	}
+
+	be := binary.BigEndian
+	tiff := []byte("MM")
+	tiff = be.AppendUint16(tiff, 42)
+	tiff = be.AppendUint32(tiff, ifd0Offset)
+
+	tiff = be.AppendUint16(tiff, 1) // IFD0 entry count.
+	tiff = be.AppendUint16(tiff, exifTagExifIFDPointer)
+	tiff = be.AppendUint16(tiff, exifTypeLong)
+	tiff = be.AppendUint32(tiff, 1)
+	tiff = be.AppendUint32(tiff, exifIFDOffset)
+	tiff = be.AppendUint32(tiff, 0) // No next IFD.
+
+	tiff = be.AppendUint16(tiff, 1) // Exif IFD entry count.
+	tiff = be.AppendUint16(tiff, exifTagUserComment)
+	tiff = be.AppendUint16(tiff, exifTypeUndefined)
+	tiff = be.AppendUint32(tiff, uint32(len(commentData)))
+	tiff = be.AppendUint32(tiff, commentOffset)
+	tiff = be.AppendUint32(tiff, 0)
+
+	return append(tiff, commentData...)
+}
+
+// Returns the position of the given tag's entry in the IFD at ifdOffset.
+func findEXIFEntry(tiff []byte, order binary.ByteOrder, ifdOffset uint32, tag uint16) (entryAt int, err error) {
+	if int(ifdOffset)+2 > len(tiff) {
+		return 0, fmt.Errorf("invalid ifd offset")
+	}
+	entryCount := int(order.Uint16(tiff[ifdOffset:]))
+	for i := 0; i < entryCount; i++ {
+		entryAt = int(ifdOffset) + 2 + i*12
+		if entryAt+12 > len(tiff) {
+			return 0, fmt.Errorf("truncated ifd")
+		}
+		if order.Uint16(tiff[entryAt:]) == tag {
+			return entryAt, nil
+		}
+	}
+	return 0, fmt.Errorf("tag %#x not found", tag)
+}
+
+// ParseEXIFUserComment returns the user comment from the given TIFF structure.
+func ParseEXIFUserComment(tiff []byte) (comment string, err error) {
+	if len(tiff) < 8 {
+		return "", fmt.Errorf("truncated exif")
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "MM":
+		order = binary.BigEndian
+	case "II":
+		order = binary.LittleEndian
+	default:
+		return "", fmt.Errorf("invalid exif byte order")
+	}
+
+	entryAt, err := findEXIFEntry(tiff, order, order.Uint32(tiff[4:]), exifTagExifIFDPointer)
+	if err != nil {
+		return "", err
+	}
+	entryAt, err = findEXIFEntry(tiff, order, order.Uint32(tiff[entryAt+8:]), exifTagUserComment)
+	if err != nil {
+		return "", err
+	}
+	commentLen := order.Uint32(tiff[entryAt+4:])
+	commentOffset := order.Uint32(tiff[entryAt+8:])
+	if commentLen < 8 || uint64(commentOffset)+uint64(commentLen) > uint64(len(tiff)) {
+		return "", fmt.Errorf("invalid user comment")
+	}
+
+	commentData := tiff[commentOffset : commentOffset+commentLen]
+	switch {
+	case bytes.HasPrefix(commentData, exifUserCommentUnicodePrefix):
+		commentData = commentData[8:]
+		u := make([]uint16, len(commentData)/2)
+		for i := range u {
+			u[i] = binary.BigEndian.Uint16(commentData[i*2:])
+		}
+		return string(utf16.Decode(u)), nil
+	case bytes.HasPrefix(commentData, exifUserCommentASCIIPrefix):
+		return string(commentData[8:]), nil
+	default:
+		return string(bytes.TrimLeft(commentData[8:], "\x00")), nil
+	}
+}
@@ -0,0 +1,69 @@
+package imgmeta
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestEXIFUserComment(t *testing.T) {
+	for _, comment := range []string{"a cat\nSteps: 20", "Unicode: 猫, emoji 🐱", ""} {
+		if read, err := ParseEXIFUserComment(BuildEXIFUserComment(comment)); err != nil || read != comment {
+			t.Errorf("%q: read %q, %v", comment, read, err)
+		}
+	}
+
+	// A little-endian TIFF with an ASCII comment, like some other tools write.
+	le := binary.LittleEndian
+	tiff := []byte("II")
+	tiff = le.AppendUint16(tiff, 42)
+	tiff = le.AppendUint32(tiff, 8)
+	tiff = le.AppendUint16(tiff, 1)
+	tiff = le.AppendUint16(tiff, exifTagExifIFDPointer)
+	tiff = le.AppendUint16(tiff, exifTypeLong)
+	tiff = le.AppendUint32(tiff, 1)
+	tiff = le.AppendUint32(tiff, 26)
+	tiff = le.AppendUint32(tiff, 0)
+	tiff = le.AppendUint16(tiff, 1)
+	tiff = le.AppendUint16(tiff, exifTagUserComment)
+	tiff = le.AppendUint16(tiff, exifTypeUndefined)
+	tiff = le.AppendUint32(tiff, 13)
+	tiff = le.AppendUint32(tiff, 44)
+	tiff = le.AppendUint32(tiff, 0)
+	tiff = append(tiff, "ASCII\x00\x00\x00a cat"...)
+	if read, err := ParseEXIFUserComment(tiff); err != nil || read != "a cat" {
+		t.Errorf("little-endian ascii comment read %q, %v", read, err)
+	}
+}
+
+func TestParseEXIFUserCommentCorrupt(t *testing.T) {
+	tiff := BuildEXIFUserComment("a cat")
+	// Every truncation has to fail without panicking.
+	for i := 0; i < len(tiff)-len("a cat")*2; i++ {
+		if _, err := ParseEXIFUserComment(tiff[:i]); err == nil {
+			t.Errorf("truncated to %d bytes: no error", i)
+		}
+	}
+
+	corrupt := func(at int, b ...byte) []byte {
+		res := append([]byte{}, tiff...)
+		copy(res[at:], b)
+		return res
+	}
+	for _, tt := range []struct {
+		name string
+		tiff []byte
+	}{
+		{"invalid byte order", corrupt(0, 'X', 'X')},
+		{"ifd0 offset out of range", corrupt(4, 0xff, 0xff, 0xff, 0xff)},
+		{"no exif ifd pointer", corrupt(10, 0, 0)},
+		{"exif ifd offset out of range", corrupt(18, 0xff, 0xff, 0xff, 0xff)},
+		{"entries past the end", corrupt(26, 0xff, 0xff, 0, 0)},
+		{"no user comment", corrupt(28, 0, 0)},
+		{"comment out of range", corrupt(36, 0xff, 0xff, 0xff, 0xff)},
+		{"comment too short", corrupt(32, 0, 0, 0, 4)},
+	} {
+		if _, err := ParseEXIFUserComment(tt.tiff); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
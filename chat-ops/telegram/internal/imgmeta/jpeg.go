@@ -0,0 +1,120 @@
+package imgmeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	jpegMarkerSOI  = 0xd8
+	jpegMarkerSOS  = 0xda
+	jpegMarkerAPP0 = 0xe0
+	jpegMarkerAPP1 = 0xe1
+)
+
+var jpegExifHeader = []byte("Exif\x00\x00")
+
+type jpegSegment struct {
+	marker byte
+	data   []byte // Whole segment including the marker and length.
+}
+
+// Returns the segments before the image data, and the rest of the file starting with the SOS segment.
+func splitJPEGSegments(data []byte) (segments []jpegSegment, rest []byte, err error) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != jpegMarkerSOI {
+		return nil, nil, fmt.Errorf("not a jpeg file")
+	}
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xff {
+			return nil, nil, fmt.Errorf("invalid jpeg marker at %d", pos)
+		}
+		marker := data[pos+1]
+		if marker == jpegMarkerSOS {
+			return segments, data[pos:], nil
+		}
+		segLen := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if pos+2+segLen > len(data) {
+			return nil, nil, fmt.Errorf("truncated jpeg segment")
+		}
+		segments = append(segments, jpegSegment{marker: marker, data: data[pos : pos+2+segLen]})
+		pos += 2 + segLen
+	}
+	return nil, nil, fmt.Errorf("missing jpeg image data")
+}
+
+func isJPEGExifSegment(s jpegSegment) bool {
+	return s.marker == jpegMarkerAPP1 && bytes.HasPrefix(s.data[4:], jpegExifHeader)
+}
+
+func isJPEGXMPSegment(s jpegSegment) bool {
+	return s.marker == jpegMarkerAPP1 && bytes.HasPrefix(s.data[4:], jpegXMPHeader)
+}
+
+// Returns an APP1 segment with the given header and data, or nil if it doesn't fit into a segment.
+func jpegAPP1Segment(header, data []byte) []byte {
+	segLen := 2 + len(header) + len(data)
+	if segLen > 0xffff {
+		return nil
+	}
+	segment := []byte{0xff, jpegMarkerAPP1}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(segLen))
+	segment = append(segment, header...)
+	return append(segment, data...)
+}
+
+// WriteJPEGUserComment stores the given comment as EXIF UserComment and as exif:UserComment in an XMP
+// packet in the JPEG file, replacing existing EXIF and XMP data. The XMP packet is left out if it's too long
+// for a segment, as its escaping can make it longer than the EXIF data.
+func WriteJPEGUserComment(data []byte, comment string) ([]byte, error) {
+	segments, rest, err := splitJPEGSegments(data)
+	if err != nil {
+		return nil, err
+	}
+
+	metaSegments := jpegAPP1Segment(jpegExifHeader, BuildEXIFUserComment(comment))
+	if metaSegments == nil {
+		return nil, fmt.Errorf("comment is too long for a jpeg exif segment")
+	}
+	metaSegments = append(metaSegments, jpegAPP1Segment(jpegXMPHeader, BuildXMPUserComment(comment))...)
+
+	res := make([]byte, 0, len(data)+len(metaSegments))
+	res = append(res, 0xff, jpegMarkerSOI)
+	metaWritten := false
+	for _, s := range segments {
+		if isJPEGExifSegment(s) || isJPEGXMPSegment(s) {
+			continue
+		}
+		// The metadata goes after the JFIF header if there's one, otherwise right after SOI.
+		if !metaWritten && s.marker != jpegMarkerAPP0 {
+			res = append(res, metaSegments...)
+			metaWritten = true
+		}
+		res = append(res, s.data...)
+	}
+	if !metaWritten {
+		res = append(res, metaSegments...)
+	}
+	return append(res, rest...), nil
+}
+
+// ReadJPEGUserComment returns the EXIF UserComment of the JPEG file, or the exif:UserComment of its XMP
+// packet if it has no EXIF data.
+func ReadJPEGUserComment(data []byte) (comment string, err error) {
+	segments, _, err := splitJPEGSegments(data)
+	if err != nil {
+		return "", err
+	}
+	for _, s := range segments {
+		if isJPEGExifSegment(s) {
+			return ParseEXIFUserComment(s.data[4+len(jpegExifHeader):])
+		}
+	}
+	for _, s := range segments {
+		if isJPEGXMPSegment(s) {
+			return ParseXMPUserComment(s.data[4+len(jpegXMPHeader):])
+		}
+	}
+	return "", fmt.Errorf("no exif data")
+}
@@ -0,0 +1,111 @@
+package imgmeta
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"strings"
+	"testing"
+)
+
+func testJPEG(t *testing.T) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, image.NewRGBA(image.Rect(0, 0, 2, 2)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// Returns the data without the APP1 segments with the given header.
+func removeJPEGSegments(t *testing.T, data, header []byte) []byte {
+	t.Helper()
+	segments, rest, err := splitJPEGSegments(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := []byte{0xff, jpegMarkerSOI}
+	for _, s := range segments {
+		if s.marker != jpegMarkerAPP1 || !bytes.HasPrefix(s.data[4:], header) {
+			res = append(res, s.data...)
+		}
+	}
+	return append(res, rest...)
+}
+
+func TestJPEGUserComment(t *testing.T) {
+	for _, comment := range []string{
+		"a cat\nNegative prompt: a dog\nSteps: 20, Sampler: Euler a, Size: 512x512",
+		"Unicode: 猫, emoji 🐱",
+		`XML special chars: <a> & "b"`,
+		"",
+	} {
+		data, err := WriteJPEGUserComment(testJPEG(t), comment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Written again, so the old segments have to be replaced.
+		if data, err = WriteJPEGUserComment(data, comment); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = jpeg.Decode(bytes.NewReader(data)); err != nil {
+			t.Errorf("%q: written jpeg doesn't decode: %v", comment, err)
+		}
+		if n := bytes.Count(data, jpegExifHeader); n != 1 {
+			t.Errorf("%q: %d exif segments", comment, n)
+		}
+		if n := bytes.Count(data, jpegXMPHeader); n != 1 {
+			t.Errorf("%q: %d xmp segments", comment, n)
+		}
+
+		if read, err := ReadJPEGUserComment(data); err != nil || read != comment {
+			t.Errorf("%q: read %q, %v", comment, read, err)
+		}
+		// Files with XMP only are read too.
+		xmpOnly := removeJPEGSegments(t, data, jpegExifHeader)
+		if read, err := ReadJPEGUserComment(xmpOnly); err != nil || read != comment {
+			t.Errorf("%q: read %q, %v from xmp", comment, read, err)
+		}
+	}
+}
+
+func TestJPEGUserCommentErrors(t *testing.T) {
+	// The XMP packet is longer because of the escaping, it's left out if it doesn't fit into a segment.
+	longComment := strings.Repeat("<", 30000)
+	data, err := WriteJPEGUserComment(testJPEG(t), longComment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, jpegXMPHeader) {
+		t.Error("too long xmp segment written")
+	}
+	if read, err := ReadJPEGUserComment(data); err != nil || read != longComment {
+		t.Errorf("long comment read with %v", err)
+	}
+	if _, err = WriteJPEGUserComment(testJPEG(t), strings.Repeat("a", 40000)); err == nil {
+		t.Error("too long exif segment written")
+	}
+
+	withComment, err := WriteJPEGUserComment(testJPEG(t), "a cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		data []byte
+	}{
+		{"not jpeg", []byte("GIF89a")},
+		{"empty", nil},
+		{"no comment", testJPEG(t)},
+		{"truncated segment", withComment[:30]},
+		{"no image data", withComment[:bytes.Index(withComment, []byte{0xff, jpegMarkerSOS})]},
+		{"invalid marker", append([]byte{0xff, jpegMarkerSOI, 0x00, 0x00}, withComment[2:]...)},
+	} {
+		if _, err := ReadJPEGUserComment(tt.data); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+	if _, err = WriteJPEGUserComment(withComment[:30], "a cat"); err == nil {
+		t.Error("wrote comment into a truncated file")
+	}
+}
@@ -0,0 +1,208 @@
+package imgmeta
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+var pngSignature = []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'}
+
+// The total size of the decompressed text chunks of a file is limited, as a small crafted file could expand
+// to gigabytes. Real infotexts are a few kilobytes.
+const maxInflatedTextSize = 1024 * 1024
+
+// ReadPNGTextChunks returns the keyword-value pairs stored in the tEXt, zTXt and iTXt chunks of the
+// given PNG file.
+func ReadPNGTextChunks(data []byte) (texts map[string]string, err error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, fmt.Errorf("not a png file")
+	}
+
+	texts = make(map[string]string)
+	inflateBudget := maxInflatedTextSize
+	pos := len(pngSignature)
+	for pos+8 <= len(data) {
+		chunkLen := int(binary.BigEndian.Uint32(data[pos:]))
+		chunkType := string(data[pos+4 : pos+8])
+		if pos+8+chunkLen+4 > len(data) {
+			return nil, fmt.Errorf("truncated %s chunk", chunkType)
+		}
+		chunkData := data[pos+8 : pos+8+chunkLen]
+		pos += 8 + chunkLen + 4 // Skipping the CRC too.
+
+		var keyword, text string
+		switch chunkType {
+		case "tEXt":
+			keyword, text, err = parsePNGtEXt(chunkData)
+		case "zTXt":
+			keyword, text, err = parsePNGzTXt(chunkData, &inflateBudget)
+		case "iTXt":
+			keyword, text, err = parsePNGiTXt(chunkData, &inflateBudget)
+		case "IEND":
+			return texts, nil
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s chunk parse error: %w", chunkType, err)
+		}
+		texts[keyword] = text
+	}
+	return texts, nil
+}
+
+func latin1ToString(b []byte) string {
+	runes := make([]rune, len(b))
+	for i := range b {
+		runes[i] = rune(b[i])
+	}
+	return string(runes)
+}
+
+func splitNullTerminated(b []byte) (field []byte, rest []byte, err error) {
+	nullAt := bytes.IndexByte(b, 0)
+	if nullAt == -1 {
+		return nil, nil, fmt.Errorf("missing null separator")
+	}
+	return b[:nullAt], b[nullAt+1:], nil
+}
+
+// Decompresses at most budget bytes and decreases the budget by the decompressed size.
+func inflate(b []byte, budget *int) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	res, err := io.ReadAll(io.LimitReader(r, int64(*budget)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(res) > *budget {
+		return nil, fmt.Errorf("decompressed text is larger than %d bytes", maxInflatedTextSize)
+	}
+	*budget -= len(res)
+	return res, nil
+}
+
+func parsePNGtEXt(chunkData []byte) (keyword, text string, err error) {
+	k, rest, err := splitNullTerminated(chunkData)
+	if err != nil {
+		return "", "", err
+	}
+	return latin1ToString(k), latin1ToString(rest), nil
+}
+
+func parsePNGzTXt(chunkData []byte, inflateBudget *int) (keyword, text string, err error) {
+	k, rest, err := splitNullTerminated(chunkData)
+	if err != nil {
+		return "", "", err
+	}
+	if len(rest) < 1 {
+		return "", "", fmt.Errorf("missing compression method")
+	}
+	inflated, err := inflate(rest[1:], inflateBudget)
+	if err != nil {
+		return "", "", err
+	}
+	return latin1ToString(k), latin1ToString(inflated), nil
+}
+
+func parsePNGiTXt(chunkData []byte, inflateBudget *int) (keyword, text string, err error) {
+	k, rest, err := splitNullTerminated(chunkData)
+	if err != nil {
+		return "", "", err
+	}
+	if len(rest) < 2 {
+		return "", "", fmt.Errorf("missing compression flags")
+	}
+	compressed := rest[0] == 1
+	rest = rest[2:]
+	if _, rest, err = splitNullTerminated(rest); err != nil { // Language tag.
+		return "", "", err
+	}
+	if _, rest, err = splitNullTerminated(rest); err != nil { // Translated keyword.
+		return "", "", err
+	}
+	if compressed {
+		if rest, err = inflate(rest, inflateBudget); err != nil {
+			return "", "", err
+		}
+	}
+	return latin1ToString(k), string(rest), nil
+}
+
+func isLatin1(s string) bool {
+	for _, r := range s {
+		if r > 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+func stringToLatin1(s string) []byte {
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		b = append(b, byte(r))
+	}
+	return b
+}
+
+func appendPNGChunk(dst []byte, chunkType string, chunkData []byte) []byte {
+	chunkStart := len(dst)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(chunkData)))
+	dst = append(dst, chunkType...)
+	dst = append(dst, chunkData...)
+	return binary.BigEndian.AppendUint32(dst, crc32.ChecksumIEEE(dst[chunkStart+4:]))
+}
+
+// WritePNGTextChunk stores the given text in the PNG file. Existing text chunks with the same keyword are
+// removed. Like AUTOMATIC1111, a tEXt chunk is used if the text can be encoded as Latin-1, iTXt otherwise.
+func WritePNGTextChunk(data []byte, keyword, text string) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, fmt.Errorf("not a png file")
+	}
+
+	var chunkType string
+	var chunkData []byte
+	if isLatin1(text) {
+		chunkType = "tEXt"
+		chunkData = append(stringToLatin1(keyword), 0)
+		chunkData = append(chunkData, stringToLatin1(text)...)
+	} else {
+		chunkType = "iTXt"
+		chunkData = append(stringToLatin1(keyword), 0, 0, 0, 0, 0) // No compression, empty language and translated keyword.
+		chunkData = append(chunkData, text...)
+	}
+
+	res := make([]byte, 0, len(data)+len(chunkData)+12)
+	res = append(res, pngSignature...)
+	pos := len(pngSignature)
+	for pos+8 <= len(data) {
+		chunkLen := int(binary.BigEndian.Uint32(data[pos:]))
+		curChunkType := string(data[pos+4 : pos+8])
+		if pos+8+chunkLen+4 > len(data) {
+			return nil, fmt.Errorf("truncated %s chunk", curChunkType)
+		}
+		chunk := data[pos : pos+8+chunkLen+4]
+		pos += len(chunk)
+
+		switch curChunkType {
+		case "tEXt", "zTXt", "iTXt":
+			if k, _, err := splitNullTerminated(chunk[8:]); err == nil && latin1ToString(k) == keyword {
+				continue // Dropping the old value.
+			}
+		}
+		res = append(res, chunk...)
+
+		if curChunkType == "IHDR" { // The text chunk goes right after the header.
+			res = appendPNGChunk(res, chunkType, chunkData)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,140 @@
+package imgmeta
+
+import (
+	"bytes"
+	"compress/zlib"
+	"image"
+	"image/png"
+	"maps"
+	"strings"
+	"testing"
+)
+
+func deflate(t *testing.T, s string) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	w := zlib.NewWriter(&b)
+	if _, err := w.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestReadPNGTextChunksInflateLimit(t *testing.T) {
+	zTXt := func(keyword string, size int) []byte {
+		return append([]byte(keyword+"\x00\x00"), deflate(t, strings.Repeat("a", size))...)
+	}
+	png := func(chunks ...[]byte) []byte {
+		data := append([]byte{}, pngSignature...)
+		for _, c := range chunks {
+			data = appendPNGChunk(data, "zTXt", c)
+		}
+		return appendPNGChunk(data, "IEND", nil)
+	}
+
+	if _, err := ReadPNGTextChunks(png(zTXt("a", maxInflatedTextSize/2), zTXt("b", maxInflatedTextSize/2))); err != nil {
+		t.Errorf("chunks within the limit got %v", err)
+	}
+	if _, err := ReadPNGTextChunks(png(zTXt("a", maxInflatedTextSize+1))); err == nil {
+		t.Error("chunk over the limit accepted")
+	}
+	// The limit is for all the chunks together.
+	if _, err := ReadPNGTextChunks(png(zTXt("a", maxInflatedTextSize/2+1), zTXt("b", maxInflatedTextSize/2+1))); err == nil {
+		t.Error("chunks over the limit accepted")
+	}
+}
+
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	if err := png.Encode(&b, image.NewRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestPNGTextChunk(t *testing.T) {
+	for _, text := range []string{
+		"a cat\nNegative prompt: a dog\nSteps: 20, Sampler: Euler a, Size: 512x512",
+		"Latin-1 only: café",
+		"Unicode: 猫, emoji 🐱",
+		"",
+	} {
+		data, err := WritePNGTextChunk(testPNG(t), "parameters", text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Written again, so the old value has to be replaced.
+		if data, err = WritePNGTextChunk(data, "parameters", text); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = png.Decode(bytes.NewReader(data)); err != nil {
+			t.Errorf("%q: written png doesn't decode: %v", text, err)
+		}
+		texts, err := ReadPNGTextChunks(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(texts) != 1 || texts["parameters"] != text {
+			t.Errorf("%q: read %q", text, texts)
+		}
+	}
+}
+
+func TestReadPNGTextChunks(t *testing.T) {
+	base := testPNG(t)
+	// Inserts the chunk after the IHDR chunk, which is 25 bytes long.
+	withChunk := func(chunkType string, chunkData []byte) []byte {
+		data := append([]byte{}, base[:33]...)
+		data = appendPNGChunk(data, chunkType, chunkData)
+		return append(data, base[33:]...)
+	}
+	withText, err := WritePNGTextChunk(base, "parameters", "a cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		data  []byte
+		texts map[string]string
+		fails bool
+	}{
+		{"no text", base, map[string]string{}, false},
+		{"tEXt", withChunk("tEXt", []byte("k\x00v")), map[string]string{"k": "v"}, false},
+		{"zTXt", withChunk("zTXt", append([]byte("k\x00\x00"), deflate(t, "v")...)), map[string]string{"k": "v"}, false},
+		{"iTXt", withChunk("iTXt", []byte("k\x00\x00\x00en\x00k\x00猫")), map[string]string{"k": "猫"}, false},
+		{"compressed iTXt", withChunk("iTXt", append([]byte("k\x00\x01\x00\x00\x00"), deflate(t, "猫")...)), map[string]string{"k": "猫"}, false},
+		{"not png", []byte("GIF89a"), nil, true},
+		{"empty", nil, nil, true},
+		{"truncated", withText[:len(withText)-20], nil, true},
+		{"tEXt without separator", withChunk("tEXt", []byte("kv")), nil, true},
+		{"zTXt without compression method", withChunk("zTXt", []byte("k\x00")), nil, true},
+		{"zTXt with invalid data", withChunk("zTXt", []byte("k\x00\x00not zlib")), nil, true},
+		{"iTXt without flags", withChunk("iTXt", []byte("k\x00")), nil, true},
+		{"iTXt without language tag", withChunk("iTXt", []byte("k\x00\x00\x00en")), nil, true},
+	} {
+		texts, err := ReadPNGTextChunks(tt.data)
+		if tt.fails {
+			if err == nil {
+				t.Errorf("%s: no error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if !maps.Equal(texts, tt.texts) {
+			t.Errorf("%s: read %q", tt.name, texts)
+		}
+	}
+
+	if _, err := WritePNGTextChunk([]byte("GIF89a"), "k", "v"); err == nil {
+		t.Error("wrote text into a non-png file")
+	}
+	if _, err := WritePNGTextChunk(withText[:len(withText)-20], "k", "v"); err == nil {
+		t.Error("wrote text into a truncated file")
+	}
+}
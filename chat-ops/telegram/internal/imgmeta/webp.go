@@ -0,0 +1,36 @@
+package imgmeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// ReadWebPUserComment returns the EXIF UserComment of the WebP file, or the exif:UserComment of its XMP
+// chunk if it has no EXIF chunk.
+func ReadWebPUserComment(data []byte) (comment string, err error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return "", fmt.Errorf("not a webp file")
+	}
+	var xmp []byte
+	pos := 12
+	for pos+8 <= len(data) {
+		fourCC := string(data[pos : pos+4])
+		chunkLen := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		if pos+8+chunkLen > len(data) {
+			return "", fmt.Errorf("truncated %s chunk", fourCC)
+		}
+		if fourCC == "EXIF" {
+			// Some encoders keep the JPEG APP1 header.
+			return ParseEXIFUserComment(bytes.TrimPrefix(data[pos+8:pos+8+chunkLen], jpegExifHeader))
+		}
+		if fourCC == "XMP " {
+			xmp = data[pos+8 : pos+8+chunkLen]
+		}
+		pos += 8 + chunkLen + chunkLen%2
+	}
+	if xmp != nil {
+		return ParseXMPUserComment(xmp)
+	}
+	return "", fmt.Errorf("no exif data")
+}
@@ -0,0 +1,61 @@
+package imgmeta
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+type riffChunk struct {
+	fourCC string
+	data   []byte
+}
+
+// Returns a WebP file with the given chunks, the image data is not valid, only the container is.
+func testWebP(chunks ...riffChunk) []byte {
+	var body []byte
+	body = append(body, "WEBP"...)
+	for _, c := range chunks {
+		body = append(body, c.fourCC...)
+		body = binary.LittleEndian.AppendUint32(body, uint32(len(c.data)))
+		body = append(body, c.data...)
+		if len(c.data)%2 == 1 {
+			body = append(body, 0)
+		}
+	}
+	data := []byte("RIFF")
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(body)))
+	return append(data, body...)
+}
+
+func TestReadWebPUserComment(t *testing.T) {
+	const comment = "a cat\nSteps: 20, Sampler: Euler a"
+	img := riffChunk{"VP8L", []byte{0x2f, 0, 0, 0, 0}}
+	exif := riffChunk{"EXIF", BuildEXIFUserComment(comment)}
+	xmp := riffChunk{"XMP ", BuildXMPUserComment(comment)}
+
+	for _, tt := range []struct {
+		name  string
+		data  []byte
+		fails bool
+	}{
+		{"exif", testWebP(riffChunk{"VP8X", make([]byte, 10)}, img, exif), false},
+		{"exif with jpeg header", testWebP(img, riffChunk{"EXIF", append(append([]byte{}, jpegExifHeader...), exif.data...)}), false},
+		{"xmp", testWebP(img, xmp), false},
+		{"exif and xmp", testWebP(img, xmp, exif), false},
+		{"no metadata", testWebP(img), true},
+		{"not webp", []byte("RIFF\x00\x00\x00\x00WAVE"), true},
+		{"empty", nil, true},
+		{"truncated", testWebP(img, exif)[:40], true},
+		{"invalid exif", testWebP(img, riffChunk{"EXIF", []byte("MM\x00*")}), true},
+		{"invalid xmp", testWebP(img, riffChunk{"XMP ", []byte("<x:xmpmeta")}), true},
+	} {
+		read, err := ReadWebPUserComment(tt.data)
+		if tt.fails {
+			if err == nil {
+				t.Errorf("%s: no error", tt.name)
+			}
+		} else if err != nil || read != comment {
+			t.Errorf("%s: read %q, %v", tt.name, read, err)
+		}
+	}
+}
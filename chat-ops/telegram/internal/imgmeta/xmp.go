@@ -0,0 +1,53 @@
+package imgmeta
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+)
+
+// The header of the JPEG APP1 segments containing an XMP packet.
+var jpegXMPHeader = []byte("http://ns.adobe.com/xap/1.0/\x00")
+
+const (
+	xmpPacketStart = `<?xpacket begin="` + "\ufeff" + `" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+<rdf:Description rdf:about="" xmlns:exif="http://ns.adobe.com/exif/1.0/">
+<exif:UserComment><rdf:Alt><rdf:li xml:lang="x-default">`
+	xmpPacketEnd = `</rdf:li></rdf:Alt></exif:UserComment>
+</rdf:Description>
+</rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>`
+)
+
+// BuildXMPUserComment returns an XMP packet containing only the given comment as exif:UserComment, for
+// the tools which read XMP instead of EXIF.
+func BuildXMPUserComment(comment string) []byte {
+	var b bytes.Buffer
+	b.WriteString(xmpPacketStart)
+	_ = xml.EscapeText(&b, []byte(comment))
+	b.WriteString(xmpPacketEnd)
+	return b.Bytes()
+}
+
+type xmpMeta struct {
+	Descriptions []struct {
+		UserComments []string `xml:"UserComment>Alt>li"`
+	} `xml:"RDF>Description"`
+}
+
+// ParseXMPUserComment returns the exif:UserComment of the XMP packet.
+func ParseXMPUserComment(packet []byte) (comment string, err error) {
+	var meta xmpMeta
+	if err = xml.Unmarshal(packet, &meta); err != nil {
+		return "", fmt.Errorf("invalid xmp packet: %w", err)
+	}
+	for _, d := range meta.Descriptions {
+		if len(d.UserComments) > 0 {
+			return d.UserComments[0], nil
+		}
+	}
+	return "", fmt.Errorf("no user comment in xmp packet")
+}
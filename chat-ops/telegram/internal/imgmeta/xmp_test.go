@@ -0,0 +1,28 @@
+package imgmeta
+
+import "testing"
+
+func TestXMPUserComment(t *testing.T) {
+	for _, comment := range []string{
+		"a cat\nNegative prompt: a dog\nSteps: 20, Size: 512x512",
+		`XML special chars: <a> & "b" 'c'`,
+		"Unicode: 猫, emoji 🐱",
+		"",
+	} {
+		if read, err := ParseXMPUserComment(BuildXMPUserComment(comment)); err != nil || read != comment {
+			t.Errorf("%q: read %q, %v", comment, read, err)
+		}
+	}
+
+	for _, packet := range []string{
+		"",
+		"not xml",
+		`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF`,
+		`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+			`<rdf:Description rdf:about=""/></rdf:RDF></x:xmpmeta>`,
+	} {
+		if _, err := ParseXMPUserComment([]byte(packet)); err == nil {
+			t.Errorf("%q: no error", packet)
+		}
+	}
+}
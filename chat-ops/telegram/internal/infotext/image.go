@@ -0,0 +1,41 @@
+package infotext
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/imgmeta"
+)
+
+var ErrNotFound = fmt.Errorf("no generation parameters found in the image")
+
+// FromImage reads the infotext from the PNG text chunks or the JPEG/WebP EXIF user comment of the image.
+func FromImage(data []byte) (it Infotext, err error) {
+	var s string
+	if bytes.HasPrefix(data, []byte("\x89PNG")) {
+		texts, err := imgmeta.ReadPNGTextChunks(data)
+		if err != nil {
+			return it, err
+		}
+		var found bool
+		if s, found = texts[PNGKeyword]; !found {
+			return it, ErrNotFound
+		}
+	} else if bytes.HasPrefix(data, []byte{0xff, 0xd8}) {
+		if s, err = imgmeta.ReadJPEGUserComment(data); err != nil {
+			return it, ErrNotFound
+		}
+	} else if bytes.HasPrefix(data, []byte("RIFF")) {
+		if s, err = imgmeta.ReadWebPUserComment(data); err != nil {
+			return it, ErrNotFound
+		}
+	} else {
+		return it, fmt.Errorf("unsupported image format")
+	}
+
+	var found bool
+	if it, found = Parse(s); !found {
+		return it, ErrNotFound
+	}
+	return it, nil
+}
@@ -0,0 +1,114 @@
+package infotext
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The key which AUTOMATIC1111 uses for storing the infotext in PNG text chunks.
+const PNGKeyword = "parameters"
+
+const negativePromptPrefix = "Negative prompt:"
+
+type Param struct {
+	Key   string
+	Value string
+}
+
+// Infotext is the generation parameters text format used by AUTOMATIC1111 and sites like Civitai:
+//
+//	prompt
+//	Negative prompt: negative prompt
+//	Steps: 30, Sampler: Euler a, CFG scale: 7, Seed: 123, Size: 512x768, Model: name
+type Infotext struct {
+	Prompt         string
+	NegativePrompt string
+	Params         []Param
+}
+
+// Get returns the value of the given key, it's case insensitive.
+func (it Infotext) Get(key string) (value string, found bool) {
+	for _, p := range it.Params {
+		if strings.EqualFold(p.Key, key) {
+			return p.Value, true
+		}
+	}
+	return "", false
+}
+
+var paramRegex = regexp.MustCompile(`\s*(\w[\w \-/]+):\s*("(?:\\.|[^\\"])+"|[^,]*)(?:,|$)`)
+
+func parseParamsLine(line string) (params []Param) {
+	for _, match := range paramRegex.FindAllStringSubmatch(line, -1) {
+		value := strings.TrimSpace(match[2])
+		if strings.HasPrefix(value, "\"") {
+			if unquoted, err := strconv.Unquote(value); err == nil {
+				value = unquoted
+			}
+		}
+		params = append(params, Param{Key: strings.TrimSpace(match[1]), Value: value})
+	}
+	return
+}
+
+// Parse parses the infotext the same way as AUTOMATIC1111 does: the last line contains the params if it
+// has at least 3 "key: value" pairs, lines before the "Negative prompt:" line are the prompt.
+func Parse(s string) (it Infotext, found bool) {
+	lines := strings.Split(strings.TrimSpace(strings.ReplaceAll(s, "\r\n", "\n")), "\n")
+	if len(lines) == 0 {
+		return
+	}
+
+	params := parseParamsLine(lines[len(lines)-1])
+	if len(params) < 3 {
+		return
+	}
+	it.Params = params
+	lines = lines[:len(lines)-1]
+
+	var prompt, negativePrompt []string
+	inNegativePrompt := false
+	for _, line := range lines {
+		if strings.HasPrefix(line, negativePromptPrefix) {
+			inNegativePrompt = true
+			line = strings.TrimPrefix(line, negativePromptPrefix)
+		}
+		if inNegativePrompt {
+			negativePrompt = append(negativePrompt, line)
+		} else {
+			prompt = append(prompt, line)
+		}
+	}
+	it.Prompt = strings.TrimSpace(strings.Join(prompt, "\n"))
+	it.NegativePrompt = strings.TrimSpace(strings.Join(negativePrompt, "\n"))
+	return it, true
+}
+
+func quoteValue(s string) string {
+	if !strings.ContainsAny(s, ",:\n\"") {
+		return s
+	}
+	return strconv.Quote(s)
+}
+
+// Add appends the given param, values with separators get quoted on formatting.
+func (it *Infotext) Add(key, value string) {
+	it.Params = append(it.Params, Param{Key: key, Value: value})
+}
+
+// String formats the infotext the same way as AUTOMATIC1111 does, so it can be parsed by other tools.
+func (it Infotext) String() string {
+	var lines []string
+	if it.Prompt != "" {
+		lines = append(lines, it.Prompt)
+	}
+	if it.NegativePrompt != "" {
+		lines = append(lines, negativePromptPrefix+" "+it.NegativePrompt)
+	}
+	params := make([]string, len(it.Params))
+	for i, p := range it.Params {
+		params[i] = p.Key + ": " + quoteValue(p.Value)
+	}
+	return strings.Join(append(lines, strings.Join(params, ", ")), "\n")
+}
@@ -0,0 +1,105 @@
+package infotext
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		s     string
+		it    Infotext
+		found bool
+	}{
+		{
+			name: "full",
+			s:    "a cat\nNegative prompt: a dog\nSteps: 20, Sampler: Euler a, CFG scale: 7, Seed: -1, Size: 512x768",
+			it: Infotext{Prompt: "a cat", NegativePrompt: "a dog", Params: []Param{
+				{"Steps", "20"}, {"Sampler", "Euler a"}, {"CFG scale", "7"}, {"Seed", "-1"}, {"Size", "512x768"},
+			}},
+			found: true,
+		},
+		{
+			name: "multiline prompts and crlf",
+			s:    "a cat,\r\non a roof\r\nNegative prompt: a dog,\r\nblurry\r\nSteps: 20, Seed: 1, Size: 512x512",
+			it: Infotext{Prompt: "a cat,\non a roof", NegativePrompt: "a dog,\nblurry", Params: []Param{
+				{"Steps", "20"}, {"Seed", "1"}, {"Size", "512x512"},
+			}},
+			found: true,
+		},
+		{
+			name: "quoted values",
+			s:    `a cat` + "\n" + `Steps: 20, Lora hashes: "a: 1, b: 2", Prompt: "say \"hi\"", Seed: 1`,
+			it: Infotext{Prompt: "a cat", Params: []Param{
+				{"Steps", "20"}, {"Lora hashes", "a: 1, b: 2"}, {"Prompt", `say "hi"`}, {"Seed", "1"},
+			}},
+			found: true,
+		},
+		{
+			name:  "params only",
+			s:     "Steps: 20, Sampler: Euler a, Seed: 1",
+			it:    Infotext{Params: []Param{{"Steps", "20"}, {"Sampler", "Euler a"}, {"Seed", "1"}}},
+			found: true,
+		},
+		{name: "plain prompt", s: "a cat on a roof"},
+		{name: "too few params", s: "a cat\nStyle: anime, Mood: happy"},
+		{name: "empty", s: ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			it, found := Parse(tt.s)
+			if found != tt.found || !reflect.DeepEqual(it, tt.it) {
+				t.Errorf("Parse(%q) = %+v, %v, want %+v, %v", tt.s, it, found, tt.it, tt.found)
+			}
+		})
+	}
+}
+
+func TestStringRoundTrip(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		it   Infotext
+		s    string
+	}{
+		{
+			name: "plain",
+			it: Infotext{Prompt: "a cat", NegativePrompt: "a dog", Params: []Param{
+				{"Steps", "20"}, {"Sampler", "Euler a"}, {"Seed", "1"},
+			}},
+			s: "a cat\nNegative prompt: a dog\nSteps: 20, Sampler: Euler a, Seed: 1",
+		},
+		{
+			name: "separators quoted",
+			it: Infotext{Prompt: "a cat", Params: []Param{
+				{"Steps", "20"}, {"Lora hashes", "a: 1, b: 2"}, {"Note", "two\nlines"}, {"Quote", `say "hi"`},
+			}},
+			s: "a cat\nSteps: 20, Lora hashes: \"a: 1, b: 2\", Note: \"two\\nlines\", Quote: \"say \\\"hi\\\"\"",
+		},
+		{
+			name: "no prompt",
+			it:   Infotext{Params: []Param{{"Steps", "20"}, {"Seed", "1"}, {"Size", "512x512"}}},
+			s:    "Steps: 20, Seed: 1, Size: 512x512",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.it.String()
+			if s != tt.s {
+				t.Fatalf("String() = %q, want %q", s, tt.s)
+			}
+			it, found := Parse(s)
+			if !found || !reflect.DeepEqual(it, tt.it) {
+				t.Errorf("Parse(String()) = %+v, %v, want %+v", it, found, tt.it)
+			}
+		})
+	}
+}
+
+func TestGet(t *testing.T) {
+	it := Infotext{Params: []Param{{"CFG scale", "7"}}}
+	if v, found := it.Get("cfg SCALE"); !found || v != "7" {
+		t.Errorf("Get(cfg SCALE) = %q, %v", v, found)
+	}
+	if _, found := it.Get("steps"); found {
+		t.Error("Get(steps) found a missing key")
+	}
+}
@@ -0,0 +1,160 @@
+// Package jsonl keeps the last records in memory and appends them to a JSON lines file, so they can be
+// loaded on startup. The file is rewritten with the kept records only when it gets twice as long, so it
+// doesn't grow forever.
+package jsonl
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// The file is not compacted until it has at least this many lines.
+const compactMinLines = 100
+
+type Options[T any] struct {
+	// Only the last KeepCount records are kept if it's set.
+	KeepCount int
+	// Records are dropped from the oldest one while Expired returns true for them, if it's set.
+	Expired func(r T) bool
+}
+
+type Store[T any] struct {
+	mutex    sync.Mutex
+	name     string
+	filename string
+	opts     Options[T]
+	records  []T
+	// Lines in the file, including the ones of the dropped records.
+	fileLines int
+}
+
+// Open loads the records of the file if it exists. The name is used in the error messages. If filename is
+// empty, the records are only kept in memory.
+func Open[T any](name, filename string, opts Options[T]) (*Store[T], error) {
+	s := &Store[T]{
+		name:     name,
+		filename: filename,
+		opts:     opts,
+	}
+	if filename == "" {
+		return s, nil
+	}
+
+	f, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("can't open %s file: %w", name, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		s.fileLines++
+		var r T
+		if err = json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			slog.Warn("skipping invalid "+name+" line", "error", err)
+			continue
+		}
+		s.records = append(s.records, r)
+		s.trim()
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("can't read %s file: %w", name, err)
+	}
+	if s.fileLines > len(s.records) {
+		if err = s.compact(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *Store[T]) trim() {
+	if s.opts.KeepCount > 0 && len(s.records) > s.opts.KeepCount {
+		s.records = s.records[len(s.records)-s.opts.KeepCount:]
+	}
+	if s.opts.Expired == nil {
+		return
+	}
+	expired := 0
+	for expired < len(s.records) && s.opts.Expired(s.records[expired]) {
+		expired++
+	}
+	s.records = s.records[expired:]
+}
+
+// Rewrites the file with the kept records. Should be called with the mutex locked.
+func (s *Store[T]) compact() error {
+	tmpFilename := s.filename + ".tmp"
+	f, err := os.Create(tmpFilename)
+	if err != nil {
+		return fmt.Errorf("can't create %s file: %w", s.name, err)
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, r := range s.records {
+		if err = enc.Encode(r); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFilename, s.filename)
+	}
+	if err != nil {
+		_ = os.Remove(tmpFilename)
+		return fmt.Errorf("can't compact %s file: %w", s.name, err)
+	}
+	slog.Debug("compacted "+s.name+" file", "dropped", s.fileLines-len(s.records), "kept", len(s.records))
+	s.fileLines = len(s.records)
+	return nil
+}
+
+func (s *Store[T]) Add(r T) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.records = append(s.records, r)
+	s.trim()
+
+	if s.filename == "" {
+		return nil
+	}
+	if s.fileLines >= compactMinLines && s.fileLines >= 2*len(s.records) {
+		return s.compact()
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("can't encode %s record: %w", s.name, err)
+	}
+	f, err := os.OpenFile(s.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("can't open %s file: %w", s.name, err)
+	}
+	defer f.Close()
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("can't write %s file: %w", s.name, err)
+	}
+	s.fileLines++
+	return nil
+}
+
+// View calls fn with the kept records, oldest first. The records must not be modified or kept after fn
+// returns, and fn must not call the methods of the store.
+func (s *Store[T]) View(fn func(records []T)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	fn(s.records)
+}
@@ -0,0 +1,98 @@
+package jsonl
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func fileLines(t *testing.T, filename string) int {
+	t.Helper()
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Count(data, []byte("\n"))
+}
+
+func records(s *Store[int]) (res []int) {
+	s.View(func(records []int) {
+		res = slices.Clone(records)
+	})
+	return res
+}
+
+func TestStoreCompaction(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "records.jsonl")
+	s, err := Open[int]("test", filename, Options[int]{KeepCount: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 250; i++ {
+		if err = s.Add(i); err != nil {
+			t.Fatal(err)
+		}
+		if n := fileLines(t, filename); n > compactMinLines {
+			t.Fatalf("file has %d lines after %d records", n, i)
+		}
+	}
+	if got := records(s); !slices.Equal(got, []int{248, 249, 250}) {
+		t.Errorf("kept %v", got)
+	}
+
+	s, err = Open[int]("test", filename, Options[int]{KeepCount: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := records(s); !slices.Equal(got, []int{248, 249, 250}) {
+		t.Errorf("loaded %v", got)
+	}
+	if n := fileLines(t, filename); n != 3 {
+		t.Errorf("file has %d lines after loading", n)
+	}
+}
+
+func TestStoreExpired(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "records.jsonl")
+	if err := os.WriteFile(filename, []byte("1\n2\ninvalid\n3\n4\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open[int]("test", filename, Options[int]{Expired: func(r int) bool { return r < 3 }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := records(s); !slices.Equal(got, []int{3, 4}) {
+		t.Errorf("loaded %v", got)
+	}
+	if n := fileLines(t, filename); n != 2 {
+		t.Errorf("file has %d lines after loading", n)
+	}
+
+	if err = s.Add(5); err != nil {
+		t.Fatal(err)
+	}
+	s, err = Open[int]("test", filename, Options[int]{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := records(s); !slices.Equal(got, []int{3, 4, 5}) {
+		t.Errorf("loaded %v", got)
+	}
+}
+
+func TestStoreMemoryOnly(t *testing.T) {
+	s, err := Open[int]("test", "", Options[int]{KeepCount: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		if err = s.Add(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := records(s); !slices.Equal(got, []int{2, 3}) {
+		t.Errorf("kept %v", got)
+	}
+}
@@ -0,0 +1,98 @@
+// Package logging sets up the leveled structured logging of the bot. Log records of requests carry their task
+// ID, which is stored in the context.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const maxAttrLen = 4096
+
+type taskIDKey struct{}
+
+// WithTaskID returns a context whose log records carry the task ID.
+func WithTaskID(ctx context.Context, taskID uint64) context.Context {
+	return context.WithValue(ctx, taskIDKey{}, taskID)
+}
+
+// TaskID returns the task ID of the context, 0 if it's not set.
+func TaskID(ctx context.Context) uint64 {
+	taskID, _ := ctx.Value(taskIDKey{}).(uint64)
+	return taskID
+}
+
+// Adds the task ID of the context to the records.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if taskID := TaskID(ctx); taskID != 0 {
+		r.AddAttrs(slog.String("task_id", strconv.FormatUint(taskID, 10)))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// Base64 encoded images, optionally as data URLs.
+var base64Regex = regexp.MustCompile(`(data:[a-z]+/[a-z0-9.+-]+;base64,)?[A-Za-z0-9+/]{256,}={0,2}`)
+
+// Redact replaces the base64 encoded images in s, so request and response bodies can be logged.
+func Redact(s string) string {
+	s = base64Regex.ReplaceAllStringFunc(s, func(m string) string {
+		return fmt.Sprintf("<%d bytes of base64 redacted>", len(m))
+	})
+	if len(s) > maxAttrLen {
+		s = s[:maxAttrLen] + "...<truncated>"
+	}
+	return s
+}
+
+func redactAttr(_ []string, a slog.Attr) slog.Attr {
+	switch v := a.Value.Any().(type) {
+	case string:
+		if len(v) >= 256 {
+			a.Value = slog.StringValue(Redact(v))
+		}
+	case []byte:
+		a.Value = slog.StringValue(fmt.Sprintf("<%d bytes redacted>", len(v)))
+	}
+	return a
+}
+
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return level, fmt.Errorf("invalid log level, valid values are debug, info, warn and error")
+	}
+	return level, nil
+}
+
+// Setup makes the default logger write to w with the given level, in text or json format.
+func Setup(w io.Writer, level slog.Level, format string) error {
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr}
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("invalid log format, valid values are text and json")
+	}
+	slog.SetDefault(slog.New(contextHandler{h}))
+	return nil
+}
@@ -0,0 +1,104 @@
+package logic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/go-telegram/bot/models"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/chatsettings"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/consts"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/imgenc"
+)
+
+// Returns the output options of the chat, the bot defaults are used for the unset settings.
+func (c *CmdHandler) outputOptions(chatID int64) imgenc.Options {
+	o := c.defaults.Output
+	settings := c.chatSettings.Get(chatID)
+	if settings.OutputFormat != "" {
+		if format, err := imgenc.ParseFormat(settings.OutputFormat); err == nil {
+			o.Format = format
+		}
+	}
+	if settings.OutputQuality > 0 {
+		o.Quality = settings.OutputQuality
+	}
+	return o
+}
+
+// In groups only bot admins can change the chat settings, so members can't override each other.
+func (c *CmdHandler) canChangeChatSettings(msg *models.Message) bool {
+	return msg.Chat.ID >= 0 || c.us.IsAdmin(msg.From.ID)
+}
+
+// Parses "[format] [-q quality]" and also accepts the quality without the -q flag.
+func parseFormatArgs(args []string) (format string, quality int, err error) {
+	for i := 0; i < len(args); i++ {
+		arg := strings.ToLower(args[i])
+		if arg == "-q" || arg == "-quality" {
+			if i+1 >= len(args) {
+				return "", 0, errors.New(arg + " is missing value")
+			}
+			i++
+			arg = args[i]
+		}
+		if q, convErr := strconv.Atoi(arg); convErr == nil {
+			if q < 1 || q > imgenc.MaxQuality {
+				return "", 0, fmt.Errorf("invalid quality, valid values are 1-%d", imgenc.MaxQuality)
+			}
+			quality = q
+			continue
+		}
+		f, err := imgenc.ParseFormat(strings.TrimPrefix(arg, "-"))
+		if err != nil {
+			return "", 0, err
+		}
+		format = string(f)
+	}
+	return format, quality, nil
+}
+
+func (c *CmdHandler) format(ctx context.Context, msg *models.Message) {
+	args := strings.Fields(removeBotName(msg.Text))
+	if len(args) == 0 {
+		c.bot.SendReplyToMessage(ctx, msg, consts.FormatSetStr+c.outputOptions(msg.Chat.ID).String()+"\n"+consts.FormatUsageStr)
+		return
+	}
+
+	if !c.canChangeChatSettings(msg) {
+		c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": "+consts.ChatSettingsAdminOnlyStr)
+		return
+	}
+
+	var update func(settings *chatsettings.Settings)
+	if len(args) == 1 && strings.EqualFold(args[0], "reset") {
+		update = func(settings *chatsettings.Settings) {
+			settings.OutputFormat = ""
+			settings.OutputQuality = 0
+		}
+	} else {
+		format, quality, err := parseFormatArgs(args)
+		if err != nil {
+			c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": "+err.Error()+"\n"+consts.FormatUsageStr)
+			return
+		}
+		update = func(settings *chatsettings.Settings) {
+			if format != "" {
+				settings.OutputFormat = format
+			}
+			if quality > 0 {
+				settings.OutputQuality = quality
+			}
+		}
+	}
+
+	if err := c.chatSettings.Update(msg.Chat.ID, update); err != nil {
+		slog.ErrorContext(ctx, "chat settings save error", "error", err)
+		c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": can't save chat settings: "+err.Error())
+		return
+	}
+	c.bot.SendReplyToMessage(ctx, msg, consts.FormatSetStr+c.outputOptions(msg.Chat.ID).String())
+}
@@ -0,0 +1,21 @@
+package logic
+
+import (
+	"context"
+	"html"
+
+	"github.com/go-telegram/bot/models"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/consts"
+)
+
+func (c *CmdHandler) gallery(ctx context.Context, msg *models.Message) {
+	if c.Gallery == nil {
+		c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": "+consts.GalleryDisabledStr)
+		return
+	}
+	if msg.Chat.ID < 0 {
+		c.bot.SendReplyToMessage(ctx, msg, consts.GalleryPrivateOnlyStr)
+		return
+	}
+	c.bot.SendReplyToMessage(ctx, msg, consts.GalleryLinkStr+html.EscapeString(c.Gallery.Link(msg.From.ID)))
+}
@@ -2,7 +2,7 @@ package logic
 
 import (
 	"context"
-	"fmt"
+	"log/slog"
 	"time"
 
 	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/consts"
@@ -27,7 +27,7 @@ func (wc *WriteCounter) Write(p []byte) (int, error) {
 
 	if time.Since(wc.LastProgressPrintAt) > wc.ProgressPrintInterval {
 		progressPercent := int(float64(wc.GotBytes) / float64(wc.TotalBytes) * 100)
-		fmt.Print("    progress: ", progressPercent, "%\n")
+		slog.DebugContext(wc.Ctx, "download progress", "percent", progressPercent)
 		wc.reqQueue.SendReplyToCurrentEntry(wc.Ctx, consts.DownloadingStr+" "+utils.GetProgressbar(progressPercent, consts.ProgressBarLength))
 		wc.LastProgressPrintAt = time.Now()
 	}
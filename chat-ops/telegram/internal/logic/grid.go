@@ -0,0 +1,102 @@
+package logic
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/go-telegram/bot/models"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/chatsettings"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/consts"
+)
+
+func gridSettingString(enabled bool) string {
+	if enabled {
+		return "on"
+	}
+	return "off"
+}
+
+func (c *CmdHandler) grid(ctx context.Context, msg *models.Message) {
+	arg := strings.ToLower(strings.TrimSpace(removeBotName(msg.Text)))
+	if arg == "" {
+		c.bot.SendReplyToMessage(ctx, msg, consts.GridSetStr+gridSettingString(c.chatSettings.Get(msg.Chat.ID).Grid)+"\n"+consts.GridUsageStr)
+		return
+	}
+	if arg != "on" && arg != "off" {
+		c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": "+consts.GridUsageStr)
+		return
+	}
+
+	if !c.canChangeChatSettings(msg) {
+		c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": "+consts.ChatSettingsAdminOnlyStr)
+		return
+	}
+
+	err := c.chatSettings.Update(msg.Chat.ID, func(settings *chatsettings.Settings) {
+		settings.Grid = arg == "on"
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "chat settings save error", "error", err)
+		c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": can't save chat settings: "+err.Error())
+		return
+	}
+	c.bot.SendReplyToMessage(ctx, msg, consts.GridSetStr+gridSettingString(arg == "on"))
+}
+
+// Handles the buttons under the grid, the callback data is "grid:<task id>:<tile number or zip>".
+func (c *CmdHandler) gridCallback(ctx context.Context, cb *models.CallbackQuery) {
+	taskIDStr, tile, found := strings.Cut(strings.TrimPrefix(cb.Data, consts.GridCallbackDataPrefix), ":")
+	taskID, err := strconv.ParseUint(taskIDStr, 10, 64)
+	if !found || err != nil {
+		c.bot.AnswerCallbackQuery(ctx, cb.ID, consts.ErrorStr+": invalid callback data")
+		return
+	}
+
+	r, found := c.reqQueue.GetGridResult(taskID)
+	if !found {
+		c.bot.AnswerCallbackQuery(ctx, cb.ID, consts.GridResultExpiredStr)
+		return
+	}
+
+	if tile == consts.GridZipCallbackDataSuffix {
+		c.bot.AnswerCallbackQuery(ctx, cb.ID, "")
+		zipData, err := r.Zip()
+		if err == nil && len(zipData) > consts.TelegramDocumentMaxSize {
+			err = fmt.Errorf("zip file is too big, use the tile buttons")
+		}
+		if err == nil {
+			err = c.bot.SendDocument(ctx, cb.Message, fmt.Sprintf("sd-images-%d.zip", taskID), zipData, "")
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "send zip error", "error", err)
+			c.bot.SendReplyToMessage(ctx, cb.Message, consts.ErrorStr+": "+err.Error())
+		}
+		return
+	}
+
+	idx, err := strconv.Atoi(tile)
+	if err != nil || idx < 1 || idx > len(r.Imgs) {
+		c.bot.AnswerCallbackQuery(ctx, cb.ID, consts.ErrorStr+": invalid tile number")
+		return
+	}
+	c.bot.AnswerCallbackQuery(ctx, cb.ID, "")
+
+	idx--
+	caption := fmt.Sprint("#", idx+1)
+	// Spoilers are sent as photos, as documents can't be hidden.
+	sendPhoto := r.Output.IsPhoto() || r.Spoiler
+	if sendPhoto {
+		_, err = c.bot.SendPhoto(ctx, cb.Message, r.Filenames[idx], r.Imgs[idx], caption, nil, r.Spoiler)
+	}
+	// Falling back to document if the photo was refused, for example because of its size.
+	if !sendPhoto || (err != nil && !r.Spoiler) {
+		err = c.bot.SendDocument(ctx, cb.Message, r.Filenames[idx], r.Imgs[idx], caption)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "send tile error", "error", err)
+		c.bot.SendReplyToMessage(ctx, cb.Message, consts.ErrorStr+": "+err.Error())
+	}
+}
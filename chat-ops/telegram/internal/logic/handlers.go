@@ -2,20 +2,30 @@ package logic
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"html"
 	"io"
-	"log"
+	"log/slog"
 	"math/rand"
-	"os/exec"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/chatsettings"
 	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/config"
 	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/consts"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/gallery"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/gpustatus"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/infotext"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/logging"
 	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/logic/userservice"
 	reqqueue "github.com/kanootoko/stable-diffusion-telegram-bot/internal/req_queue"
 	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/reqparams"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/safety"
 	sdapi "github.com/kanootoko/stable-diffusion-telegram-bot/internal/sd_api"
 	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/telegram"
 )
@@ -25,12 +35,16 @@ func NewCmdHandler(
 	reqQueue *reqqueue.ReqQueue,
 	generationDefaults config.GenerationDefaults,
 	userService userservice.UserService,
+	chatSettings *chatsettings.Store,
 ) *CmdHandler {
 	c := CmdHandler{
-		sdApi:    sdApi,
-		reqQueue: reqQueue,
-		defaults: generationDefaults,
-		us:       userService,
+		sdApi:        sdApi,
+		reqQueue:     reqQueue,
+		defaults:     generationDefaults,
+		us:           userService,
+		chatSettings: chatSettings,
+
+		pngInfoWaiting: make(map[pngInfoWaitingKey]time.Time),
 	}
 	return &c
 }
@@ -47,6 +61,24 @@ func (c *CmdHandler) AddHandlers(
 	bot.RegisterPrefixHandler("/smi", c.adaptHandler(c.smi))
 	bot.RegisterPrefixHandler("/help", c.adaptHandler(c.help))
 	bot.RegisterPrefixHandler("/kuka", c.adaptHandler(c.img2img))
+	bot.RegisterPrefixHandler("/pnginfo", c.adaptHandler(c.pngInfo))
+	bot.RegisterPrefixHandler("/format", c.adaptHandler(c.format))
+	bot.RegisterPrefixHandler("/grid", c.adaptHandler(c.grid))
+	bot.RegisterPrefixHandler("/safety", c.adaptHandler(c.safety))
+	bot.RegisterPrefixHandler("/blocklist", c.adaptHandler(c.blocklist))
+	bot.RegisterPrefixHandler("/negative", c.adaptHandler(c.forcedNegative))
+	bot.RegisterPrefixHandler("/audit", c.adaptHandler(c.audit))
+	bot.RegisterPrefixHandler("/stats", c.adaptHandler(c.stats))
+	bot.RegisterPrefixHandler("/maintenance", c.adaptHandler(c.maintenance))
+	bot.RegisterPrefixHandler("/broadcast", c.adaptHandler(c.broadcast))
+	bot.RegisterPrefixHandler("/pause", c.adaptHandler(c.pause))
+	bot.RegisterPrefixHandler("/resume", c.adaptHandler(c.resume))
+	bot.RegisterPrefixHandler("/drain", c.adaptHandler(c.drain))
+	bot.RegisterPrefixHandler("/history", c.adaptHandler(c.history))
+	bot.RegisterPrefixHandler("/again", c.adaptHandler(c.again))
+	bot.RegisterPrefixHandler("/gallery", c.adaptHandler(c.gallery))
+	bot.RegisterCallbackPrefixHandler(consts.GridCallbackDataPrefix, c.adaptCallbackHandler(c.gridCallback))
+	bot.RegisterCallbackPrefixHandler(consts.PNGInfoRenderCallbackData, c.adaptCallbackHandler(c.pngInfoRender))
 
 	bot.RegisterPrefixHandler("/models", c.adaptHandler(c.listModels))
 	bot.RegisterPrefixHandler("/samplers", c.adaptHandler(c.listSamplers))
@@ -56,8 +88,28 @@ func (c *CmdHandler) AddHandlers(
 	bot.RegisterPrefixHandler("/vaes", c.adaptHandler(c.listVAEs))
 }
 
+// GetDefaultHandler handles the messages not matching any command, and the inline mode updates.
 func (c *CmdHandler) GetDefaultHandler() bot.HandlerFunc {
-	return c.adaptHandler(c.defaultHandler)
+	msgHandler := c.adaptHandler(c.defaultHandler)
+	return func(ctx context.Context, b *bot.Bot, update *models.Update) {
+		switch {
+		case update.InlineQuery != nil:
+			c.inlineQuery(ctx, update.InlineQuery)
+		case update.ChosenInlineResult != nil:
+			c.chosenInlineResult(ctx, update.ChosenInlineResult)
+		default:
+			msgHandler(ctx, b, update)
+		}
+	}
+}
+
+// Returns the command of the message text without the bot name, or an empty string if it's not a command.
+func commandOf(text string) string {
+	if !strings.HasPrefix(text, "/") {
+		return ""
+	}
+	cmd, _, _ := strings.Cut(strings.Fields(text)[0], "@")
+	return cmd
 }
 
 func removeBotName(s string) string {
@@ -80,11 +132,17 @@ func (c *CmdHandler) adaptHandler(innerHandler func(context.Context, *models.Mes
 		if update.Message == nil {
 			return
 		}
-		fmt.Print("msg from ", update.Message.From.Username, "#", update.Message.From.ID, ": ", update.Message.Text, "\n")
-		if update.Message.Chat.ID < 0 {
-			fmt.Print("  msg from group #", update.Message.Chat.ID)
+		// The task ID of the requests queued by the handler, so the log records of a request can be correlated
+		// with the message.
+		ctx = logging.WithTaskID(ctx, reqqueue.NewTaskID())
+		slog.InfoContext(ctx, "message", "user", update.Message.From.Username, "user_id", update.Message.From.ID,
+			"chat_id", update.Message.Chat.ID, "topic_id", telegram.TopicOf(update.Message), "command", commandOf(update.Message.Text))
+		slog.DebugContext(ctx, "message text", "text", update.Message.Text)
+
+		if !c.isTopicAllowed(update.Message) {
+			slog.InfoContext(ctx, "topic not allowed, ignoring")
+			return
 		}
-		fmt.Println()
 
 		// Add this condition to check for exact command match
 		if update.Message.Text == "/kuka" {
@@ -95,12 +153,12 @@ func (c *CmdHandler) adaptHandler(innerHandler func(context.Context, *models.Mes
 		if update.Message.ReplyToMessage != nil &&
 			update.Message.Text != "" &&
 			update.Message.Text[0] != '/' {
-			fmt.Println("  skipping message as a reply to bot without a command")
+			slog.DebugContext(ctx, "skipping message as a reply to bot without a command")
 			return
 		}
 
 		if !c.us.IsUsageAllowed(update.Message.From.ID, update.Message.Chat.ID) {
-			fmt.Println("  user not allowed, ignoring")
+			slog.InfoContext(ctx, "user not allowed, ignoring")
 			if update.Message.Text != "" && update.Message.Text[0] == '/' || update.Message.From.ID == update.Message.Chat.ID {
 				c.bot.SendReplyToMessage(ctx, update.Message, consts.UsageNotAllowedStr)
 			}
@@ -111,6 +169,36 @@ func (c *CmdHandler) adaptHandler(innerHandler func(context.Context, *models.Mes
 	}
 }
 
+func (c *CmdHandler) adaptCallbackHandler(innerHandler func(context.Context, *models.CallbackQuery)) bot.HandlerFunc {
+	return func(ctx context.Context, _ *bot.Bot, update *models.Update) {
+		if update.CallbackQuery == nil || update.CallbackQuery.Message == nil {
+			return
+		}
+		ctx = logging.WithTaskID(ctx, reqqueue.NewTaskID())
+		slog.InfoContext(ctx, "callback", "user", update.CallbackQuery.Sender.Username, "user_id", update.CallbackQuery.Sender.ID,
+			"chat_id", update.CallbackQuery.Message.Chat.ID, "data", update.CallbackQuery.Data)
+
+		if !c.isTopicAllowed(update.CallbackQuery.Message) {
+			slog.InfoContext(ctx, "topic not allowed, ignoring")
+			return
+		}
+
+		if !c.us.IsUsageAllowed(update.CallbackQuery.Sender.ID, update.CallbackQuery.Message.Chat.ID) {
+			slog.InfoContext(ctx, "user not allowed, ignoring")
+			c.bot.AnswerCallbackQuery(ctx, update.CallbackQuery.ID, consts.UsageNotAllowedStr)
+			return
+		}
+
+		innerHandler(ctx, update.CallbackQuery)
+	}
+}
+
+// Groups without allowed topics set aren't restricted.
+func (c *CmdHandler) isTopicAllowed(msg *models.Message) bool {
+	topicIDs, restricted := c.AllowedTopics[msg.Chat.ID]
+	return !restricted || slices.Contains(topicIDs, telegram.TopicOf(msg))
+}
+
 type CmdHandler struct {
 	sdApi    *sdapi.SdAPIType
 	bot      *telegram.SDBot
@@ -118,11 +206,31 @@ type CmdHandler struct {
 	defaults config.GenerationDefaults
 	//defaultEnv config.DefaultsFromEnv
 	us userservice.UserService
+
+	chatSettings *chatsettings.Store
+
+	// Set if the gallery is enabled.
+	Gallery *gallery.Gallery
+
+	Inline      config.InlineParams
+	inlineCache inlineCache
+
+	// Forum topics the bot is restricted to in groups.
+	AllowedTopics map[int64][]int
+
+	// Set if the NSFW checks are enabled.
+	Safety *safety.Checker
+
+	GPUStatus gpustatus.Source
+
+	// The configured users and groups, broadcasts are sent to these and to the chats of the recorded requests.
+	KnownChatIDs []int64
+
+	pngInfoMutex   sync.Mutex
+	pngInfoWaiting map[pngInfoWaitingKey]time.Time
 }
 
 func (c *CmdHandler) img2img(ctx context.Context, msg *models.Message) {
-	log.Println("DEBUG: img2img command received")
-
 	reqParams := reqparams.ReqParamsKuka{
 		OriginalPromptText: c.defaults.KukaPrompt,
 		Prompt:             c.defaults.KukaPrompt,
@@ -136,6 +244,7 @@ func (c *CmdHandler) img2img(ctx context.Context, msg *models.Message) {
 		SamplerName:        c.defaults.Sampler,
 		ModelName:          c.defaults.KukaModel,
 		DenoisingStrength:  0.75,
+		Output:             c.outputOptions(msg.Chat.ID),
 	}
 
 	// Ensure no zero values
@@ -147,12 +256,13 @@ func (c *CmdHandler) img2img(ctx context.Context, msg *models.Message) {
 	}
 	// Removed check for DenoisingStrength as it does not exist in ReqParamsKuka
 
-	log.Printf("DEBUG: Kuka params: %+v", reqParams)
+	slog.DebugContext(ctx, "kuka params", "params", fmt.Sprintf("%+v", reqParams))
 
 	req := reqqueue.ReqQueueReq{
 		Type:    reqqueue.ReqTypeKuka,
 		Message: msg,
 		Params:  reqParams,
+		TaskID:  logging.TaskID(ctx),
 	}
 
 	// Remove this line:
@@ -161,18 +271,20 @@ func (c *CmdHandler) img2img(ctx context.Context, msg *models.Message) {
 	c.reqQueue.Add(req)
 }
 
-func (c *CmdHandler) txt2img(ctx context.Context, msg *models.Message) {
-	text := strings.TrimSpace(removeBotName(msg.Text))
-	reqParams := reqparams.ReqParamsRender{
+func (c *CmdHandler) defaultReqParamsRender(chatID int64, text string) reqparams.ReqParamsRender {
+	return reqparams.ReqParamsRender{
 		OriginalPromptText: text,
 		Seed:               rand.Uint32(),
 		Width:              c.defaults.Width,
 		Height:             c.defaults.Height,
 		Steps:              c.defaults.Steps,
 		NumOutputs:         c.defaults.Cnt,
+		BatchSize:          c.defaults.Batch,
 		CFGScale:           c.defaults.CFGScale,
 		SamplerName:        c.defaults.Sampler,
 		ModelName:          c.defaults.Model,
+		Output:             c.outputOptions(chatID),
+		Grid:               c.chatSettings.Get(chatID).Grid,
 		Upscale: reqparams.ReqParamsUpscale{
 			Upscaler: "LDSR",
 		},
@@ -182,84 +294,155 @@ func (c *CmdHandler) txt2img(ctx context.Context, msg *models.Message) {
 			SecondPassSteps:   15,
 		},
 	}
-	log.Printf("DEBUG: Parsed params: %+v", reqParams)
+}
+
+// RenderParamsFromText parses a render request, the prompt with the optional negative prompt on the next
+// line and the render params at the end.
+func (c *CmdHandler) RenderParamsFromText(ctx context.Context, chatID int64, text string) (reqparams.ReqParamsRender, error) {
+	reqParams := c.defaultReqParamsRender(chatID, text)
 	var paramsLine *string
 	lines := strings.Split(text, "\n")
 	if len(lines) > 1 {
 		reqParams.Prompt = lines[0]
 		reqParams.NegativePrompt = strings.Join(lines[1:], " ")
 		paramsLine = &reqParams.NegativePrompt
-		log.Printf("DEBUG: Negative prompt: %s", reqParams.NegativePrompt)
 	} else {
 		reqParams.Prompt = text
 		paramsLine = &reqParams.Prompt
-		log.Printf("DEBUG: Prompt: %s", reqParams.Prompt)
 	}
-	firstCmdCharAt, err := ReqParamsParse(ctx, c.sdApi, c.defaults, *paramsLine, &reqParams)
+	firstCmdCharAt, err := ReqParamsParse(ctx, c.sdApi, &c.defaults, *paramsLine, &reqParams)
 	if err != nil {
-		log.Printf("ERROR: Failed to parse render params: %v", err)
-		c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": can't parse render params: "+err.Error())
-		return
+		return reqParams, fmt.Errorf("can't parse render params: %w", err)
 	}
 	if firstCmdCharAt >= 0 { // Commands found? Removing them from the line.
 		if firstCmdCharAt == 0 {
-			log.Println("WARN: Empty request error")
-			c.bot.SendReplyToMessage(ctx, msg, consts.EmptyRequestErrorStr)
-			return
+			return reqParams, errors.New(consts.EmptyRequestErrorStr)
 		}
 		*paramsLine = (*paramsLine)[:firstCmdCharAt]
 		if len(lines) > 1 {
 			firstCmdCharAt += len(lines[0]) + 1
-			log.Printf("DEBUG: First command char at: %d", firstCmdCharAt)
 		}
 		reqParams.OriginalPromptText = fmt.Sprintf("%s\nParameters: %s", reqParams.OriginalPromptText[:firstCmdCharAt], reqParams.OriginalPromptText[firstCmdCharAt:])
-		log.Printf("DEBUG: Original prompt text: %s", reqParams.OriginalPromptText)
 	}
 
 	reqParams.Prompt = strings.TrimSpace(reqParams.Prompt)
 	reqParams.NegativePrompt = strings.TrimSpace(reqParams.NegativePrompt)
-	log.Printf("DEBUG: Final params: %+v", reqParams)
+	slog.DebugContext(ctx, "render params", "params", fmt.Sprintf("%+v", reqParams))
 	if reqParams.Prompt == "" {
-		log.Println("WARN: Missing prompt")
-		c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": missing prompt")
-		return
+		return reqParams, fmt.Errorf("missing prompt")
 	}
 
 	if reqParams.HR.Scale > 0 || reqParams.Upscale.Scale > 0 {
-		log.Println("DEBUG: Setting num outputs to 1")
 		reqParams.NumOutputs = 1
 	}
+	return reqParams, nil
+}
+
+func (c *CmdHandler) txt2img(ctx context.Context, msg *models.Message) {
+	text := strings.TrimSpace(removeBotName(msg.Text))
+	infotextText, params := SplitInfotextParams(text)
+	if it, found := infotext.Parse(infotextText); found && IsInfotextPrompt(it) {
+		c.txt2imgFromInfotext(ctx, msg, it, params)
+		return
+	}
+
+	reqParams, err := c.RenderParamsFromText(ctx, msg.Chat.ID, text)
+	if err != nil {
+		c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": "+err.Error())
+		return
+	}
 
 	req := reqqueue.ReqQueueReq{
 		Type:    reqqueue.ReqTypeRender,
 		Message: msg,
 		Params:  reqParams,
+		TaskID:  logging.TaskID(ctx),
 	}
-	log.Println("DEBUG: adding req: ", req)
 	c.reqQueue.Add(req)
 
 }
 
-func (c *CmdHandler) upscale(ctx context.Context, msg *models.Message) {
+// Returns the render params of the infotext with the params given after it applied on top. The defaults are
+// used for the params set by neither of them, the same way as in RenderParamsFromText. Infotext keys which
+// can't be honored are returned in unsupported.
+func (c *CmdHandler) renderParamsFromInfotext(ctx context.Context, chatID int64, it infotext.Infotext, params string) (reqParams reqparams.ReqParamsRender, unsupported []string, err error) {
+	reqParams = c.defaultReqParamsRender(chatID, it.Prompt)
+	if unsupported, err = ReqParamsFromInfotext(ctx, c.sdApi, it, &reqParams); err != nil {
+		return reqParams, nil, fmt.Errorf("can't parse render params: %w", err)
+	}
+	_, given, err := parseReqParams(ctx, c.sdApi, params, &reqParams)
+	if err != nil {
+		return reqParams, nil, fmt.Errorf("can't parse render params: %w", err)
+	}
+	_, sizeFound := it.Get("size")
+	_, stepsFound := it.Get("steps")
+	_, batchSizeFound := it.Get("batch size")
+	given.width = given.width || sizeFound
+	given.height = given.height || sizeFound
+	given.steps = given.steps || stepsFound
+	given.batchSize = given.batchSize || batchSizeFound
+	given.setDefaults(&c.defaults, &reqParams)
+
+	if reqParams.HR.Scale > 0 || reqParams.Upscale.Scale > 0 {
+		reqParams.NumOutputs = 1
+	}
+	return reqParams, unsupported, nil
+}
+
+func (c *CmdHandler) txt2imgFromInfotext(ctx context.Context, msg *models.Message, it infotext.Infotext, params string) {
+	reqParams, unsupported, err := c.renderParamsFromInfotext(ctx, msg.Chat.ID, it, params)
+	if err != nil {
+		c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": "+err.Error())
+		return
+	}
+
+	if len(unsupported) > 0 {
+		slog.InfoContext(ctx, "unsupported infotext params", "params", unsupported)
+		for i := range unsupported {
+			unsupported[i] = "- <code>" + html.EscapeString(unsupported[i]) + "</code>"
+		}
+		c.bot.SendReplyToMessage(ctx, msg, consts.InfotextUnsupportedParamsStr+"\n"+strings.Join(unsupported, "\n"))
+	}
+
+	c.reqQueue.Add(reqqueue.ReqQueueReq{
+		Type:    reqqueue.ReqTypeRender,
+		Message: msg,
+		Params:  reqParams,
+		TaskID:  logging.TaskID(ctx),
+	})
+}
+
+// UpscaleParamsFromText parses the params of an upscale request.
+func (c *CmdHandler) UpscaleParamsFromText(ctx context.Context, chatID int64, text string) (reqparams.ReqParamsUpscale, error) {
 	reqParams := reqparams.ReqParamsUpscale{
-		OriginalPromptText: msg.Text,
+		OriginalPromptText: text,
 		Scale:              2,
 		Upscaler:           "LDSR",
+		Output:             c.outputOptions(chatID),
 	}
 
-	firstCmdCharAt, err := ReqParamsParse(ctx, c.sdApi, c.defaults, msg.Text, &reqParams)
+	firstCmdCharAt, err := ReqParamsParse(ctx, c.sdApi, &c.defaults, text, &reqParams)
 	if err != nil {
-		c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": can't parse render params: "+err.Error())
-		return
+		return reqParams, fmt.Errorf("can't parse render params: %w", err)
 	}
 	if firstCmdCharAt >= 0 {
 		reqParams.OriginalPromptText = fmt.Sprintf("%s\nParameters: %s", reqParams.OriginalPromptText[:firstCmdCharAt], reqParams.OriginalPromptText[firstCmdCharAt:])
 	}
+	return reqParams, nil
+}
+
+func (c *CmdHandler) upscale(ctx context.Context, msg *models.Message) {
+	reqParams, err := c.UpscaleParamsFromText(ctx, msg.Chat.ID, msg.Text)
+	if err != nil {
+		c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": "+err.Error())
+		return
+	}
 
 	req := reqqueue.ReqQueueReq{
 		Type:    reqqueue.ReqTypeUpscale,
 		Message: msg,
 		Params:  reqParams,
+		TaskID:  logging.TaskID(ctx),
 	}
 	c.reqQueue.Add(req)
 }
@@ -273,7 +456,7 @@ func (c *CmdHandler) cancel(ctx context.Context, msg *models.Message) {
 func (c *CmdHandler) listModels(ctx context.Context, msg *models.Message) {
 	models, err := c.sdApi.GetModels(ctx)
 	if err != nil {
-		fmt.Println("  error getting models:", err)
+		slog.ErrorContext(ctx, "error getting models", "error", err)
 		c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": error getting models: "+err.Error())
 		return
 	}
@@ -297,7 +480,7 @@ func (c *CmdHandler) listModels(ctx context.Context, msg *models.Message) {
 func (c *CmdHandler) listSamplers(ctx context.Context, msg *models.Message) {
 	samplers, err := c.sdApi.GetSamplers(ctx)
 	if err != nil {
-		fmt.Println("  error getting samplers:", err)
+		slog.ErrorContext(ctx, "error getting samplers", "error", err)
 		c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": error getting samplers: "+err.Error())
 		return
 	}
@@ -321,7 +504,7 @@ func (c *CmdHandler) listSamplers(ctx context.Context, msg *models.Message) {
 func (c *CmdHandler) listEmbeddings(ctx context.Context, msg *models.Message) {
 	embs, err := c.sdApi.GetEmbeddings(ctx)
 	if err != nil {
-		fmt.Println("  error getting embeddings:", err)
+		slog.ErrorContext(ctx, "error getting embeddings", "error", err)
 		c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": error getting embeddings: "+err.Error())
 		return
 	}
@@ -341,7 +524,7 @@ func (c *CmdHandler) listEmbeddings(ctx context.Context, msg *models.Message) {
 func (c *CmdHandler) listLoRAs(ctx context.Context, msg *models.Message) {
 	loras, err := c.sdApi.GetLoRAs(ctx)
 	if err != nil {
-		fmt.Println("  error getting loras:", err)
+		slog.ErrorContext(ctx, "error getting loras", "error", err)
 		c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": error getting loras: "+err.Error())
 		return
 	}
@@ -361,7 +544,7 @@ func (c *CmdHandler) listLoRAs(ctx context.Context, msg *models.Message) {
 func (c *CmdHandler) listUpscalers(ctx context.Context, msg *models.Message) {
 	ups, err := c.sdApi.GetUpscalers(ctx)
 	if err != nil {
-		fmt.Println("  error getting upscalers:", err)
+		slog.ErrorContext(ctx, "error getting upscalers", "error", err)
 		c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": error getting upscalers: "+err.Error())
 		return
 	}
@@ -381,7 +564,7 @@ func (c *CmdHandler) listUpscalers(ctx context.Context, msg *models.Message) {
 func (c *CmdHandler) listVAEs(ctx context.Context, msg *models.Message) {
 	vaes, err := c.sdApi.GetVAEs(ctx)
 	if err != nil {
-		fmt.Println("  error getting vaes:", err)
+		slog.ErrorContext(ctx, "error getting vaes", "error", err)
 		c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": error getting vaes: "+err.Error())
 		return
 	}
@@ -399,14 +582,16 @@ func (c *CmdHandler) listVAEs(ctx context.Context, msg *models.Message) {
 }
 
 func (c *CmdHandler) smi(ctx context.Context, msg *models.Message) {
-	cmd := exec.Command("nvidia-smi")
-	out, err := cmd.CombinedOutput()
+	statusCtx, cancel := context.WithTimeout(ctx, consts.GPUStatusTimeout)
+	defer cancel()
+
+	gpus, err := c.GPUStatus.GPUs(statusCtx)
 	if err != nil {
-		fmt.Println("  error running nvidia-smi:", err)
-		c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": error running nvidia-smi: "+err.Error())
+		slog.ErrorContext(ctx, "error getting gpu status", "error", err)
+		c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": error getting gpu status: "+html.EscapeString(err.Error()))
 		return
 	}
-	c.bot.SendReplyToMessage(ctx, msg, "<pre>"+string(out)+"</pre>")
+	c.bot.SendReplyToMessage(ctx, msg, gpustatus.Format(c.GPUStatus, gpus))
 }
 
 func (c *CmdHandler) Start(ctx context.Context, msg *models.Message) {
@@ -425,9 +610,18 @@ func (c *CmdHandler) help(ctx context.Context, msg *models.Message) {
 
 func (c *CmdHandler) defaultHandler(ctx context.Context, msg *models.Message) {
 	if msg.Document != nil {
+		if strings.HasPrefix(msg.Caption, "/pnginfo") || c.takePNGInfoWaiting(msg) {
+			c.handlePNGInfo(ctx, msg)
+			return
+		}
 		c.handleImage(ctx, msg, msg.Document.FileID, msg.Document.FileName)
 		return
 	} else if msg.Photo != nil && len(msg.Photo) > 0 {
+		if strings.HasPrefix(msg.Caption, "/pnginfo") || c.isPNGInfoWaiting(msg) {
+			// Photos are recompressed by Telegram, so the metadata is lost.
+			c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": "+consts.PNGInfoImageReqStr)
+			return
+		}
 		c.handleImage(ctx, msg, msg.Photo[len(msg.Photo)-1].FileID, "image.jpg")
 		return
 	}
@@ -0,0 +1,119 @@
+package logic
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-telegram/bot/models"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/consts"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/history"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/logging"
+	reqqueue "github.com/kanootoko/stable-diffusion-telegram-bot/internal/req_queue"
+)
+
+const historyMaxPromptLen = 60
+
+func historyEntryString(e history.Entry) string {
+	prompt := strings.ReplaceAll(e.Prompt, "\n", " ")
+	if len([]rune(prompt)) > historyMaxPromptLen {
+		prompt = string([]rune(prompt)[:historyMaxPromptLen]) + "..."
+	}
+
+	res := fmt.Sprintf("<code>#%d</code> %s", e.ID, e.Time.Format("01-02 15:04"))
+	if e.ChatID < 0 {
+		res += " @" + html.EscapeString(e.Username)
+	}
+	res += " " + e.Type
+	if e.Seed != 0 {
+		res += fmt.Sprintf(" 🌱%d", e.Seed)
+	}
+	if e.Model != "" {
+		res += " 🧩" + html.EscapeString(e.Model)
+	}
+	res += " ⏱" + fmt.Sprint(e.Duration.Round(time.Second))
+	if prompt != "" {
+		res += "\n    " + html.EscapeString(prompt)
+	}
+	return res
+}
+
+func (c *CmdHandler) history(ctx context.Context, msg *models.Message) {
+	n := consts.HistoryDefaultListCount
+	if arg := strings.TrimSpace(removeBotName(msg.Text)); arg != "" {
+		var err error
+		if n, err = strconv.Atoi(arg); err != nil || n < 1 {
+			c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": invalid count")
+			return
+		}
+		n = min(n, consts.HistoryMaxListCount)
+	}
+
+	entries := c.reqQueue.History.List(msg.Chat.ID, n, nil)
+	if len(entries) == 0 {
+		c.bot.SendReplyToMessage(ctx, msg, consts.HistoryEmptyStr)
+		return
+	}
+	lines := make([]string, len(entries))
+	for i := range entries {
+		lines[i] = historyEntryString(entries[i])
+	}
+	c.bot.SendReplyToMessage(ctx, msg, strings.Join(lines, "\n"))
+}
+
+// Repeats a render from the history of the chat. Params given after the ID override the stored ones, the
+// seed is kept unless it's overridden.
+func (c *CmdHandler) again(ctx context.Context, msg *models.Message) {
+	args := strings.TrimSpace(removeBotName(msg.Text))
+
+	var entry history.Entry
+	var found bool
+	idStr, rest, _ := strings.Cut(args, " ")
+	if id, err := strconv.ParseUint(strings.TrimPrefix(idStr, "#"), 10, 64); err == nil {
+		args = strings.TrimSpace(rest)
+		entry, found = c.reqQueue.History.Get(id)
+		if found && entry.ChatID != msg.Chat.ID && !c.us.IsAdmin(msg.From.ID) {
+			found = false
+		}
+	} else if idStr == "" || strings.HasPrefix(idStr, "-") {
+		entries := c.reqQueue.History.List(msg.Chat.ID, 1, func(e history.Entry) bool {
+			return e.UserID == msg.From.ID && e.RenderParams != nil
+		})
+		if len(entries) > 0 {
+			entry, found = entries[0], true
+		}
+	} else {
+		c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": "+consts.AgainUsageStr)
+		return
+	}
+
+	if !found {
+		c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": "+consts.HistoryEntryNotFoundStr)
+		return
+	}
+	if entry.RenderParams == nil {
+		c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": "+consts.AgainNotRenderStr)
+		return
+	}
+
+	reqParams := *entry.RenderParams
+	if args != "" {
+		if _, err := ReqParamsParse(ctx, c.sdApi, nil, args, &reqParams); err != nil {
+			c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": can't parse render params: "+err.Error())
+			return
+		}
+		if reqParams.HR.Scale > 0 || reqParams.Upscale.Scale > 0 {
+			reqParams.NumOutputs = 1
+		}
+	}
+
+	c.reqQueue.Add(reqqueue.ReqQueueReq{
+		Type:    reqqueue.ReqTypeRender,
+		Message: msg,
+		Params:  reqParams,
+		TaskID:  logging.TaskID(ctx),
+	})
+}
@@ -0,0 +1,272 @@
+package logic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/go-telegram/bot/models"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/consts"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/imgenc"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/logging"
+	reqqueue "github.com/kanootoko/stable-diffusion-telegram-bot/internal/req_queue"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/reqparams"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/telegram"
+)
+
+// ID of the placeholder result, the render is started when it's chosen.
+const inlineRenderResultID = "render"
+
+type inlineCacheEntry struct {
+	key     string
+	fileIDs []string
+	caption string
+}
+
+// Results of the inline renders, so they can be sent again by typing the same query.
+type inlineCache struct {
+	mutex   sync.Mutex
+	entries []inlineCacheEntry
+}
+
+func inlineCacheKey(userID int64, query string) string {
+	return fmt.Sprint(userID, ":", strings.TrimSpace(query))
+}
+
+func (c *inlineCache) get(key string) (inlineCacheEntry, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for i := len(c.entries) - 1; i >= 0; i-- {
+		if c.entries[i].key == key {
+			return c.entries[i], true
+		}
+	}
+	return inlineCacheEntry{}, false
+}
+
+func (c *inlineCache) put(entry inlineCacheEntry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.entries = append(c.entries, entry)
+	if len(c.entries) > consts.InlineCacheKeepCount {
+		c.entries = c.entries[len(c.entries)-consts.InlineCacheKeepCount:]
+	}
+}
+
+// Inline messages only get an ID if they have a keyboard, so the placeholder has a button for rendering
+// the query again.
+func inlineMarkup(query string) models.ReplyMarkup {
+	return &models.InlineKeyboardMarkup{
+		InlineKeyboard: [][]models.InlineKeyboardButton{{
+			{Text: consts.InlineRenderAgainButtonStr, SwitchInlineQueryCurrentChat: query},
+		}},
+	}
+}
+
+// The inline preset overrides the params of the query, so the inline renders stay fast.
+func (c *CmdHandler) inlineRenderParams(ctx context.Context, userID int64, query string) (reqparams.ReqParamsRender, error) {
+	reqParams, err := c.RenderParamsFromText(ctx, userID, strings.TrimSpace(query))
+	if err != nil {
+		return reqParams, err
+	}
+	if _, err = ReqParamsParse(ctx, c.sdApi, nil, c.Inline.Preset, &reqParams); err != nil {
+		return reqParams, fmt.Errorf("can't parse inline preset: %w", err)
+	}
+	reqParams.Grid = false
+	// Inline results can only be photos.
+	if !reqParams.Output.IsPhoto() {
+		reqParams.Output = imgenc.Options{Format: imgenc.FormatJPEG, Quality: consts.InlineJPEGQuality}
+	}
+	return reqParams, nil
+}
+
+func (c *CmdHandler) inlineQuery(ctx context.Context, query *models.InlineQuery) {
+	slog.DebugContext(ctx, "inline query", "user", query.From.Username, "user_id", query.From.ID, "query", query.Query)
+
+	if !c.us.IsUsageAllowed(query.From.ID, query.From.ID) {
+		slog.DebugContext(ctx, "user not allowed, ignoring")
+		c.bot.AnswerInlineQuery(ctx, query.ID, []models.InlineQueryResult{}, &models.InlineQueryResultsButton{
+			Text:           consts.InlineNotAllowedStr,
+			StartParameter: "inline",
+		}, consts.InlineQueryCacheTime)
+		return
+	}
+	if strings.TrimSpace(query.Query) == "" {
+		c.bot.AnswerInlineQuery(ctx, query.ID, []models.InlineQueryResult{}, nil, consts.InlineQueryCacheTime)
+		return
+	}
+
+	reqParams, err := c.inlineRenderParams(ctx, query.From.ID, query.Query)
+	if err != nil {
+		c.bot.AnswerInlineQuery(ctx, query.ID, []models.InlineQueryResult{}, &models.InlineQueryResultsButton{
+			Text:           consts.ErrorStr + ": " + err.Error(),
+			StartParameter: "inline",
+		}, consts.InlineQueryCacheTime)
+		return
+	}
+
+	var results []models.InlineQueryResult
+	if entry, found := c.inlineCache.get(inlineCacheKey(query.From.ID, query.Query)); found {
+		for i, fileID := range entry.fileIDs {
+			results = append(results, &models.InlineQueryResultCachedPhoto{
+				ID:          fmt.Sprint("cached-", i),
+				PhotoFileID: fileID,
+				Caption:     entry.caption,
+				ParseMode:   models.ParseModeHTML,
+				ReplyMarkup: inlineMarkup(query.Query),
+			})
+		}
+	}
+	prompt := html.EscapeString(reqParams.OriginalPrompt())
+	results = append(results, &models.InlineQueryResultArticle{
+		ID:          inlineRenderResultID,
+		Title:       consts.InlineRenderTitleStr,
+		Description: reqParams.OriginalPrompt(),
+		InputMessageContent: &models.InputTextMessageContent{
+			MessageText: consts.InlineRenderingStr + "\n" + prompt,
+			ParseMode:   models.ParseModeHTML,
+		},
+		ReplyMarkup: inlineMarkup(query.Query),
+	})
+	c.bot.AnswerInlineQuery(ctx, query.ID, results, nil, consts.InlineQueryCacheTime)
+}
+
+// The render is started when the placeholder is chosen, the bot only gets these updates if inline feedback
+// is enabled with BotFather.
+func (c *CmdHandler) chosenInlineResult(ctx context.Context, result *models.ChosenInlineResult) {
+	if result.ResultID != inlineRenderResultID || result.InlineMessageID == "" {
+		return
+	}
+	ctx = logging.WithTaskID(ctx, reqqueue.NewTaskID())
+	slog.InfoContext(ctx, "inline render", "user", result.From.Username, "user_id", result.From.ID)
+	slog.DebugContext(ctx, "inline render query", "query", result.Query)
+
+	if !c.us.IsUsageAllowed(result.From.ID, result.From.ID) {
+		slog.InfoContext(ctx, "user not allowed, ignoring")
+		return
+	}
+
+	d := &inlineDelivery{
+		bot:             c.bot,
+		cache:           &c.inlineCache,
+		cacheKey:        inlineCacheKey(result.From.ID, result.Query),
+		inlineMessageID: result.InlineMessageID,
+		uploadChatID:    c.Inline.CacheChatID,
+		markup:          inlineMarkup(result.Query),
+	}
+	if d.uploadChatID == 0 {
+		d.uploadChatID = result.From.ID
+		d.deleteUploads = true
+	}
+
+	reqParams, err := c.inlineRenderParams(ctx, result.From.ID, result.Query)
+	if err != nil {
+		d.Finished(ctx, err)
+		return
+	}
+	c.reqQueue.Add(reqqueue.ReqQueueReq{
+		Type:     reqqueue.ReqTypeRender,
+		Params:   reqParams,
+		Delivery: d,
+		UserID:   result.From.ID,
+		Username: result.From.Username,
+		TaskID:   logging.TaskID(ctx),
+	})
+}
+
+// inlineDelivery shows the status in the chosen inline message, and replaces it with the result. Inline
+// messages can't be edited with new uploads, so the images are uploaded to a chat first.
+type inlineDelivery struct {
+	bot             *telegram.SDBot
+	cache           *inlineCache
+	cacheKey        string
+	inlineMessageID string
+	uploadChatID    int64
+	// Set if the images are uploaded to the user's private chat, the uploads are deleted once their file IDs
+	// are known, which stay valid.
+	deleteUploads bool
+	markup        models.ReplyMarkup
+
+	// The queue calls the delivery without holding its own mutex, so updates can come concurrently.
+	mutex    sync.Mutex
+	lastText string
+}
+
+func (d *inlineDelivery) Status(ctx context.Context, s reqqueue.Status) {
+	d.editText(ctx, s.Text)
+}
+
+func (d *inlineDelivery) Previews() bool {
+	return false
+}
+
+// Inline renders don't need input images.
+func (d *inlineDelivery) AskForImage(ctx context.Context) {}
+
+func (d *inlineDelivery) Deliver(ctx context.Context, r reqqueue.Result) ([]string, error) {
+	var fileIDs []string
+	for i, img := range r.Imgs[:min(len(r.Imgs), consts.InlineMaxResults)] {
+		msg, err := d.bot.SendPhotoToChat(ctx, d.uploadChatID, r.Filenames[i], img, r.Spoiler)
+		if err != nil && d.deleteUploads {
+			// The bot can't message users who haven't started it.
+			return fileIDs, fmt.Errorf("%s: %w", consts.InlineStartBotStr, err)
+		} else if err != nil {
+			return fileIDs, fmt.Errorf("upload error: %w", err)
+		}
+		if fileID := telegram.FileIDOf(msg); fileID != "" {
+			fileIDs = append(fileIDs, fileID)
+		}
+		if d.deleteUploads {
+			if err = d.bot.DeleteMessage(ctx, msg); err != nil {
+				slog.WarnContext(ctx, "can't delete inline upload", "error", err)
+			}
+		}
+	}
+	if len(fileIDs) == 0 {
+		return nil, fmt.Errorf("nothing uploaded")
+	}
+
+	var caption string
+	if len(r.Description) <= consts.TelegramCaptionMaxLength {
+		caption = r.Description
+	}
+	// Cached photo results can't be sent as spoilers.
+	if !r.Spoiler {
+		d.cache.put(inlineCacheEntry{key: d.cacheKey, fileIDs: fileIDs, caption: caption})
+	}
+	if err := d.bot.EditInlineMessagePhoto(ctx, d.inlineMessageID, fileIDs[0], caption, d.markup, r.Spoiler); err != nil {
+		return fileIDs, fmt.Errorf("inline message edit error: %w", err)
+	}
+	return fileIDs, nil
+}
+
+func (d *inlineDelivery) Finished(ctx context.Context, err error) {
+	switch {
+	case err == nil:
+	case errors.Is(err, reqqueue.ErrCanceled):
+		d.editText(ctx, consts.CanceledStr)
+	case errors.Is(err, reqqueue.ErrRestarting):
+		d.editText(ctx, consts.RestartingStr)
+	default:
+		d.editText(ctx, consts.ErrorStr+": "+html.EscapeString(err.Error()))
+	}
+}
+
+func (d *inlineDelivery) editText(ctx context.Context, text string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if text == d.lastText {
+		return
+	}
+	d.lastText = text
+	if err := d.bot.EditInlineMessage(ctx, d.inlineMessageID, text, d.markup); err != nil {
+		slog.ErrorContext(ctx, "inline message edit error", "error", err)
+	}
+}
@@ -0,0 +1,103 @@
+package logic
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-telegram/bot/models"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/consts"
+)
+
+// Usage: /maintenance on [message], /maintenance off, without args the current state is shown.
+func (c *CmdHandler) maintenance(ctx context.Context, msg *models.Message) {
+	if !c.us.IsAdmin(msg.From.ID) {
+		return
+	}
+
+	action, message, _ := strings.Cut(strings.TrimSpace(removeBotName(msg.Text)), " ")
+	switch action {
+	case "":
+		text := consts.MaintenanceIsOffStr
+		if on, message := c.reqQueue.Maintenance(); on {
+			text = consts.MaintenanceStr + html.EscapeString(message)
+		}
+		c.bot.SendReplyToMessage(ctx, msg, text+"\n"+consts.MaintenanceUsageStr)
+	case "on":
+		c.reqQueue.SetMaintenance(ctx, true, strings.TrimSpace(message))
+		c.bot.SendReplyToMessage(ctx, msg, consts.MaintenanceOnStr)
+	case "off":
+		c.reqQueue.SetMaintenance(ctx, false, "")
+		c.bot.SendReplyToMessage(ctx, msg, consts.MaintenanceOffStr)
+	default:
+		c.bot.SendReplyToMessage(ctx, msg, consts.MaintenanceUsageStr)
+	}
+}
+
+// Returns the configured chats and the chats of the recorded requests.
+func (c *CmdHandler) knownChatIDs() []int64 {
+	chatIDs := slices.Clone(c.KnownChatIDs)
+	if c.reqQueue.Stats != nil {
+		for _, r := range c.reqQueue.Stats.Since(time.Time{}) {
+			chatIDs = append(chatIDs, r.ChatID)
+		}
+	}
+	slices.Sort(chatIDs)
+	return slices.Compact(chatIDs)
+}
+
+// The message is sent to the known chats in the background, the admin gets the result when it's done.
+func (c *CmdHandler) broadcast(ctx context.Context, msg *models.Message) {
+	if !c.us.IsAdmin(msg.From.ID) {
+		return
+	}
+	text := strings.TrimSpace(removeBotName(msg.Text))
+	if text == "" {
+		c.bot.SendReplyToMessage(ctx, msg, consts.BroadcastUsageStr)
+		return
+	}
+
+	chatIDs := c.knownChatIDs()
+	go func() {
+		var failed int
+		for _, chatID := range chatIDs {
+			if err := c.bot.SendText(ctx, chatID, text); err != nil {
+				slog.WarnContext(ctx, "broadcast error", "chat_id", chatID, "error", err)
+				failed++
+			}
+			// Staying under the flood limits of Telegram.
+			time.Sleep(consts.BroadcastInterval)
+		}
+		slog.InfoContext(ctx, "broadcast sent", "chats", len(chatIDs), "failed", failed)
+		c.bot.SendReplyToMessage(ctx, msg, fmt.Sprintf(consts.BroadcastSentStr, len(chatIDs)-failed, failed))
+	}()
+}
+
+func (c *CmdHandler) pause(ctx context.Context, msg *models.Message) {
+	if !c.us.IsAdmin(msg.From.ID) {
+		return
+	}
+	c.reqQueue.Pause(ctx)
+	c.bot.SendReplyToMessage(ctx, msg, consts.QueuePauseStr)
+}
+
+func (c *CmdHandler) resume(ctx context.Context, msg *models.Message) {
+	if !c.us.IsAdmin(msg.From.ID) {
+		return
+	}
+	c.reqQueue.Resume(ctx)
+	c.bot.SendReplyToMessage(ctx, msg, consts.QueueResumeStr)
+}
+
+// The bot stops when the queue is drained, like on SIGTERM.
+func (c *CmdHandler) drain(ctx context.Context, msg *models.Message) {
+	if !c.us.IsAdmin(msg.From.ID) {
+		return
+	}
+	c.bot.SendReplyToMessage(ctx, msg, consts.QueueDrainStr)
+	go c.reqQueue.Drain(ctx)
+}
@@ -0,0 +1,143 @@
+package logic
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/go-telegram/bot/models"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/chatsettings"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/consts"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/moderation"
+)
+
+func (c *CmdHandler) updateModerationRules(ctx context.Context, msg *models.Message, fn func(settings *chatsettings.Settings)) bool {
+	if !c.us.IsAdmin(msg.From.ID) {
+		c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": "+consts.ModerationAdminOnlyStr)
+		return false
+	}
+	if err := c.chatSettings.Update(msg.Chat.ID, fn); err != nil {
+		slog.ErrorContext(ctx, "chat settings save error", "error", err)
+		c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": can't save chat settings: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func (c *CmdHandler) sendBlocklist(ctx context.Context, msg *models.Message, usage bool) {
+	blocklist := c.chatSettings.Get(msg.Chat.ID).Blocklist
+	text := consts.BlocklistEmptyStr
+	if len(blocklist) > 0 {
+		lines := []string{consts.BlocklistStr}
+		for _, rule := range blocklist {
+			lines = append(lines, "- <code>"+html.EscapeString(rule)+"</code>")
+		}
+		text = strings.Join(lines, "\n")
+	}
+	if usage {
+		text += "\n" + consts.BlocklistUsageStr
+	}
+	c.bot.SendReplyToMessage(ctx, msg, text)
+}
+
+// Handles "/blocklist [add|remove] <rule>" and "/blocklist reset", the rules are words or /regexes/.
+func (c *CmdHandler) blocklist(ctx context.Context, msg *models.Message) {
+	args := strings.TrimSpace(removeBotName(msg.Text))
+	if args == "" {
+		c.sendBlocklist(ctx, msg, true)
+		return
+	}
+	action, rule, _ := strings.Cut(args, " ")
+	rule = strings.TrimSpace(rule)
+
+	var update func(settings *chatsettings.Settings)
+	switch strings.ToLower(action) {
+	case "add":
+		if _, err := moderation.ParseRule(rule); err != nil {
+			c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": "+html.EscapeString(err.Error()))
+			return
+		}
+		update = func(settings *chatsettings.Settings) {
+			if !slices.Contains(settings.Blocklist, rule) {
+				settings.Blocklist = append(settings.Blocklist, rule)
+			}
+		}
+	case "remove":
+		update = func(settings *chatsettings.Settings) {
+			settings.Blocklist = slices.DeleteFunc(settings.Blocklist, func(r string) bool { return r == rule })
+		}
+	case "reset":
+		update = func(settings *chatsettings.Settings) {
+			settings.Blocklist = nil
+		}
+	default:
+		c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": "+consts.BlocklistUsageStr)
+		return
+	}
+	if c.updateModerationRules(ctx, msg, update) {
+		c.sendBlocklist(ctx, msg, false)
+	}
+}
+
+// Handles "/negative [prompt|reset]", the prompt is added to the negative prompt of all requests in the chat.
+func (c *CmdHandler) forcedNegative(ctx context.Context, msg *models.Message) {
+	arg := strings.TrimSpace(removeBotName(msg.Text))
+	if arg == "" {
+		if forced := c.chatSettings.Get(msg.Chat.ID).ForcedNegativePrompt; forced != "" {
+			c.bot.SendReplyToMessage(ctx, msg, consts.ForcedNegativeStr+html.EscapeString(forced)+"\n"+consts.ForcedNegativeUsageStr)
+		} else {
+			c.bot.SendReplyToMessage(ctx, msg, consts.ForcedNegativeEmptyStr+"\n"+consts.ForcedNegativeUsageStr)
+		}
+		return
+	}
+	if strings.EqualFold(arg, "reset") {
+		arg = ""
+	}
+	ok := c.updateModerationRules(ctx, msg, func(settings *chatsettings.Settings) {
+		settings.ForcedNegativePrompt = arg
+	})
+	if !ok {
+		return
+	}
+	if arg == "" {
+		c.bot.SendReplyToMessage(ctx, msg, consts.ForcedNegativeEmptyStr)
+	} else {
+		c.bot.SendReplyToMessage(ctx, msg, consts.ForcedNegativeStr+html.EscapeString(arg))
+	}
+}
+
+// Lists the last rejected prompts of all chats, for admins only.
+func (c *CmdHandler) audit(ctx context.Context, msg *models.Message) {
+	if !c.us.IsAdmin(msg.From.ID) || c.reqQueue.Moderation == nil || c.reqQueue.Moderation.Audit == nil {
+		return
+	}
+	n := consts.ModerationAuditDefaultListCount
+	if arg := strings.TrimSpace(removeBotName(msg.Text)); arg != "" {
+		var err error
+		if n, err = strconv.Atoi(arg); err != nil || n < 1 {
+			c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": invalid count")
+			return
+		}
+		n = min(n, consts.ModerationAuditMaxListCount)
+	}
+
+	entries := c.reqQueue.Moderation.Audit.List(n)
+	if len(entries) == 0 {
+		c.bot.SendReplyToMessage(ctx, msg, consts.ModerationAuditEmptyStr)
+		return
+	}
+	lines := make([]string, len(entries))
+	for i, e := range entries {
+		prompt := strings.ReplaceAll(e.Prompt, "\n", " ")
+		if len([]rune(prompt)) > historyMaxPromptLen {
+			prompt = string([]rune(prompt)[:historyMaxPromptLen]) + "..."
+		}
+		lines[i] = fmt.Sprintf("%s @%s #%d in <code>%d</code>: %s\n    %s", e.Time.Format("01-02 15:04"),
+			html.EscapeString(e.Username), e.UserID, e.ChatID, html.EscapeString(e.Reason), html.EscapeString(prompt))
+	}
+	c.bot.SendReplyToMessage(ctx, msg, strings.Join(lines, "\n"))
+}
@@ -3,37 +3,86 @@ package logic
 import (
 	"context"
 	"fmt"
+	"regexp"
 	"strconv"
 	"strings"
 
 	"github.com/google/shlex"
 	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/config"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/imgenc"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/infotext"
 	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/reqparams"
 	sdapi "github.com/kanootoko/stable-diffusion-telegram-bot/internal/sd_api"
 	"golang.org/x/exp/slices"
 )
 
-// Returns -1 as firstCmdCharAt if no params have been found in the given string.
-func ReqParamsParse(ctx context.Context, sdApi *sdapi.SdAPIType, defaults config.GenerationDefaults, s string, reqParams reqparams.ReqParams) (firstCmdCharAt int, err error) {
+// Returns -1 as firstCmdCharAt if no params have been found in the given string. If defaults is nil then the
+// params not set in the string keep their current values.
+func ReqParamsParse(ctx context.Context, sdApi *sdapi.SdAPIType, defaults *config.GenerationDefaults, s string, reqParams reqparams.ReqParams) (firstCmdCharAt int, err error) {
+	firstCmdCharAt, given, err := parseReqParams(ctx, sdApi, s, reqParams)
+	if err != nil {
+		return 0, err
+	}
+	if reqParamsRender, ok := reqParams.(*reqparams.ReqParamsRender); ok && defaults != nil {
+		given.setDefaults(defaults, reqParamsRender)
+	}
+	return firstCmdCharAt, nil
+}
+
+// The render params which were given explicitly, the others get the defaults.
+type givenRenderParams struct {
+	width, height, steps, numOutputs, batchSize bool
+}
+
+// Sets the defaults of the params which were not given, the size and the steps depend on whether the model is
+// an SDXL one.
+func (g givenRenderParams) setDefaults(defaults *config.GenerationDefaults, reqParams *reqparams.ReqParamsRender) {
+	if !g.numOutputs {
+		reqParams.NumOutputs = defaults.Cnt
+	}
+	if !g.batchSize {
+		reqParams.BatchSize = defaults.Batch
+	}
+	if strings.Contains(strings.ToLower(reqParams.ModelName), "xl") {
+		if !g.width {
+			reqParams.Width = defaults.WidthSDXL
+		}
+		if !g.height {
+			reqParams.Height = defaults.HeightSDXL
+		}
+		if !g.steps {
+			reqParams.Steps = defaults.Steps
+		}
+	} else {
+		if !g.width {
+			reqParams.Width = defaults.Width
+		}
+		if !g.height {
+			reqParams.Height = defaults.Height
+		}
+		if !g.steps {
+			reqParams.Steps = defaults.StepsSDXL
+		}
+	}
+}
+
+func parseReqParams(ctx context.Context, sdApi *sdapi.SdAPIType, s string, reqParams reqparams.ReqParams) (firstCmdCharAt int, given givenRenderParams, err error) {
 	lexer := shlex.NewLexer(strings.NewReader(s))
 
 	var reqParamsRender *reqparams.ReqParamsRender
 	var reqParamsUpscale *reqparams.ReqParamsUpscale
+	var output *imgenc.Options
 	switch v := reqParams.(type) {
 	case *reqparams.ReqParamsRender:
 		reqParamsRender = v
+		output = &v.Output
 	case *reqparams.ReqParamsUpscale:
 		reqParamsUpscale = v
+		output = &v.Output
 	default:
-		return 0, fmt.Errorf("invalid reqParams type")
+		return 0, given, fmt.Errorf("invalid reqParams type")
 	}
 
-	gotWidth := false
-	gotHeight := false
-	gotSteps := false
-	gotNumOutputs := false
-	gotBatchSize := false
-
 	firstCmdCharAt = -1
 	for {
 		token, lexErr := lexer.Next()
@@ -43,7 +92,7 @@ func ReqParamsParse(ctx context.Context, sdApi *sdapi.SdAPIType, defaults config
 
 		if token[0] != '-' {
 			if firstCmdCharAt > -1 {
-				return 0, fmt.Errorf("params need to be after the prompt")
+				return 0, given, fmt.Errorf("params need to be after the prompt")
 			}
 			continue // Ignore tokens not starting with -
 		}
@@ -58,12 +107,12 @@ func ReqParamsParse(ctx context.Context, sdApi *sdapi.SdAPIType, defaults config
 			}
 			val, lexErr := lexer.Next()
 			if lexErr != nil {
-				return 0, fmt.Errorf(attr + " is missing value")
+				return 0, given, fmt.Errorf(attr + " is missing value")
 			}
 			val = strings.TrimPrefix(val, "🌱")
 			valInt, err := strconv.ParseUint(val, 10, 32)
 			if err != nil {
-				return 0, fmt.Errorf("invalid seed")
+				return 0, given, fmt.Errorf("invalid seed")
 			}
 			reqParamsRender.Seed = uint32(valInt)
 			validAttr = true
@@ -73,81 +122,111 @@ func ReqParamsParse(ctx context.Context, sdApi *sdapi.SdAPIType, defaults config
 			}
 			val, lexErr := lexer.Next()
 			if lexErr != nil {
-				return 0, fmt.Errorf(attr + " is missing value")
+				return 0, given, fmt.Errorf(attr + " is missing value")
 			}
 			valInt, err := strconv.Atoi(val)
 			if err != nil {
-				return 0, fmt.Errorf("invalid width")
+				return 0, given, fmt.Errorf("invalid width")
 			}
 			reqParamsRender.Width = valInt
 			validAttr = true
-			gotWidth = true
+			given.width = true
 		case "height", "h":
 			if reqParamsRender == nil {
 				break
 			}
 			val, lexErr := lexer.Next()
 			if lexErr != nil {
-				return 0, fmt.Errorf(attr + " is missing value")
+				return 0, given, fmt.Errorf(attr + " is missing value")
 			}
 			valInt, err := strconv.Atoi(val)
 			if err != nil {
-				return 0, fmt.Errorf("invalid height")
+				return 0, given, fmt.Errorf("invalid height")
 			}
 			reqParamsRender.Height = valInt
 			validAttr = true
-			gotHeight = true
+			given.height = true
 		case "steps", "t":
 			if reqParamsRender == nil {
 				break
 			}
 			val, lexErr := lexer.Next()
 			if lexErr != nil {
-				return 0, fmt.Errorf(attr + " is missing value")
+				return 0, given, fmt.Errorf(attr + " is missing value")
 			}
 			valInt, err := strconv.Atoi(val)
 			if err != nil {
-				return 0, fmt.Errorf("invalid steps")
+				return 0, given, fmt.Errorf("invalid steps")
 			}
 			reqParamsRender.Steps = valInt
 			validAttr = true
-			gotSteps = true
+			given.steps = true
 		case "batch", "b":
 			if reqParamsRender == nil {
 				break
 			}
 			val, lexErr := lexer.Next()
 			if lexErr != nil {
-				return 0, fmt.Errorf(attr + " is missing value")
+				return 0, given, fmt.Errorf(attr + " is missing value")
 			}
 			valInt, err := strconv.Atoi(val)
 			if err != nil {
-				return 0, fmt.Errorf("invalid batch size")
+				return 0, given, fmt.Errorf("invalid batch size")
 			}
 			reqParamsRender.BatchSize = valInt
 			validAttr = true
-			gotBatchSize = true
+			given.batchSize = true
 		case "cnt", "o":
 			if reqParamsRender == nil {
 				break
 			}
 			val, lexErr := lexer.Next()
 			if lexErr != nil {
-				return 0, fmt.Errorf(attr + " is missing value")
+				return 0, given, fmt.Errorf(attr + " is missing value")
 			}
 			valInt, err := strconv.Atoi(val)
 			if err != nil {
-				return 0, fmt.Errorf("invalid output count")
+				return 0, given, fmt.Errorf("invalid output count")
 			}
 			reqParamsRender.NumOutputs = valInt
 			validAttr = true
-			gotNumOutputs = true
+			given.numOutputs = true
 		case "png", "p":
-			if reqParamsRender != nil {
-				reqParamsRender.OutputPNG = true
-			} else if reqParamsUpscale != nil {
-				reqParamsUpscale.OutputPNG = true
+			output.Format = imgenc.FormatPNG
+			validAttr = true
+		case "grid", "g":
+			if reqParamsRender == nil {
+				break
 			}
+			reqParamsRender.Grid = true
+			validAttr = true
+		case "nogrid":
+			if reqParamsRender == nil {
+				break
+			}
+			reqParamsRender.Grid = false
+			validAttr = true
+		case "format", "f":
+			val, lexErr := lexer.Next()
+			if lexErr != nil {
+				return 0, given, fmt.Errorf(attr + " is missing value")
+			}
+			format, err := imgenc.ParseFormat(val)
+			if err != nil {
+				return 0, given, err
+			}
+			output.Format = format
+			validAttr = true
+		case "quality", "q":
+			val, lexErr := lexer.Next()
+			if lexErr != nil {
+				return 0, given, fmt.Errorf(attr + " is missing value")
+			}
+			valInt, err := strconv.Atoi(val)
+			if err != nil || valInt < 1 || valInt > imgenc.MaxQuality {
+				return 0, given, fmt.Errorf("invalid quality, valid values are 1-%d", imgenc.MaxQuality)
+			}
+			output.Quality = valInt
 			validAttr = true
 		case "cfg", "c":
 			if reqParamsRender == nil {
@@ -155,11 +234,11 @@ func ReqParamsParse(ctx context.Context, sdApi *sdapi.SdAPIType, defaults config
 			}
 			val, lexErr := lexer.Next()
 			if lexErr != nil {
-				return 0, fmt.Errorf(attr + " is missing value")
+				return 0, given, fmt.Errorf(attr + " is missing value")
 			}
 			valFloat, err := strconv.ParseFloat(val, 64)
 			if err != nil {
-				return 0, fmt.Errorf("  invalid CFG scale")
+				return 0, given, fmt.Errorf("  invalid CFG scale")
 			}
 			reqParamsRender.CFGScale = valFloat
 			validAttr = true
@@ -169,14 +248,14 @@ func ReqParamsParse(ctx context.Context, sdApi *sdapi.SdAPIType, defaults config
 			}
 			val, lexErr := lexer.Next()
 			if lexErr != nil {
-				return 0, fmt.Errorf(attr + " is missing value")
+				return 0, given, fmt.Errorf(attr + " is missing value")
 			}
 			samplers, err := sdApi.GetSamplers(ctx)
 			if err != nil {
-				return 0, fmt.Errorf("error getting samplers: %w", err)
+				return 0, given, fmt.Errorf("error getting samplers: %w", err)
 			}
 			if !slices.Contains(samplers, val) {
-				return 0, fmt.Errorf("invalid sampler")
+				return 0, given, fmt.Errorf("invalid sampler")
 			}
 			reqParamsRender.SamplerName = val
 			validAttr = true
@@ -186,14 +265,14 @@ func ReqParamsParse(ctx context.Context, sdApi *sdapi.SdAPIType, defaults config
 			}
 			val, lexErr := lexer.Next()
 			if lexErr != nil {
-				return 0, fmt.Errorf(attr + " is missing value")
+				return 0, given, fmt.Errorf(attr + " is missing value")
 			}
 			models, err := sdApi.GetModels(ctx)
 			if err != nil {
-				return 0, fmt.Errorf("error getting models: %w", err)
+				return 0, given, fmt.Errorf("error getting models: %w", err)
 			}
 			if !slices.Contains(models, val) {
-				return 0, fmt.Errorf(" invalid model")
+				return 0, given, fmt.Errorf(" invalid model")
 			}
 			reqParamsRender.ModelName = val
 			validAttr = true
@@ -203,11 +282,11 @@ func ReqParamsParse(ctx context.Context, sdApi *sdapi.SdAPIType, defaults config
 			}
 			val, lexErr := lexer.Next()
 			if lexErr != nil {
-				return 0, fmt.Errorf(attr + " is missing value")
+				return 0, given, fmt.Errorf(attr + " is missing value")
 			}
 			valFloat, err := strconv.ParseFloat(val, 32)
 			if err != nil {
-				return 0, fmt.Errorf("invalid hr scale")
+				return 0, given, fmt.Errorf("invalid hr scale")
 			}
 			if reqParamsRender != nil {
 				reqParamsRender.Upscale.Scale = float32(valFloat)
@@ -221,14 +300,14 @@ func ReqParamsParse(ctx context.Context, sdApi *sdapi.SdAPIType, defaults config
 			}
 			val, lexErr := lexer.Next()
 			if lexErr != nil {
-				return 0, fmt.Errorf(attr + " is missing value")
+				return 0, given, fmt.Errorf(attr + " is missing value")
 			}
 			upscalers, err := sdApi.GetUpscalers(ctx)
 			if err != nil {
-				return 0, fmt.Errorf("error getting upscalers: %w", err)
+				return 0, given, fmt.Errorf("error getting upscalers: %w", err)
 			}
 			if !slices.Contains(upscalers, val) {
-				return 0, fmt.Errorf("invalid upscaler")
+				return 0, given, fmt.Errorf("invalid upscaler")
 			}
 			if reqParamsRender != nil {
 				reqParamsRender.Upscale.Upscaler = val
@@ -242,11 +321,11 @@ func ReqParamsParse(ctx context.Context, sdApi *sdapi.SdAPIType, defaults config
 			}
 			val, lexErr := lexer.Next()
 			if lexErr != nil {
-				return 0, fmt.Errorf(attr + " is missing value")
+				return 0, given, fmt.Errorf(attr + " is missing value")
 			}
 			valFloat, err := strconv.ParseFloat(val, 32)
 			if err != nil {
-				return 0, fmt.Errorf("invalid hr scale")
+				return 0, given, fmt.Errorf("invalid hr scale")
 			}
 			reqParamsRender.HR.Scale = float32(valFloat)
 			validAttr = true
@@ -256,11 +335,11 @@ func ReqParamsParse(ctx context.Context, sdApi *sdapi.SdAPIType, defaults config
 			}
 			val, lexErr := lexer.Next()
 			if lexErr != nil {
-				return 0, fmt.Errorf(attr + " is missing value")
+				return 0, given, fmt.Errorf(attr + " is missing value")
 			}
 			valFloat, err := strconv.ParseFloat(val, 32)
 			if err != nil {
-				return 0, fmt.Errorf("invalid hr denoise strength")
+				return 0, given, fmt.Errorf("invalid hr denoise strength")
 			}
 			reqParamsRender.HR.DenoisingStrength = float32(valFloat)
 			validAttr = true
@@ -270,14 +349,14 @@ func ReqParamsParse(ctx context.Context, sdApi *sdapi.SdAPIType, defaults config
 			}
 			val, lexErr := lexer.Next()
 			if lexErr != nil {
-				return 0, fmt.Errorf(attr + " is missing value")
+				return 0, given, fmt.Errorf(attr + " is missing value")
 			}
 			upscalers, err := sdApi.GetUpscalers(ctx)
 			if err != nil {
-				return 0, fmt.Errorf("error getting upscalers: %w", err)
+				return 0, given, fmt.Errorf("error getting upscalers: %w", err)
 			}
 			if !slices.Contains(upscalers, val) {
-				return 0, fmt.Errorf("invalid upscaler")
+				return 0, given, fmt.Errorf("invalid upscaler")
 			}
 			reqParamsRender.HR.Upscaler = val
 			validAttr = true
@@ -287,11 +366,11 @@ func ReqParamsParse(ctx context.Context, sdApi *sdapi.SdAPIType, defaults config
 			}
 			val, lexErr := lexer.Next()
 			if lexErr != nil {
-				return 0, fmt.Errorf(attr + " is missing value")
+				return 0, given, fmt.Errorf(attr + " is missing value")
 			}
 			valInt, err := strconv.Atoi(val)
 			if err != nil {
-				return 0, fmt.Errorf("invalid hr second pass steps")
+				return 0, given, fmt.Errorf("invalid hr second pass steps")
 			}
 			reqParamsRender.HR.SecondPassSteps = valInt
 			validAttr = true
@@ -303,39 +382,167 @@ func ReqParamsParse(ctx context.Context, sdApi *sdapi.SdAPIType, defaults config
 	}
 
 	if reqParamsRender != nil {
-		if !gotNumOutputs {
-			reqParamsRender.NumOutputs = defaults.Cnt
+		// Don't allow upscaler while HR is enabled.
+		if reqParamsRender.HR.Scale > 0 {
+			reqParamsRender.Upscale.Scale = 0
 		}
-		if !gotBatchSize {
-			reqParamsRender.BatchSize = defaults.Batch
+	}
+
+	return
+}
+
+// Infotext keys which only describe the environment of the original render, these are silently skipped.
+var infotextInformationalKeys = []string{"model hash", "version", "hashes", "vae hash", "lora hashes", "ti hashes"}
+
+var infotextParamsRegex = regexp.MustCompile(`(?:^|\s)-[a-zA-Z]`)
+
+// Splits the render params given after an infotext, at the end of its last line or on their own line, like
+// "Steps: 20, Sampler: Euler a, Seed: 1 -cnt 2".
+func SplitInfotextParams(text string) (infotextText, params string) {
+	lines := strings.Split(text, "\n")
+	last := lines[len(lines)-1]
+	loc := infotextParamsRegex.FindStringIndex(last)
+	if loc == nil {
+		return text, ""
+	}
+	params = strings.TrimSpace(last[loc[0]:])
+	lines[len(lines)-1] = strings.TrimSpace(last[:loc[0]])
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return strings.Join(lines, "\n"), params
+}
+
+// Returns true if the given text is an infotext with a prompt and at least one known render param, so
+// ordinary prompts containing colons are not mistaken for infotexts.
+func IsInfotextPrompt(it infotext.Infotext) bool {
+	if it.Prompt == "" {
+		return false
+	}
+	for _, key := range []string{"steps", "sampler", "cfg scale", "seed", "size"} {
+		if _, found := it.Get(key); found {
+			return true
 		}
-		if strings.Contains(strings.ToLower(reqParamsRender.ModelName), "xl") {
-			if !gotWidth {
-				reqParamsRender.Width = defaults.WidthSDXL
+	}
+	return false
+}
+
+// Sets the render params from the given infotext. Keys which can't be honored are returned in unsupported.
+func ReqParamsFromInfotext(ctx context.Context, sdApi *sdapi.SdAPIType, it infotext.Infotext, reqParams *reqparams.ReqParamsRender) (unsupported []string, err error) {
+	reqParams.Prompt = it.Prompt
+	reqParams.NegativePrompt = it.NegativePrompt
+
+	for _, p := range it.Params {
+		honored := true
+		switch strings.ToLower(p.Key) {
+		case "steps":
+			valInt, err := strconv.Atoi(p.Value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid steps")
 			}
-			if !gotHeight {
-				reqParamsRender.Height = defaults.HeightSDXL
+			reqParams.Steps = valInt
+		case "sampler":
+			samplers, err := sdApi.GetSamplers(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("error getting samplers: %w", err)
+			}
+			if honored = slices.Contains(samplers, p.Value); honored {
+				reqParams.SamplerName = p.Value
+			}
+		case "cfg scale":
+			valFloat, err := strconv.ParseFloat(p.Value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CFG scale")
+			}
+			reqParams.CFGScale = valFloat
+		case "seed":
+			if p.Value == "-1" { // Random seed, keeping the already set one.
+				break
+			}
+			valInt, err := strconv.ParseUint(p.Value, 10, 32)
+			if honored = (err == nil); honored {
+				reqParams.Seed = uint32(valInt)
 			}
-			if !gotSteps {
-				reqParamsRender.Steps = defaults.Steps
+		case "size":
+			w, h, found := strings.Cut(p.Value, "x")
+			if !found {
+				return nil, fmt.Errorf("invalid size")
 			}
-		} else {
-			if !gotWidth {
-				reqParamsRender.Width = defaults.Width
+			width, err := strconv.Atoi(w)
+			if err != nil {
+				return nil, fmt.Errorf("invalid width")
 			}
-			if !gotHeight {
-				reqParamsRender.Height = defaults.Height
+			height, err := strconv.Atoi(h)
+			if err != nil {
+				return nil, fmt.Errorf("invalid height")
 			}
-			if !gotSteps {
-				reqParamsRender.Steps = defaults.StepsSDXL
+			reqParams.Width = width
+			reqParams.Height = height
+		case "model":
+			models, err := sdApi.GetModels(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("error getting models: %w", err)
 			}
+			if honored = slices.Contains(models, p.Value); honored {
+				reqParams.ModelName = p.Value
+			}
+		case "batch size":
+			valInt, err := strconv.Atoi(p.Value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid batch size")
+			}
+			reqParams.BatchSize = valInt
+		case "hires upscale":
+			valFloat, err := strconv.ParseFloat(p.Value, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid hr scale")
+			}
+			reqParams.HR.Scale = float32(valFloat)
+		case "hires upscaler":
+			upscalers, err := sdApi.GetUpscalers(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("error getting upscalers: %w", err)
+			}
+			if honored = slices.Contains(upscalers, p.Value); honored {
+				reqParams.HR.Upscaler = p.Value
+			}
+		case "hires steps":
+			valInt, err := strconv.Atoi(p.Value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid hr second pass steps")
+			}
+			reqParams.HR.SecondPassSteps = valInt
+		case "denoising strength":
+			valFloat, err := strconv.ParseFloat(p.Value, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid hr denoise strength")
+			}
+			reqParams.HR.DenoisingStrength = float32(valFloat)
+		case "postprocess upscale by":
+			valFloat, err := strconv.ParseFloat(p.Value, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid upscale scale")
+			}
+			reqParams.Upscale.Scale = float32(valFloat)
+		case "postprocess upscaler":
+			upscalers, err := sdApi.GetUpscalers(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("error getting upscalers: %w", err)
+			}
+			if honored = slices.Contains(upscalers, p.Value); honored {
+				reqParams.Upscale.Upscaler = p.Value
+			}
+		default:
+			honored = slices.Contains(infotextInformationalKeys, strings.ToLower(p.Key))
 		}
 
-		// Don't allow upscaler while HR is enabled.
-		if reqParamsRender.HR.Scale > 0 {
-			reqParamsRender.Upscale.Scale = 0
+		if !honored {
+			unsupported = append(unsupported, p.Key+": "+p.Value)
 		}
 	}
 
+	if reqParams.HR.Scale > 0 {
+		reqParams.Upscale.Scale = 0
+	}
 	return
 }
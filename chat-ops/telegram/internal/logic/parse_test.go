@@ -0,0 +1,157 @@
+package logic
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/infotext"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/reqparams"
+	sdapi "github.com/kanootoko/stable-diffusion-telegram-bot/internal/sd_api"
+)
+
+func TestSplitInfotextParams(t *testing.T) {
+	const it = "a cat\nNegative prompt: a dog\nSteps: 20, Sampler: Euler a, Seed: -1, Model: sd_xl-base"
+	for _, tt := range []struct {
+		text, infotext, params string
+	}{
+		{it, it, ""},
+		{it + " -cnt 2 -w 512", it, "-cnt 2 -w 512"},
+		{it + "\n-cnt 2", it, "-cnt 2"},
+		{"a cat -seed 1", "a cat", "-seed 1"},
+	} {
+		infotext, params := SplitInfotextParams(tt.text)
+		if infotext != tt.infotext || params != tt.params {
+			t.Errorf("%q split to %q and %q", tt.text, infotext, params)
+		}
+	}
+}
+
+func TestIsInfotextPrompt(t *testing.T) {
+	for _, tt := range []struct {
+		text string
+		want bool
+	}{
+		{"a cat\nNegative prompt: a dog\nSteps: 20, Sampler: Euler a, Seed: 1", true},
+		{"a cat\nSize: 512x768, Model: sd_xl-base, Version: v1.9.0", true},
+		{"a cat, style: anime, mood: happy, lighting: soft", false},
+		{"a cat\nstyle: anime, mood: happy, lighting: soft", false},
+		{"Steps: 20, Sampler: Euler a, Seed: 1", false},
+		{"a cat on a roof", false},
+	} {
+		it, _ := infotext.Parse(tt.text)
+		if got := IsInfotextPrompt(it); got != tt.want {
+			t.Errorf("IsInfotextPrompt(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
+
+// infotextParams returns the params from the given key and value pairs.
+func infotextParams(kv ...string) (params []infotext.Param) {
+	for i := 0; i+1 < len(kv); i += 2 {
+		params = append(params, infotext.Param{Key: kv[i], Value: kv[i+1]})
+	}
+	return
+}
+
+// newStubSDAPI returns a WebUI API which only lists the samplers, models and upscalers.
+func newStubSDAPI(t *testing.T) *sdapi.SdAPIType {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sdapi/v1/samplers":
+			_, _ = w.Write([]byte(`[{"name": "Euler a"}, {"name": "DPM++ 2M"}]`))
+		case "/sdapi/v1/sd-models":
+			_, _ = w.Write([]byte(`[{"model_name": "sd_xl-base"}]`))
+		case "/sdapi/v1/upscalers":
+			_, _ = w.Write([]byte(`[{"name": "R-ESRGAN 4x+"}]`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return &sdapi.SdAPIType{SdHost: server.URL}
+}
+
+func TestReqParamsFromInfotext(t *testing.T) {
+	sdAPI := newStubSDAPI(t)
+	for _, tt := range []struct {
+		name        string
+		params      []infotext.Param
+		want        reqparams.ReqParamsRender
+		unsupported []string
+		err         bool
+	}{
+		{
+			name: "render params",
+			params: infotextParams(
+				"Steps", "30", "Sampler", "Euler a", "CFG scale", "6.5", "Seed", "123",
+				"Size", "512x768", "Model", "sd_xl-base", "Batch size", "2", "Model hash", "abc",
+			),
+			want: reqparams.ReqParamsRender{
+				Steps: 30, SamplerName: "Euler a", CFGScale: 6.5, Seed: 123, Width: 512, Height: 768,
+				ModelName: "sd_xl-base", BatchSize: 2,
+			},
+		},
+		{
+			name:   "random seed keeps the set one",
+			params: infotextParams("Seed", "-1"),
+			want:   reqparams.ReqParamsRender{Seed: 42},
+		},
+		{
+			name: "unsupported keys",
+			params: infotextParams(
+				"Sampler", "Unknown", "Model", "other", "Seed", "99999999999", "Clip skip", "2",
+				"Postprocess upscaler", "Unknown",
+			),
+			want: reqparams.ReqParamsRender{Seed: 42},
+			unsupported: []string{
+				"Sampler: Unknown", "Model: other", "Seed: 99999999999", "Clip skip: 2", "Postprocess upscaler: Unknown",
+			},
+		},
+		{
+			name: "hires fix wins over upscale",
+			params: infotextParams(
+				"Hires upscale", "2", "Hires upscaler", "R-ESRGAN 4x+", "Hires steps", "10",
+				"Denoising strength", "0.5", "Postprocess upscale by", "4", "Postprocess upscaler", "R-ESRGAN 4x+",
+			),
+			want: reqparams.ReqParamsRender{
+				Seed:    42,
+				HR:      reqparams.ReqParamsRenderHR{Scale: 2, Upscaler: "R-ESRGAN 4x+", SecondPassSteps: 10, DenoisingStrength: 0.5},
+				Upscale: reqparams.ReqParamsUpscale{Upscaler: "R-ESRGAN 4x+"},
+			},
+		},
+		{
+			name:   "upscale without hires fix",
+			params: infotextParams("Postprocess upscale by", "4", "Postprocess upscaler", "R-ESRGAN 4x+"),
+			want:   reqparams.ReqParamsRender{Seed: 42, Upscale: reqparams.ReqParamsUpscale{Scale: 4, Upscaler: "R-ESRGAN 4x+"}},
+		},
+		{name: "size without x", params: infotextParams("Size", "512"), err: true},
+		{name: "invalid width", params: infotextParams("Size", "ax768"), err: true},
+		{name: "invalid height", params: infotextParams("Size", "512xb"), err: true},
+		{name: "invalid steps", params: infotextParams("Steps", "many"), err: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			it := infotext.Infotext{Prompt: "a cat", NegativePrompt: "a dog", Params: tt.params}
+			reqParams := reqparams.ReqParamsRender{Seed: 42}
+			unsupported, err := ReqParamsFromInfotext(context.Background(), sdAPI, it, &reqParams)
+			if tt.err {
+				if err == nil {
+					t.Fatal("no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.want.Prompt, tt.want.NegativePrompt = "a cat", "a dog"
+			if !reflect.DeepEqual(reqParams, tt.want) {
+				t.Errorf("params = %+v, want %+v", reqParams, tt.want)
+			}
+			if !reflect.DeepEqual(unsupported, tt.unsupported) {
+				t.Errorf("unsupported = %q, want %q", unsupported, tt.unsupported)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package logic
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/go-telegram/bot/models"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/consts"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/infotext"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/logging"
+	reqqueue "github.com/kanootoko/stable-diffusion-telegram-bot/internal/req_queue"
+)
+
+const pngInfoMaxPromptLen = 1000
+
+func (c *CmdHandler) pngInfo(ctx context.Context, msg *models.Message) {
+	if msg.ReplyToMessage != nil && msg.ReplyToMessage.Document != nil {
+		c.handlePNGInfo(ctx, msg.ReplyToMessage)
+		return
+	}
+
+	c.pngInfoMutex.Lock()
+	for key, deadline := range c.pngInfoWaiting {
+		if time.Now().After(deadline) {
+			delete(c.pngInfoWaiting, key)
+		}
+	}
+	c.pngInfoWaiting[pngInfoWaitingKey{userID: msg.From.ID, chatID: msg.Chat.ID}] = time.Now().Add(consts.PNGInfoWaitTimeout)
+	c.pngInfoMutex.Unlock()
+	c.bot.SendReplyToMessage(ctx, msg, consts.PNGInfoImageReqStr)
+}
+
+// The users who sent /pnginfo without a file are waited for in the chat of the command until a deadline.
+type pngInfoWaitingKey struct {
+	userID int64
+	chatID int64
+}
+
+// Returns true if the user has sent /pnginfo in the chat of the message and we are waiting for the file. An
+// image requested by the queue for the user takes precedence.
+func (c *CmdHandler) isPNGInfoWaiting(msg *models.Message) bool {
+	if c.reqQueue.IsImageForMessage(msg) {
+		return false
+	}
+
+	c.pngInfoMutex.Lock()
+	defer c.pngInfoMutex.Unlock()
+	key := pngInfoWaitingKey{userID: msg.From.ID, chatID: msg.Chat.ID}
+	deadline, found := c.pngInfoWaiting[key]
+	if found && time.Now().After(deadline) {
+		delete(c.pngInfoWaiting, key)
+		return false
+	}
+	return found
+}
+
+// Like isPNGInfoWaiting, but stops waiting.
+func (c *CmdHandler) takePNGInfoWaiting(msg *models.Message) bool {
+	if !c.isPNGInfoWaiting(msg) {
+		return false
+	}
+
+	c.pngInfoMutex.Lock()
+	defer c.pngInfoMutex.Unlock()
+	delete(c.pngInfoWaiting, pngInfoWaitingKey{userID: msg.From.ID, chatID: msg.Chat.ID})
+	return true
+}
+
+func (c *CmdHandler) getInfotextFromDocument(ctx context.Context, docMsg *models.Message) (it infotext.Infotext, err error) {
+	d, err := c.bot.GetFile(ctx, docMsg.Document.FileID, func(fileSize int64) io.Writer {
+		return io.Discard
+	})
+	if err != nil {
+		return it, fmt.Errorf("can't get file: %w", err)
+	}
+
+	return infotext.FromImage(d)
+}
+
+func truncatePrompt(s string) string {
+	if len([]rune(s)) > pngInfoMaxPromptLen {
+		return string([]rune(s)[:pngInfoMaxPromptLen]) + "..."
+	}
+	return s
+}
+
+func pngInfoString(it infotext.Infotext) string {
+	lines := []string{"📝 <b>Prompt:</b> <code>" + html.EscapeString(truncatePrompt(it.Prompt)) + "</code>"}
+	if it.NegativePrompt != "" {
+		lines = append(lines, "📍 <b>Negative prompt:</b> <code>"+html.EscapeString(truncatePrompt(it.NegativePrompt))+"</code>")
+	}
+
+	emojis := map[string]string{
+		"steps":     "👟",
+		"sampler":   "🔭",
+		"cfg scale": "🕹",
+		"seed":      "🌱",
+		"size":      "🖼",
+		"model":     "🧩",
+	}
+	for _, p := range it.Params {
+		emoji, found := emojis[strings.ToLower(p.Key)]
+		if !found {
+			emoji = "▫"
+		}
+		lines = append(lines, emoji+" "+html.EscapeString(p.Key)+": <code>"+html.EscapeString(p.Value)+"</code>")
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (c *CmdHandler) handlePNGInfo(ctx context.Context, docMsg *models.Message) {
+	it, err := c.getInfotextFromDocument(ctx, docMsg)
+	if err != nil {
+		slog.ErrorContext(ctx, "pnginfo error", "error", err)
+		c.bot.SendReplyToMessage(ctx, docMsg, consts.ErrorStr+": "+err.Error())
+		return
+	}
+
+	c.bot.SendReplyWithMarkup(ctx, docMsg, pngInfoString(it), &models.InlineKeyboardMarkup{
+		InlineKeyboard: [][]models.InlineKeyboardButton{{
+			{Text: consts.PNGInfoRenderButtonStr, CallbackData: consts.PNGInfoRenderCallbackData},
+		}},
+	})
+}
+
+// The callback message is our reply to the document, so the parameters are read again from the replied file.
+func (c *CmdHandler) pngInfoRender(ctx context.Context, cb *models.CallbackQuery) {
+	docMsg := cb.Message.ReplyToMessage
+	if docMsg == nil || docMsg.Document == nil {
+		c.bot.AnswerCallbackQuery(ctx, cb.ID, consts.ErrorStr+": original file not found")
+		return
+	}
+
+	it, err := c.getInfotextFromDocument(ctx, docMsg)
+	if err != nil {
+		c.bot.AnswerCallbackQuery(ctx, cb.ID, consts.ErrorStr+": "+err.Error())
+		return
+	}
+
+	reqParams, _, err := c.renderParamsFromInfotext(ctx, cb.Message.Chat.ID, it, "")
+	if err != nil {
+		c.bot.AnswerCallbackQuery(ctx, cb.ID, consts.ErrorStr+": "+err.Error())
+		return
+	}
+	c.bot.AnswerCallbackQuery(ctx, cb.ID, "")
+
+	// Results are sent as a reply to the document, on behalf of the user who pressed the button.
+	reqMsg := *docMsg
+	reqMsg.From = &cb.Sender
+	c.reqQueue.Add(reqqueue.ReqQueueReq{
+		Type:    reqqueue.ReqTypeRender,
+		Message: &reqMsg,
+		Params:  reqParams,
+		TaskID:  logging.TaskID(ctx),
+	})
+}
@@ -0,0 +1,48 @@
+package logic
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+
+	"github.com/go-telegram/bot/models"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/chatsettings"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/consts"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/safety"
+)
+
+func (c *CmdHandler) safety(ctx context.Context, msg *models.Message) {
+	if c.Safety == nil {
+		c.bot.SendReplyToMessage(ctx, msg, consts.SafetyDisabledStr)
+		return
+	}
+
+	arg := strings.ToLower(strings.TrimSpace(removeBotName(msg.Text)))
+	if arg == "" {
+		c.bot.SendReplyToMessage(ctx, msg, consts.SafetySetStr+string(c.Safety.Policy(msg.Chat.ID))+"\n"+consts.SafetyUsageStr)
+		return
+	}
+	var policy safety.Policy
+	if arg != "reset" {
+		var err error
+		if policy, err = safety.ParsePolicy(arg); err != nil {
+			c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": "+consts.SafetyUsageStr)
+			return
+		}
+	}
+
+	if !c.canChangeChatSettings(msg) {
+		c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": "+consts.ChatSettingsAdminOnlyStr)
+		return
+	}
+
+	err := c.chatSettings.Update(msg.Chat.ID, func(settings *chatsettings.Settings) {
+		settings.SafetyPolicy = string(policy)
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "chat settings save error", "error", err)
+		c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": can't save chat settings: "+err.Error())
+		return
+	}
+	c.bot.SendReplyToMessage(ctx, msg, consts.SafetySetStr+string(c.Safety.Policy(msg.Chat.ID)))
+}
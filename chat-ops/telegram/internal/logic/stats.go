@@ -0,0 +1,55 @@
+package logic
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/go-telegram/bot/models"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/consts"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/stats"
+)
+
+// Usage: /stats [day|week|month] [chart], the period is a week by default.
+func (c *CmdHandler) stats(ctx context.Context, msg *models.Message) {
+	if !c.us.IsAdmin(msg.From.ID) || c.reqQueue.Stats == nil {
+		return
+	}
+
+	periodName := consts.StatsDefaultPeriod
+	var chart bool
+	for _, arg := range strings.Fields(removeBotName(msg.Text)) {
+		if arg == "chart" {
+			chart = true
+		} else {
+			periodName = arg
+		}
+	}
+	period, err := stats.ParsePeriod(periodName)
+	if err != nil {
+		c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": "+err.Error()+"\n"+consts.StatsUsageStr)
+		return
+	}
+
+	now := time.Now()
+	records := c.reqQueue.Stats.Since(now.Add(-period.Duration))
+	if len(records) == 0 {
+		c.bot.SendReplyToMessage(ctx, msg, consts.StatsEmptyStr)
+		return
+	}
+	c.bot.SendReplyToMessage(ctx, msg, stats.Summarize(records).Format(consts.StatsTitleStr+period.Name, consts.StatsTopCount))
+
+	if !chart {
+		return
+	}
+	png, err := stats.Chart(records, period, now)
+	if err == nil {
+		_, err = c.bot.SendPhoto(ctx, msg, fmt.Sprintf("sd-stats-%s.png", period.Name), png, "", nil, false)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "stats chart error", "error", err)
+		c.bot.SendReplyToMessage(ctx, msg, consts.ErrorStr+": "+err.Error())
+	}
+}
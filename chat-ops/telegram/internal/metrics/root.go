@@ -0,0 +1,92 @@
+// Package metrics has the Prometheus metrics of the bot, they are served on /metrics.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "sdbot"
+
+// Outcomes of the requests.
+const (
+	OutcomeDone     = "done"
+	OutcomeFailed   = "failed"
+	OutcomeCanceled = "canceled"
+	// Rejected by the moderation before queueing.
+	OutcomeRejected = "rejected"
+	// Blocked by the safety policy of the chat.
+	OutcomeBlocked = "blocked"
+)
+
+var (
+	Requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "Requests by type and outcome.",
+	}, []string{"type", "outcome"})
+
+	QueueLength = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_length",
+		Help:      "Requests in the queue, including the one being processed.",
+	})
+	QueueWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "queue_wait_seconds",
+		Help:      "Time the requests spent in the queue before their processing started.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	})
+
+	RenderDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "render_duration_seconds",
+		Help:      "Time the backend spent processing the successful requests, without the uploads.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 11),
+	}, []string{"type", "model", "sampler"})
+	ImagesDelivered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "images_delivered_total",
+		Help:      "Delivered images by request type.",
+	}, []string{"type"})
+
+	TelegramAPIErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "telegram_api_errors_total",
+		Help:      "Failed Telegram Bot API calls by method and HTTP status code.",
+	}, []string{"method", "code"})
+	TelegramRetryAfterWaits = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "telegram_retry_after_waits_total",
+		Help:      "Waits because of Telegram flood control.",
+	})
+	TelegramRetryAfterWaitSeconds = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "telegram_retry_after_wait_seconds_total",
+		Help:      "Total time waited because of Telegram flood control.",
+	})
+
+	SDAPIDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "sd_api_request_duration_seconds",
+		Help:      "Latency of the Stable Diffusion API requests by endpoint.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+	}, []string{"endpoint"})
+	SDAPIErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sd_api_errors_total",
+		Help:      "Failed Stable Diffusion API requests by endpoint.",
+	}, []string{"endpoint"})
+	BackendUp = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "backend_up",
+		Help:      "1 if the last Stable Diffusion API request got a response, 0 if the backend couldn't be reached.",
+	})
+)
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,45 @@
+package moderation
+
+import (
+	"time"
+
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/jsonl"
+)
+
+// AuditEntry is a rejected prompt.
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	UserID   int64     `json:"user_id"`
+	Username string    `json:"username,omitempty"`
+	ChatID   int64     `json:"chat_id"`
+	Prompt   string    `json:"prompt"`
+	Reason   string    `json:"reason"`
+}
+
+// Audit keeps the last keepCount rejections in memory. If filename is set, entries are appended to the file as
+// JSON lines and the last ones are loaded on startup.
+type Audit struct {
+	entries *jsonl.Store[AuditEntry]
+}
+
+func NewAudit(filename string, keepCount int) (*Audit, error) {
+	entries, err := jsonl.Open[AuditEntry]("moderation audit", filename, jsonl.Options[AuditEntry]{KeepCount: keepCount})
+	if err != nil {
+		return nil, err
+	}
+	return &Audit{entries: entries}, nil
+}
+
+func (a *Audit) Add(e AuditEntry) error {
+	return a.entries.Add(e)
+}
+
+// List returns the last n entries, newest first.
+func (a *Audit) List(n int) (res []AuditEntry) {
+	a.entries.View(func(entries []AuditEntry) {
+		for i := len(entries) - 1; i >= 0 && len(res) < n; i-- {
+			res = append(res, entries[i])
+		}
+	})
+	return
+}
@@ -0,0 +1,75 @@
+package moderation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const hookTimeout = 10 * time.Second
+
+// Hook posts the prompts to an external moderation service as
+// {"user_id": 1, "username": "", "chat_id": 1, "prompt": "", "negative_prompt": ""}, which should respond with
+// {"allowed": false, "reason": "..."}.
+type Hook struct {
+	URL string
+}
+
+type hookRequest struct {
+	UserID         int64  `json:"user_id"`
+	Username       string `json:"username"`
+	ChatID         int64  `json:"chat_id"`
+	Prompt         string `json:"prompt"`
+	NegativePrompt string `json:"negative_prompt"`
+}
+
+type hookResponse struct {
+	Allowed *bool  `json:"allowed"`
+	Reason  string `json:"reason"`
+}
+
+func (h *Hook) Check(ctx context.Context, req Request) (allowed bool, reason string, err error) {
+	ctx, cancel := context.WithTimeout(ctx, hookTimeout)
+	defer cancel()
+
+	body, err := json.Marshal(hookRequest{
+		UserID:         req.UserID,
+		Username:       req.Username,
+		ChatID:         req.ChatID,
+		Prompt:         req.Prompt,
+		NegativePrompt: req.NegativePrompt,
+	})
+	if err != nil {
+		return false, "", err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, "", err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return false, "", err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return false, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, "", fmt.Errorf("moderation hook response status %d", resp.StatusCode)
+	}
+	var res hookResponse
+	if err = json.Unmarshal(respBody, &res); err != nil {
+		return false, "", fmt.Errorf("invalid moderation hook response: %w", err)
+	}
+	if res.Allowed == nil {
+		return false, "", fmt.Errorf("moderation hook response has no allowed field")
+	}
+	return *res.Allowed, res.Reason, nil
+}
@@ -0,0 +1,148 @@
+package moderation
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Request is the prompt checked before a request is queued.
+type Request struct {
+	UserID         int64
+	Username       string
+	ChatID         int64
+	Prompt         string
+	NegativePrompt string
+}
+
+// RejectedError is returned for the rejected prompts, the reason is shown to the user.
+type RejectedError struct {
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	return "prompt rejected: " + e.Reason
+}
+
+// ParseRule compiles a blocklist rule. Rules enclosed in slashes like /regex/ are regular expressions,
+// others are words matched as whole words. Both are case insensitive.
+func ParseRule(rule string) (*regexp.Regexp, error) {
+	rule = strings.TrimSpace(rule)
+	if len(rule) > 2 && strings.HasPrefix(rule, "/") && strings.HasSuffix(rule, "/") {
+		re, err := regexp.Compile("(?i)" + rule[1:len(rule)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex: %w", err)
+		}
+		return re, nil
+	}
+	if rule == "" {
+		return nil, fmt.Errorf("empty rule")
+	}
+	return regexp.MustCompile(`(?i)\b` + regexp.QuoteMeta(rule) + `\b`), nil
+}
+
+// ChatRules returns the blocklist and the forced negative prompt of a chat.
+type ChatRules func(chatID int64) (blocklist []string, negativePrompt string)
+
+// Moderator checks the prompts against the global and the per-chat blocklists, and the external hook.
+type Moderator struct {
+	rules     []string
+	compiled  []*regexp.Regexp
+	chatRules ChatRules
+
+	// Optional, called after the blocklists.
+	Hook *Hook
+	// Rejected prompts are recorded here if set.
+	Audit *Audit
+}
+
+func New(rules []string, chatRules ChatRules) (*Moderator, error) {
+	m := &Moderator{rules: rules, chatRules: chatRules}
+	for _, rule := range rules {
+		re, err := ParseRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("blocklist rule %q: %w", rule, err)
+		}
+		m.compiled = append(m.compiled, re)
+	}
+	return m, nil
+}
+
+// Check returns a RejectedError if the prompt is rejected. Hook errors reject the prompt too.
+func (m *Moderator) Check(ctx context.Context, req Request) error {
+	reason := m.matchBlocklists(req)
+	if reason == "" && m.Hook != nil {
+		allowed, hookReason, err := m.Hook.Check(ctx, req)
+		switch {
+		case err != nil:
+			slog.ErrorContext(ctx, "moderation hook error", "error", err)
+			reason = "moderation unavailable"
+		case !allowed:
+			reason = hookReason
+			if reason == "" {
+				reason = "rejected by moderation"
+			}
+		}
+	}
+	if reason == "" {
+		return nil
+	}
+
+	slog.InfoContext(ctx, "prompt rejected", "user_id", req.UserID, "chat_id", req.ChatID, "reason", reason)
+	if m.Audit != nil {
+		err := m.Audit.Add(AuditEntry{
+			Time:     time.Now(),
+			UserID:   req.UserID,
+			Username: req.Username,
+			ChatID:   req.ChatID,
+			Prompt:   req.Prompt,
+			Reason:   reason,
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "moderation audit error", "error", err)
+		}
+	}
+	return &RejectedError{Reason: reason}
+}
+
+// Only the prompt is matched, as negative prompts usually list the unwanted things.
+func (m *Moderator) matchBlocklists(req Request) string {
+	for i, re := range m.compiled {
+		if re.MatchString(req.Prompt) {
+			return fmt.Sprintf("matches blocklist rule %q", m.rules[i])
+		}
+	}
+	if m.chatRules == nil {
+		return ""
+	}
+	blocklist, _ := m.chatRules(req.ChatID)
+	for _, rule := range blocklist {
+		re, err := ParseRule(rule)
+		if err != nil {
+			slog.Warn("invalid chat blocklist rule", "chat_id", req.ChatID, "error", err)
+			continue
+		}
+		if re.MatchString(req.Prompt) {
+			return fmt.Sprintf("matches chat blocklist rule %q", rule)
+		}
+	}
+	return ""
+}
+
+// AddForcedNegative appends the forced negative prompt of the chat to the negative prompt.
+func (m *Moderator) AddForcedNegative(chatID int64, negativePrompt string) string {
+	if m.chatRules == nil {
+		return negativePrompt
+	}
+	_, forced := m.chatRules(chatID)
+	if forced = strings.TrimSpace(forced); forced == "" || strings.Contains(negativePrompt, forced) {
+		return negativePrompt
+	}
+	if strings.TrimSpace(negativePrompt) == "" {
+		return forced
+	}
+	return negativePrompt + ", " + forced
+}
@@ -0,0 +1,54 @@
+package reqqueue
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/archive"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/infotext"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/reqparams"
+)
+
+// Saves the original PNGs of the current entry to the archive if it's set. Archive errors are only logged,
+// as the results were already delivered.
+func (q *ReqQueue) archiveResults(originals [][]byte, filenames []string, infotexts []infotext.Infotext) {
+	if q.Archive == nil {
+		return
+	}
+
+	e := q.currentEntry.entry
+	meta := archive.Metadata{
+		Time:     time.Now(),
+		TaskID:   e.TaskID,
+		UserID:   e.UserID,
+		Username: e.Username,
+		ChatID:   e.ChatID,
+		Type:     e.Type.String(),
+		Prompt:   e.Params.OriginalPrompt(),
+		Params:   e.Params,
+	}
+	switch p := e.Params.(type) {
+	case reqparams.ReqParamsRender:
+		meta.Model = p.ModelName
+	case reqparams.ReqParamsKuka:
+		meta.Model = p.ModelName
+	}
+	texts := make([]string, len(infotexts))
+	for i := range infotexts {
+		texts[i] = infotexts[i].String()
+	}
+
+	if err := q.Archive.Save(meta, originals, filenames, texts); err != nil {
+		slog.ErrorContext(q.currentEntry.entry.ctx, "archive error", "error", err)
+	}
+}
+
+// Returns the archive filenames of the rendered PNGs, the base should contain the task ID to avoid collisions.
+func archiveFilenames(base string, count int) []string {
+	filenames := make([]string, count)
+	for i := range filenames {
+		filenames[i] = fmt.Sprintf("%s-%d.png", base, i)
+	}
+	return filenames
+}
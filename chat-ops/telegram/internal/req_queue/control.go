@@ -0,0 +1,205 @@
+package reqqueue
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/consts"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/metrics"
+)
+
+// ErrRestarting is passed to Delivery.Finished for the requests which were waiting when the queue was
+// drained or interrupted by the shutdown, and returned by Add while draining.
+var ErrRestarting = errors.New("the bot is restarting, please send the request again later")
+
+// Returns true if no new requests should be started. Should be called with the mutex locked.
+func (q *ReqQueue) held() bool {
+	return q.paused || q.maintenance || q.draining
+}
+
+// Returns an error if new requests are not accepted.
+func (q *ReqQueue) checkAccepting() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.draining {
+		return ErrRestarting
+	}
+	if q.maintenance && !q.MaintenanceHold {
+		return &MaintenanceError{Message: q.maintenanceMessage}
+	}
+	return nil
+}
+
+// Returns the entries which are not being processed. Should be called with the mutex locked.
+func (q *ReqQueue) waitingEntries() []ReqQueueEntry {
+	if q.processing && len(q.entries) > 0 {
+		return slices.Clone(q.entries[1:])
+	}
+	return slices.Clone(q.entries)
+}
+
+// Updates the status of the given entries. Should be called with the mutex unlocked, as the deliveries can
+// block for long, for example on Telegram flood control.
+func sendStatus(entries []ReqQueueEntry, s Status) {
+	for i := range entries {
+		entries[i].Delivery.Status(entries[i].ctx, s)
+	}
+}
+
+func (q *ReqQueue) notifyProcessor() {
+	select {
+	case q.processReqChan <- true:
+	default:
+	}
+}
+
+// Pause stops starting new requests after the current one, new requests are still queued.
+func (q *ReqQueue) Pause(ctx context.Context) {
+	q.mutex.Lock()
+	slog.InfoContext(ctx, "queue paused")
+	q.paused = true
+	var waiting []ReqQueueEntry
+	if !q.maintenance {
+		waiting = q.waitingEntries()
+	}
+	q.mutex.Unlock()
+
+	sendStatus(waiting, Status{Text: consts.QueuePausedStr})
+}
+
+func (q *ReqQueue) Resume(ctx context.Context) {
+	q.mutex.Lock()
+	slog.InfoContext(ctx, "queue resumed")
+	q.paused = false
+	q.mutex.Unlock()
+
+	q.notifyProcessor()
+}
+
+func (q *ReqQueue) Paused() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.paused
+}
+
+// Drain stops accepting and starting new requests, waits for the current one to finish, and cancels the
+// waiting ones with ErrRestarting. The wait is bounded by the time a request can take. The channel returned
+// by Drained is closed when it's done, calling Drain again only waits for that.
+func (q *ReqQueue) Drain(ctx context.Context) {
+	q.mutex.Lock()
+	if q.draining {
+		q.mutex.Unlock()
+		<-q.drained
+		return
+	}
+	slog.InfoContext(ctx, "draining queue", "waiting", len(q.entries))
+	q.draining = true
+	q.mutex.Unlock()
+
+	q.waitProcessing(ctx, q.ProcessTimeout+consts.ProcessorStallGrace)
+	if q.isProcessing() && ctx.Err() == nil {
+		slog.WarnContext(ctx, "drain timeout, the current request is still being processed")
+	}
+
+	q.mutex.Lock()
+	waiting := q.removeWaiting()
+	q.mutex.Unlock()
+	q.finishEntries(waiting, ErrRestarting)
+
+	slog.InfoContext(ctx, "queue drained")
+	close(q.drained)
+}
+
+// Drained returns a channel which is closed when the queue is drained.
+func (q *ReqQueue) Drained() <-chan struct{} {
+	return q.drained
+}
+
+func (q *ReqQueue) isProcessing() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.processing
+}
+
+// Waits for the current request to finish, at most for the timeout.
+func (q *ReqQueue) waitProcessing(ctx context.Context, timeout time.Duration) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for q.isProcessing() {
+		select {
+		case <-ticker.C:
+		case <-timer.C:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Removes the entries which are not being processed from the queue and returns them. Should be called with
+// the mutex locked.
+func (q *ReqQueue) removeWaiting() []ReqQueueEntry {
+	waiting := q.waitingEntries()
+	if q.processing && len(q.entries) > 0 {
+		q.entries = q.entries[:1]
+	} else {
+		q.entries = nil
+	}
+	metrics.QueueLength.Set(float64(len(q.entries)))
+	return waiting
+}
+
+// Finishes the given removed entries as canceled with err. Should be called with the mutex unlocked, see
+// sendStatus.
+func (q *ReqQueue) finishEntries(entries []ReqQueueEntry, err error) {
+	for i := range entries {
+		entries[i].Delivery.Finished(entries[i].ctx, err)
+		metrics.Requests.WithLabelValues(entries[i].Type.String(), metrics.OutcomeCanceled).Inc()
+		q.recordStats(&entries[i], metrics.OutcomeCanceled)
+	}
+}
+
+func (q *ReqQueue) setUploading() {
+	q.mutex.Lock()
+	q.currentEntry.uploading = true
+	q.mutex.Unlock()
+}
+
+// Shutdown is called when the bot stops, after the queue context is canceled. The users of the waiting
+// requests are told that the bot is restarting. The current request is interrupted the same way, unless its
+// results are being uploaded, which gets ShutdownUploadTimeout to finish.
+func (q *ReqQueue) Shutdown() {
+	q.mutex.Lock()
+	slog.Info("shutting down the queue", "waiting", len(q.entries))
+	q.draining = true
+	waiting := q.removeWaiting()
+	uploading := q.processing && q.currentEntry.uploading
+	q.mutex.Unlock()
+	q.finishEntries(waiting, ErrRestarting)
+
+	if uploading {
+		slog.Info("waiting for the upload to finish")
+		q.waitProcessing(context.Background(), consts.ShutdownUploadTimeout)
+	}
+
+	q.mutex.Lock()
+	processing := q.processing
+	if processing {
+		slog.Info("interrupting the current request")
+		q.currentEntry.canceled = true
+		q.currentEntry.restarting = true
+		q.currentEntry.ctxCancel()
+	}
+	q.mutex.Unlock()
+
+	if processing {
+		q.waitProcessing(context.Background(), consts.ShutdownNotifyTimeout)
+	}
+	slog.Info("queue shut down")
+}
@@ -0,0 +1,127 @@
+package reqqueue
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/imgenc"
+)
+
+// ErrCanceled is passed to Delivery.Finished for canceled requests.
+var ErrCanceled = errors.New("canceled")
+
+// Status of a request shown by its frontend.
+type Status struct {
+	Text string
+	// Set while the request is waiting in the queue.
+	QueuePosition int
+	// Set once the backend started processing the request. Held requests have neither this nor a queue
+	// position.
+	Started bool
+	// Set while rendering.
+	Progress int
+	ETA      time.Duration
+	// The latest live preview as a JPEG, only set if the delivery wants previews.
+	Preview []byte
+	// The preview should be hidden as a spoiler.
+	Spoiler bool
+}
+
+// Result images of a request.
+type Result struct {
+	TaskID uint64
+	// The images are encoded in the output format.
+	Imgs        [][]byte
+	Filenames   []string
+	Output      imgenc.Options
+	Description string
+	// If set, this contact sheet should be shown instead of the images.
+	Grid []byte
+	// The images should be hidden as spoilers.
+	Spoiler bool
+}
+
+// Delivery is the frontend a request came from, the queue reports the status and sends the results through
+// it.
+type Delivery interface {
+	// Status replaces the shown status of the request.
+	Status(ctx context.Context, s Status)
+	// Previews returns false if the live previews shouldn't be fetched for the request.
+	Previews() bool
+	// AskForImage asks the user to send the input image of the request, which should then be passed to
+	// ReqQueue.GotImage.
+	AskForImage(ctx context.Context)
+	// Deliver sends the results and returns the IDs of the delivered files if the frontend has them.
+	Deliver(ctx context.Context, r Result) (fileIDs []string, err error)
+	// Finished is called when the request is done. The error is set if it failed, it's ErrCanceled if the
+	// request was canceled.
+	Finished(ctx context.Context, err error)
+}
+
+// MemoryDelivery keeps everything the queue reports, for testing the queue without a frontend.
+type MemoryDelivery struct {
+	mutex sync.Mutex
+
+	statuses      []Status
+	askedForImage bool
+	results       []Result
+	finished      bool
+	err           error
+}
+
+func (d *MemoryDelivery) Status(ctx context.Context, s Status) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.statuses = append(d.statuses, s)
+}
+
+func (d *MemoryDelivery) Previews() bool {
+	return false
+}
+
+func (d *MemoryDelivery) AskForImage(ctx context.Context) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.askedForImage = true
+}
+
+func (d *MemoryDelivery) Deliver(ctx context.Context, r Result) ([]string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.results = append(d.results, r)
+	return nil, nil
+}
+
+func (d *MemoryDelivery) Finished(ctx context.Context, err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.finished = true
+	d.err = err
+}
+
+func (d *MemoryDelivery) Statuses() []Status {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.statuses
+}
+
+func (d *MemoryDelivery) AskedForImage() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.askedForImage
+}
+
+func (d *MemoryDelivery) Results() []Result {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.results
+}
+
+// IsFinished returns true if the request is done, with its error.
+func (d *MemoryDelivery) IsFinished() (bool, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.finished, d.err
+}
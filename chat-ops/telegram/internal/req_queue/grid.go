@@ -0,0 +1,105 @@
+package reqqueue
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+
+	"github.com/go-telegram/bot/models"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/consts"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/imgenc"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/imggrid"
+)
+
+// The original images of a result sent as a grid, kept for the "send tile" and zip buttons.
+type GridResult struct {
+	TaskID    uint64
+	Imgs      [][]byte
+	Filenames []string
+	Output    imgenc.Options
+	Spoiler   bool
+}
+
+// Zip returns the original images packed into a zip file.
+func (r GridResult) Zip() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w := zip.NewWriter(buf)
+	for i := range r.Imgs {
+		// The images are already compressed.
+		f, err := w.CreateHeader(&zip.FileHeader{Name: r.Filenames[i], Method: zip.Store})
+		if err != nil {
+			return nil, err
+		}
+		if _, err = f.Write(r.Imgs[i]); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (q *ReqQueue) storeGridResult(r GridResult) {
+	q.gridResultsMutex.Lock()
+	defer q.gridResultsMutex.Unlock()
+
+	q.gridResults = append(q.gridResults, r)
+	if len(q.gridResults) > consts.GridResultsKeepCount {
+		q.gridResults = q.gridResults[len(q.gridResults)-consts.GridResultsKeepCount:]
+	}
+}
+
+// GetGridResult returns the originals of a grid sent recently, only the last few results are kept in memory.
+func (q *ReqQueue) GetGridResult(taskID uint64) (r GridResult, found bool) {
+	q.gridResultsMutex.Lock()
+	defer q.gridResultsMutex.Unlock()
+
+	for _, r := range q.gridResults {
+		if r.TaskID == taskID {
+			return r, true
+		}
+	}
+	return r, false
+}
+
+// Composes the contact sheet of the rendered PNGs, the tiles are labeled with the image index and seed.
+func composeGrid(imgs [][]byte, firstSeed uint32) ([]byte, error) {
+	decoded := make([]image.Image, len(imgs))
+	labels := make([]string, len(imgs))
+	for i := range imgs {
+		var err error
+		if decoded[i], err = png.Decode(bytes.NewReader(imgs[i])); err != nil {
+			return nil, fmt.Errorf("png decode error: %w", err)
+		}
+		labels[i] = fmt.Sprintf("#%d seed %d", i+1, firstSeed+uint32(i))
+	}
+
+	grid := imggrid.Compose(decoded, labels, consts.GridMaxDimensionsSum)
+	return imgenc.EncodeImage(grid, imgenc.Options{Format: imgenc.FormatJPEG, Quality: 90}, "")
+}
+
+func gridMarkup(taskID uint64, imgCount int) *models.InlineKeyboardMarkup {
+	var rows [][]models.InlineKeyboardButton
+	var row []models.InlineKeyboardButton
+	for i := 0; i < imgCount; i++ {
+		row = append(row, models.InlineKeyboardButton{
+			Text:         fmt.Sprintf("#%d", i+1),
+			CallbackData: fmt.Sprintf("%s%d:%d", consts.GridCallbackDataPrefix, taskID, i+1),
+		})
+		if len(row) == consts.GridButtonsPerRow {
+			rows = append(rows, row)
+			row = nil
+		}
+	}
+	if len(row) > 0 {
+		rows = append(rows, row)
+	}
+	rows = append(rows, []models.InlineKeyboardButton{{
+		Text:         consts.GridZipButtonStr,
+		CallbackData: fmt.Sprintf("%s%d:%s", consts.GridCallbackDataPrefix, taskID, consts.GridZipCallbackDataSuffix),
+	}})
+	return &models.InlineKeyboardMarkup{InlineKeyboard: rows}
+}
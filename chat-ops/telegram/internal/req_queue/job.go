@@ -0,0 +1,139 @@
+package reqqueue
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/imgenc"
+)
+
+type JobState string
+
+const (
+	JobStateQueued   JobState = "queued"
+	JobStateRunning  JobState = "running"
+	JobStateDone     JobState = "done"
+	JobStateFailed   JobState = "failed"
+	JobStateCanceled JobState = "canceled"
+)
+
+// Job is the delivery of requests not coming from a Telegram chat, it stores the status and the results
+// until they are fetched.
+type Job struct {
+	mutex sync.Mutex
+
+	UserID   int64
+	Username string
+	Created  time.Time
+
+	state     JobState
+	progress  int
+	eta       time.Duration
+	err       string
+	finished  time.Time
+	results   [][]byte
+	filenames []string
+	output    imgenc.Options
+}
+
+// JobStatus is a snapshot of the job, the results are only set when the job is done.
+type JobStatus struct {
+	State     JobState
+	Progress  int
+	ETA       time.Duration
+	Error     string
+	Finished  time.Time
+	Results   [][]byte
+	Filenames []string
+	Output    imgenc.Options
+}
+
+func NewJob(userID int64, username string) *Job {
+	return &Job{
+		UserID:   userID,
+		Username: username,
+		Created:  time.Now(),
+		state:    JobStateQueued,
+	}
+}
+
+func (j *Job) Snapshot() JobStatus {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	s := JobStatus{
+		State:    j.state,
+		Progress: j.progress,
+		ETA:      j.eta,
+		Error:    j.err,
+		Finished: j.finished,
+	}
+	if j.state == JobStateDone {
+		s.Results = j.results
+		s.Filenames = j.filenames
+		s.Output = j.output
+	}
+	return s
+}
+
+func (j *Job) setState(state JobState) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.state = state
+	if state == JobStateDone {
+		j.progress = 100
+		j.eta = 0
+	}
+	if state != JobStateQueued && state != JobStateRunning {
+		j.finished = time.Now()
+	}
+}
+
+func (j *Job) Status(ctx context.Context, s Status) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if s.Started {
+		j.state = JobStateRunning
+	}
+	// Text only updates, like the upload status, keep the last progress.
+	if s.Progress > 0 {
+		j.progress = s.Progress
+		j.eta = s.ETA
+	}
+}
+
+func (j *Job) Previews() bool {
+	return false
+}
+
+// Jobs are queued with their input image, so this is never called.
+func (j *Job) AskForImage(ctx context.Context) {}
+
+// Results are added for each delivery, as a request can have more of them.
+func (j *Job) Deliver(ctx context.Context, r Result) ([]string, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.results = append(j.results, r.Imgs...)
+	j.filenames = append(j.filenames, r.Filenames...)
+	j.output = r.Output
+	return nil, nil
+}
+
+func (j *Job) Finished(ctx context.Context, err error) {
+	switch {
+	case err == nil:
+		j.setState(JobStateDone)
+	case errors.Is(err, ErrCanceled):
+		j.setState(JobStateCanceled)
+	default:
+		j.mutex.Lock()
+		j.err = err.Error()
+		j.mutex.Unlock()
+		j.setState(JobStateFailed)
+	}
+}
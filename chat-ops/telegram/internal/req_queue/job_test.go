@@ -0,0 +1,57 @@
+package reqqueue
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestJobState(t *testing.T) {
+	ctx := context.Background()
+	j := NewJob(1, "user")
+
+	// Queued, paused and maintenance statuses don't start the job.
+	j.Status(ctx, Status{Text: "queued", QueuePosition: 2})
+	j.Status(ctx, Status{Text: "paused"})
+	if s := j.Snapshot(); s.State != JobStateQueued {
+		t.Fatalf("held job is %s", s.State)
+	}
+
+	j.Status(ctx, Status{Text: "rendering", Started: true, Progress: 40})
+	if s := j.Snapshot(); s.State != JobStateRunning || s.Progress != 40 {
+		t.Fatalf("started job is %s at %d%%", s.State, s.Progress)
+	}
+	// Text only updates keep the progress.
+	j.Status(ctx, Status{Text: "uploading"})
+	if s := j.Snapshot(); s.State != JobStateRunning || s.Progress != 40 {
+		t.Fatalf("uploading job is %s at %d%%", s.State, s.Progress)
+	}
+
+	if _, err := j.Deliver(ctx, Result{Imgs: [][]byte{{1}}, Filenames: []string{"a.png"}}); err != nil {
+		t.Fatal(err)
+	}
+	j.Finished(ctx, nil)
+	s := j.Snapshot()
+	if s.State != JobStateDone || s.Progress != 100 || len(s.Results) != 1 || s.Finished.IsZero() {
+		t.Fatalf("unexpected done status %+v", s)
+	}
+}
+
+func TestJobFinishedErrors(t *testing.T) {
+	ctx := context.Background()
+
+	j := NewJob(1, "")
+	j.Finished(ctx, ErrCanceled)
+	if s := j.Snapshot(); s.State != JobStateCanceled {
+		t.Errorf("canceled job is %s", s.State)
+	}
+
+	j = NewJob(1, "")
+	if _, err := j.Deliver(ctx, Result{Imgs: [][]byte{{1}}}); err != nil {
+		t.Fatal(err)
+	}
+	j.Finished(ctx, errors.New("backend error"))
+	if s := j.Snapshot(); s.State != JobStateFailed || s.Error != "backend error" || s.Results != nil {
+		t.Errorf("unexpected failed status %+v", s)
+	}
+}
@@ -0,0 +1,58 @@
+package reqqueue
+
+import (
+	"context"
+	"html"
+	"log/slog"
+
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/consts"
+)
+
+// MaintenanceError rejects the requests in maintenance if they are not held.
+type MaintenanceError struct {
+	Message string
+}
+
+func (e *MaintenanceError) Error() string {
+	return consts.MaintenanceRejectedStr + e.Message
+}
+
+// SetMaintenance turns the maintenance mode on or off. In maintenance no new requests are processed after
+// the current one, the users of the waiting requests get the message. The message is plain text, it's
+// escaped for the Telegram statuses.
+func (q *ReqQueue) SetMaintenance(ctx context.Context, on bool, message string) {
+	if message == "" {
+		message = consts.MaintenanceDefaultMessageStr
+	}
+
+	q.mutex.Lock()
+	q.maintenance = on
+	q.maintenanceMessage = message
+	var waiting []ReqQueueEntry
+	status := q.maintenanceStatus()
+	if on {
+		slog.InfoContext(ctx, "maintenance mode on", "message", message)
+		waiting = q.waitingEntries()
+	} else {
+		slog.InfoContext(ctx, "maintenance mode off")
+	}
+	q.mutex.Unlock()
+
+	if on {
+		sendStatus(waiting, status)
+	} else {
+		q.notifyProcessor()
+	}
+}
+
+// Maintenance returns if the maintenance mode is on and its message.
+func (q *ReqQueue) Maintenance() (on bool, message string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.maintenance, q.maintenanceMessage
+}
+
+// Should be called with the mutex locked.
+func (q *ReqQueue) maintenanceStatus() Status {
+	return Status{Text: consts.MaintenanceStr + html.EscapeString(q.maintenanceMessage) + "\n" + consts.MaintenanceHeldStr}
+}
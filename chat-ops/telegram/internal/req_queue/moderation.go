@@ -0,0 +1,34 @@
+package reqqueue
+
+import (
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/moderation"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/reqparams"
+)
+
+// Adds the forced negative prompt of the chat to the params and checks the prompt. Upscales have no prompt.
+func (q *ReqQueue) moderate(e *ReqQueueEntry) error {
+	if q.Moderation == nil {
+		return nil
+	}
+
+	var negativePrompt string
+	switch p := e.Params.(type) {
+	case reqparams.ReqParamsRender:
+		p.NegativePrompt = q.Moderation.AddForcedNegative(e.ChatID, p.NegativePrompt)
+		negativePrompt = p.NegativePrompt
+		e.Params = p
+	case reqparams.ReqParamsKuka:
+		p.NegativePrompt = q.Moderation.AddForcedNegative(e.ChatID, p.NegativePrompt)
+		negativePrompt = p.NegativePrompt
+		e.Params = p
+	default:
+		return nil
+	}
+	return q.Moderation.Check(e.ctx, moderation.Request{
+		UserID:         e.UserID,
+		Username:       e.Username,
+		ChatID:         e.ChatID,
+		Prompt:         promptOf(e.Params),
+		NegativePrompt: negativePrompt,
+	})
+}
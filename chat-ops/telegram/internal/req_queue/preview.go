@@ -0,0 +1,52 @@
+package reqqueue
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/crc32"
+	"image"
+	_ "image/png"
+	"log/slog"
+
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/consts"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/imgenc"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/safety"
+	sdapi "github.com/kanootoko/stable-diffusion-telegram-bot/internal/sd_api"
+	_ "golang.org/x/image/webp"
+)
+
+// Converts the live preview to a small JPEG, as the WebUI sends PNG, JPEG or WebP previews depending on
+// its settings.
+func convertPreview(data []byte) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decode error: %w", err)
+	}
+	return imgenc.EncodeImage(img, imgenc.Options{Format: imgenc.FormatJPEG, Quality: consts.PreviewJPEGQuality}, "")
+}
+
+// Returns the current live preview if it changed since the last call, nil otherwise.
+func (q *ReqQueue) getNewPreview(ctx context.Context, sdApi *sdapi.SdAPIType) []byte {
+	e := q.currentEntry.entry
+	if !e.Delivery.Previews() || q.safetyPolicy(e) == safety.PolicyBlock {
+		return nil
+	}
+
+	data, err := sdApi.GetCurrentImage(ctx)
+	if err != nil || data == nil {
+		return nil
+	}
+	hash := crc32.ChecksumIEEE(data)
+	if hash == e.lastPreviewHash {
+		return nil
+	}
+	e.lastPreviewHash = hash
+
+	preview, err := convertPreview(data)
+	if err != nil {
+		slog.WarnContext(ctx, "preview error", "error", err)
+		return nil
+	}
+	return preview
+}
@@ -0,0 +1,403 @@
+package reqqueue
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/consts"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/imgenc"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/metrics"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/reqparams"
+	sdapi "github.com/kanootoko/stable-diffusion-telegram-bot/internal/sd_api"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/stats"
+)
+
+const testTimeout = 5 * time.Second
+
+// stubSD is a WebUI API which renders a 1x1 PNG. Renders block until release is called or the request is
+// canceled.
+type stubSD struct {
+	server     *httptest.Server
+	renders    chan struct{}
+	released   chan struct{}
+	releaseOne sync.Once
+	interrupts atomic.Int32
+}
+
+func newStubSD(t *testing.T) *stubSD {
+	var b bytes.Buffer
+	if err := png.Encode(&b, image.NewRGBA(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	img := base64.StdEncoding.EncodeToString(b.Bytes())
+
+	s := &stubSD{
+		renders:  make(chan struct{}, 10),
+		released: make(chan struct{}),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sdapi/v1/txt2img":
+			s.renders <- struct{}{}
+			select {
+			case <-s.released:
+			case <-r.Context().Done():
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]any{"images": []string{img}})
+		case "/sdapi/v1/interrupt":
+			s.interrupts.Add(1)
+		case "/sdapi/v1/progress":
+			_, _ = w.Write([]byte(`{"progress": 0.5, "eta_relative": 1}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(func() {
+		s.release()
+		s.server.Close()
+	})
+	return s
+}
+
+func (s *stubSD) release() {
+	s.releaseOne.Do(func() { close(s.released) })
+}
+
+func (s *stubSD) waitRender(t *testing.T) {
+	t.Helper()
+	select {
+	case <-s.renders:
+	case <-time.After(testTimeout):
+		t.Fatal("render not started")
+	}
+}
+
+func (s *stubSD) noRender(t *testing.T) {
+	t.Helper()
+	select {
+	case <-s.renders:
+		t.Fatal("render started")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func newTestQueue(t *testing.T, sd *stubSD) *ReqQueue {
+	q := &ReqQueue{ProcessTimeout: time.Minute}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	q.Init(ctx, &sdapi.SdAPIType{SdHost: sd.server.URL}, nil)
+	return q
+}
+
+func addRender(t *testing.T, q *ReqQueue, d Delivery) (uint64, error) {
+	t.Helper()
+	return q.Add(ReqQueueReq{
+		Type:     ReqTypeRender,
+		Delivery: d,
+		UserID:   1,
+		Params: reqparams.ReqParamsRender{
+			Prompt:     "test",
+			Width:      1,
+			Height:     1,
+			Steps:      1,
+			NumOutputs: 1,
+			BatchSize:  1,
+			Output:     imgenc.Options{Format: imgenc.FormatPNG},
+		},
+	})
+}
+
+func waitFinished(t *testing.T, d *MemoryDelivery) error {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for time.Now().Before(deadline) {
+		if finished, err := d.IsFinished(); finished {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("request not finished")
+	return nil
+}
+
+func lastStatus(d *MemoryDelivery) Status {
+	statuses := d.Statuses()
+	if len(statuses) == 0 {
+		return Status{}
+	}
+	return statuses[len(statuses)-1]
+}
+
+func TestAdd(t *testing.T) {
+	sd := newStubSD(t)
+	q := newTestQueue(t, sd)
+
+	first, second := &MemoryDelivery{}, &MemoryDelivery{}
+	if _, err := addRender(t, q, first); err != nil {
+		t.Fatal(err)
+	}
+	sd.waitRender(t)
+	if _, err := addRender(t, q, second); err != nil {
+		t.Fatal(err)
+	}
+	if s := lastStatus(second); s.QueuePosition != 1 {
+		t.Errorf("second request is at position %d", s.QueuePosition)
+	}
+
+	sd.release()
+	for _, d := range []*MemoryDelivery{first, second} {
+		if err := waitFinished(t, d); err != nil {
+			t.Fatal(err)
+		}
+		if len(d.Results()) != 1 || len(d.Results()[0].Imgs) != 1 {
+			t.Errorf("got %d results", len(d.Results()))
+		}
+		started := false
+		for _, s := range d.Statuses() {
+			started = started || s.Started
+		}
+		if !started {
+			t.Error("no started status")
+		}
+	}
+}
+
+func TestCancelEntry(t *testing.T) {
+	sd := newStubSD(t)
+	q := newTestQueue(t, sd)
+	var err error
+	if q.Stats, err = stats.NewStore("", stats.MaxPeriod); err != nil {
+		t.Fatal(err)
+	}
+
+	first, second := &MemoryDelivery{}, &MemoryDelivery{}
+	firstID, err := addRender(t, q, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd.waitRender(t)
+	secondID, err := addRender(t, q, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = q.CancelEntry(secondID); err != nil {
+		t.Fatal(err)
+	}
+	if err = waitFinished(t, second); !errors.Is(err, ErrCanceled) {
+		t.Errorf("waiting request finished with %v", err)
+	}
+	if err = q.CancelEntry(firstID); err != nil {
+		t.Fatal(err)
+	}
+	if err = waitFinished(t, first); !errors.Is(err, ErrCanceled) {
+		t.Errorf("current request finished with %v", err)
+	}
+	if sd.interrupts.Load() != 1 {
+		t.Errorf("backend interrupted %d times", sd.interrupts.Load())
+	}
+	if err = q.CancelEntry(firstID); err == nil {
+		t.Error("canceled a finished request")
+	}
+	records := q.Stats.Since(time.Time{})
+	if len(records) != 2 || records[0].Outcome != metrics.OutcomeCanceled || records[1].Outcome != metrics.OutcomeCanceled {
+		t.Errorf("got stats records %+v", records)
+	}
+}
+
+func TestPause(t *testing.T) {
+	sd := newStubSD(t)
+	sd.release()
+	q := newTestQueue(t, sd)
+
+	q.Pause(context.Background())
+	d := &MemoryDelivery{}
+	job := NewJob(1, "")
+	if _, err := addRender(t, q, d); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := addRender(t, q, job); err != nil {
+		t.Fatal(err)
+	}
+	sd.noRender(t)
+	if s := lastStatus(d); s.Text != consts.QueuePausedStr {
+		t.Errorf("paused request status is %q", s.Text)
+	}
+	if s := job.Snapshot(); s.State != JobStateQueued {
+		t.Errorf("paused job is %s", s.State)
+	}
+
+	q.Resume(context.Background())
+	if err := waitFinished(t, d); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	sd := newStubSD(t)
+	sd.release()
+	q := newTestQueue(t, sd)
+	q.MaintenanceHold = true
+
+	q.SetMaintenance(context.Background(), true, "new GPU <3 & more")
+	d := &MemoryDelivery{}
+	if _, err := addRender(t, q, d); err != nil {
+		t.Fatal(err)
+	}
+	sd.noRender(t)
+	if s := lastStatus(d); !strings.Contains(s.Text, "new GPU &lt;3 &amp; more") {
+		t.Errorf("held request status is %q", s.Text)
+	}
+
+	q.SetMaintenance(context.Background(), false, "")
+	if err := waitFinished(t, d); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaintenanceReject(t *testing.T) {
+	sd := newStubSD(t)
+	q := newTestQueue(t, sd)
+
+	q.SetMaintenance(context.Background(), true, "new GPU <3 & more")
+	d := &MemoryDelivery{}
+	_, err := addRender(t, q, d)
+	var maintenanceErr *MaintenanceError
+	if !errors.As(err, &maintenanceErr) || maintenanceErr.Message != "new GPU <3 & more" {
+		t.Fatalf("got %v", err)
+	}
+	if finished, finishErr := d.IsFinished(); !finished || finishErr != err {
+		t.Errorf("rejected request finished %v with %v", finished, finishErr)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	sd := newStubSD(t)
+	q := newTestQueue(t, sd)
+
+	first, second := &MemoryDelivery{}, &MemoryDelivery{}
+	if _, err := addRender(t, q, first); err != nil {
+		t.Fatal(err)
+	}
+	sd.waitRender(t)
+	if _, err := addRender(t, q, second); err != nil {
+		t.Fatal(err)
+	}
+
+	go q.Drain(context.Background())
+	// The current request is finished before the waiting ones are canceled.
+	time.Sleep(100 * time.Millisecond)
+	if _, err := addRender(t, q, &MemoryDelivery{}); !errors.Is(err, ErrRestarting) {
+		t.Errorf("request added while draining got %v", err)
+	}
+	sd.release()
+	if err := waitFinished(t, first); err != nil {
+		t.Errorf("current request finished with %v", err)
+	}
+	if err := waitFinished(t, second); !errors.Is(err, ErrRestarting) {
+		t.Errorf("waiting request finished with %v", err)
+	}
+	select {
+	case <-q.Drained():
+	case <-time.After(testTimeout):
+		t.Fatal("not drained")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	sd := newStubSD(t)
+	q := newTestQueue(t, sd)
+
+	first, second := &MemoryDelivery{}, &MemoryDelivery{}
+	if _, err := addRender(t, q, first); err != nil {
+		t.Fatal(err)
+	}
+	sd.waitRender(t)
+	if _, err := addRender(t, q, second); err != nil {
+		t.Fatal(err)
+	}
+
+	q.Shutdown()
+	for _, d := range []*MemoryDelivery{first, second} {
+		if finished, err := d.IsFinished(); !finished || !errors.Is(err, ErrRestarting) {
+			t.Errorf("request finished %v with %v", finished, err)
+		}
+	}
+	if sd.interrupts.Load() != 1 {
+		t.Errorf("backend interrupted %d times", sd.interrupts.Load())
+	}
+	if _, err := addRender(t, q, &MemoryDelivery{}); !errors.Is(err, ErrRestarting) {
+		t.Errorf("request added after shutdown got %v", err)
+	}
+}
+
+// blockingDelivery blocks the status updates once blocking is set, like a delivery waiting for Telegram
+// flood control.
+type blockingDelivery struct {
+	MemoryDelivery
+	blocking atomic.Bool
+	blocked  chan struct{}
+	release  chan struct{}
+}
+
+func (d *blockingDelivery) Status(ctx context.Context, s Status) {
+	if d.blocking.Load() {
+		d.blocked <- struct{}{}
+		<-d.release
+	}
+	d.MemoryDelivery.Status(ctx, s)
+}
+
+func TestBlockingDelivery(t *testing.T) {
+	sd := newStubSD(t)
+	q := newTestQueue(t, sd)
+
+	if _, err := addRender(t, q, &MemoryDelivery{}); err != nil {
+		t.Fatal(err)
+	}
+	sd.waitRender(t)
+	d := &blockingDelivery{blocked: make(chan struct{}), release: make(chan struct{})}
+	if _, err := addRender(t, q, d); err != nil {
+		t.Fatal(err)
+	}
+
+	d.blocking.Store(true)
+	go q.Pause(context.Background())
+	select {
+	case <-d.blocked:
+	case <-time.After(testTimeout):
+		t.Fatal("status not sent")
+	}
+
+	// The queue is usable while the delivery is blocked.
+	done := make(chan error)
+	go func() {
+		id, err := addRender(t, q, &MemoryDelivery{})
+		if err == nil {
+			err = q.CancelEntry(id)
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(testTimeout):
+		t.Error("queue blocked by a delivery")
+	}
+	close(d.release)
+}
@@ -1,23 +1,31 @@
 package reqqueue
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
-	"image/jpeg"
-	"image/png"
+	_ "image/jpeg"
+	"log/slog"
 	"math/rand"
-	"regexp"
-	"strconv"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/go-telegram/bot/models"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/archive"
 	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/consts"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/history"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/imgenc"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/infotext"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/logging"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/metrics"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/moderation"
 	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/reqparams"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/safety"
 	sdapi "github.com/kanootoko/stable-diffusion-telegram-bot/internal/sd_api"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/stats"
 	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/telegram"
 	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/utils"
 )
@@ -30,143 +38,98 @@ const (
 	ReqTypeKuka
 )
 
+func (t ReqType) String() string {
+	switch t {
+	case ReqTypeRender:
+		return "render"
+	case ReqTypeUpscale:
+		return "upscale"
+	case ReqTypeKuka:
+		return "kuka"
+	}
+	return "unknown"
+}
+
 type ReqQueueEntry struct {
 	Type   ReqType
 	Params reqparams.ReqParams
 	TaskID uint64
 
-	bot          *telegram.SDBot
-	ReplyMessage *models.Message
-	Message      *models.Message
+	// The sender of the request. For requests not coming from a chat, the chat ID is the user ID.
+	UserID   int64
+	Username string
+	ChatID   int64
+
+	Delivery Delivery
+	// Carries the task ID for the log records.
+	ctx context.Context
+	// The input image if it was sent with the request.
+	image *telegram.ImageFileData
+
+	queuedAt  time.Time
+	queueWait time.Duration
+	// Time spent by the backend processing the request.
+	processDuration time.Duration
+
+	lastPreviewHash uint32
+	// Set if the request was flagged by the safety checks.
+	nsfwReason string
+
+	// IDs of the delivered files.
+	resultFileIDs []string
+	imageCount    int
 }
 
-func (e *ReqQueueEntry) checkWaitError(err error) time.Duration {
-	var retryRegex = regexp.MustCompile(`{"retry_after":([0-9]+)}`)
-	match := retryRegex.FindStringSubmatch(err.Error())
-	if len(match) < 2 {
-		return 0
-	}
-
-	retryAfter, err := strconv.Atoi(match[1])
-	if err != nil {
-		return 0
-	}
-	return time.Duration(retryAfter) * time.Second
+func (e *ReqQueueEntry) sendStatus(ctx context.Context, text string) {
+	e.Delivery.Status(ctx, Status{Text: text})
 }
 
-func (e *ReqQueueEntry) sendReply(ctx context.Context, text string) {
-	if e.ReplyMessage == nil {
-		e.ReplyMessage = e.bot.SendReplyToMessage(ctx, e.Message, text)
-	} else if e.ReplyMessage.Text != text {
-		e.ReplyMessage.Text = text
-		err := e.bot.EditMessage(ctx, e.ReplyMessage, text)
-		if err != nil {
-			fmt.Println("  reply edit error:", err)
-
-			waitNeeded := e.checkWaitError(err)
-			fmt.Println("  waiting", waitNeeded, "...")
-			time.Sleep(waitNeeded)
-		}
-	}
-}
-
-func (e *ReqQueueEntry) convertImagesFromPNGToJPG(imgs [][]byte) error {
+// Converts the images to the output format and embeds the infotexts into them, so they carry their
+// generation params. The last infotext is used for the images without an own one. Images exceeding the
+// Telegram upload limit are downscaled.
+func (e *ReqQueueEntry) encodeImages(imgs [][]byte, output imgenc.Options, infotexts []infotext.Infotext) (err error) {
 	for i := range imgs {
-		p, err := png.Decode(bytes.NewReader(imgs[i]))
-		if err != nil {
-			fmt.Println("  png decode error:", err)
-			return fmt.Errorf("png decode error: %w", err)
+		var text string
+		if len(infotexts) > 0 {
+			text = infotexts[min(i, len(infotexts)-1)].String()
 		}
-		buf := new(bytes.Buffer)
-		err = jpeg.Encode(buf, p, &jpeg.Options{Quality: 80})
-		if err != nil {
-			fmt.Println("  jpg decode error:", err)
-			return fmt.Errorf("jpg decode error: %w", err)
+		if imgs[i], err = imgenc.EncodeWithMaxSize(imgs[i], output, text, consts.TelegramDocumentMaxSize); err != nil {
+			return err
 		}
-		imgs[i] = buf.Bytes()
 	}
 	return nil
 }
 
-// If filename is empty then a filename will be automatically generated.
-func (e *ReqQueueEntry) uploadImages(
-	ctx context.Context,
-	firstImageID uint32,
-	description string,
-	imgs [][]byte,
-	filename string,
-	retryAllowed bool,
-	sendPNGs bool,
-) error {
-	fileExt := "jpg"
-	if sendPNGs {
-		fileExt = "png"
-	}
-	if len(imgs) == 0 {
-		fmt.Println("  error: nothing to upload")
-		return fmt.Errorf("nothing to upload")
-	}
-
-	generateFilename := (filename == "")
-
-	caption := description
-	if len(caption) > 1024 {
-		caption = caption[:1021] + "..."
-	}
-	var err error
-	var media []models.InputMedia
-	for i := range imgs {
-		if generateFilename {
-			filename = fmt.Sprintf("sd-image-%d-%d-%d.%s", firstImageID, e.TaskID, i, fileExt)
-		}
-		if sendPNGs {
-			media = append(media, &models.InputMediaDocument{
-				Media:           "attach://" + filename,
-				MediaAttachment: bytes.NewReader(imgs[i]),
-				ParseMode:       models.ParseModeHTML,
-				Caption:         caption,
-			})
-		} else {
-			media = append(media, &models.InputMediaPhoto{
-				Media:           "attach://" + filename,
-				MediaAttachment: bytes.NewReader(imgs[i]),
-				ParseMode:       models.ParseModeHTML,
-				Caption:         caption,
-			})
+// Returns the filenames of the result images. If filename is empty then filenames will be automatically
+// generated.
+func (e *ReqQueueEntry) resultFilenames(count int, firstImageID uint32, filename string, output imgenc.Options) []string {
+	filenames := make([]string, count)
+	for i := range filenames {
+		filenames[i] = filename
+		if filename == "" {
+			filenames[i] = fmt.Sprintf("sd-image-%d-%d-%d.%s", firstImageID, e.TaskID, i, output.Ext())
 		}
-		caption = ""
 	}
-
-	err = e.bot.SendMediaGroup(ctx, e.Message, media)
-	if err != nil {
-		fmt.Println("  send images error:", err)
-
-		if !retryAllowed {
-			return fmt.Errorf("send images error: %w", err)
-		}
-
-		retryAfter := e.checkWaitError(err)
-		if retryAfter > 0 {
-			fmt.Println("  retrying after", retryAfter, "...")
-			time.Sleep(retryAfter)
-			return e.uploadImages(ctx, firstImageID, description, imgs, filename, false, sendPNGs)
-		}
-	}
-	return nil
+	return filenames
 }
 
-func (e *ReqQueueEntry) deleteReply(ctx context.Context) {
-	if e.ReplyMessage == nil {
-		return
+func (e *ReqQueueEntry) deliver(ctx context.Context, r Result) error {
+	fileIDs, err := e.Delivery.Deliver(ctx, r)
+	e.resultFileIDs = append(e.resultFileIDs, fileIDs...)
+	if err == nil {
+		e.imageCount += len(r.Imgs)
+		metrics.ImagesDelivered.WithLabelValues(e.Type.String()).Add(float64(len(r.Imgs)))
 	}
-
-	_ = e.bot.DeleteMessage(ctx, e.ReplyMessage)
+	return err
 }
 
 type ReqQueueCurrentEntry struct {
-	entry     *ReqQueueEntry
-	canceled  bool
-	ctxCancel context.CancelFunc
+	entry    *ReqQueueEntry
+	canceled bool
+	// Set if it was interrupted by the shutdown, see Shutdown.
+	restarting bool
+	uploading  bool
+	ctxCancel  context.CancelFunc
 
 	imgsChan    chan [][]byte
 	errChan     chan error
@@ -184,12 +147,55 @@ type ReqQueue struct {
 	ProcessTimeout time.Duration
 
 	currentEntry ReqQueueCurrentEntry
+	// Set while the first entry is being processed, it's not if the queue is held.
+	processing bool
+	// Unix nanoseconds of the last beat of the processor, see Alive.
+	heartbeat atomic.Int64
+
+	// Completed requests are recorded here if set.
+	History *history.Store
+	// The original images of completed requests are saved here if set.
+	Archive *archive.Archive
+	// Prompts are checked before queueing if set.
+	Moderation *moderation.Moderator
+	// Request outcomes are recorded here if set.
+	Stats *stats.Store
+	// Prompts and results are checked for NSFW content if set, blocked requests are reported to the admins.
+	Safety       *safety.Checker
+	AdminUserIDs []int64
+
+	// Requests added in maintenance are queued until it's over if set, rejected otherwise.
+	MaintenanceHold    bool
+	maintenance        bool
+	maintenanceMessage string
+	paused             bool
+	draining           bool
+	// Closed when the draining is done.
+	drained chan struct{}
+
+	gridResultsMutex sync.Mutex
+	gridResults      []GridResult
 }
 
+// ReqQueueReq is a request from a Telegram message, or from another frontend if the delivery is set.
 type ReqQueueReq struct {
 	Type    ReqType
 	Message *models.Message
 	Params  reqparams.ReqParams
+
+	// For requests not coming from a Telegram message.
+	Delivery Delivery
+	UserID   int64
+	Username string
+	// Upscale and img2img requests ask for the image if it's not set.
+	Image *telegram.ImageFileData
+	// Generated if not set. Handlers set it to the ID they log with, so the log records of the request can be
+	// correlated.
+	TaskID uint64
+}
+
+func NewTaskID() uint64 {
+	return rand.Uint64()
 }
 
 func (q *ReqQueue) CurrentEntryParams() reqparams.ReqParams {
@@ -198,65 +204,132 @@ func (q *ReqQueue) CurrentEntryParams() reqparams.ReqParams {
 
 func (q *ReqQueue) GotImage(ctx context.Context, updateMsg *models.Message, imageData *telegram.ImageFileData) {
 	// Updating the message to reply to this document.
-	q.currentEntry.entry.Message = updateMsg
-	q.currentEntry.entry.ReplyMessage = nil
+	if d, ok := q.currentEntry.entry.Delivery.(*TelegramDelivery); ok {
+		d.ReplyTo(updateMsg)
+	}
 	// Notifying the request queue that we now got the image data.
 	q.currentEntry.gotImageChan <- *imageData
 }
 
 func (q *ReqQueue) SendReplyToCurrentEntry(ctx context.Context, text string) {
-	q.currentEntry.entry.sendReply(ctx, text)
+	q.currentEntry.entry.sendStatus(ctx, text)
 }
 
 func (q *ReqQueue) IsImageForMessage(msg *models.Message) bool {
-	return q.currentEntry.gotImageChan != nil && msg.From.ID == q.currentEntry.entry.Message.From.ID
+	return q.currentEntry.gotImageChan != nil && msg.From.ID == q.currentEntry.entry.UserID
 }
 
 func (q *ReqQueue) IsCurrentEntryChat() bool {
-	return q.currentEntry.entry.Message.Chat.ID >= 0
+	return q.currentEntry.entry.ChatID >= 0
 }
 
-func (q *ReqQueue) Add(req ReqQueueReq) {
-	q.mutex.Lock()
-
+// Add queues the request and returns its task ID. Requests rejected by the moderation, in maintenance if they
+// are not held or while draining are not queued, the delivery is notified about the error.
+func (q *ReqQueue) Add(req ReqQueueReq) (uint64, error) {
 	newEntry := ReqQueueEntry{
 		Type:   req.Type,
 		Params: req.Params,
-		TaskID: rand.Uint64(),
+		TaskID: req.TaskID,
+
+		Delivery: req.Delivery,
+		UserID:   req.UserID,
+		Username: req.Username,
+		ChatID:   req.UserID,
+		image:    req.Image,
+		queuedAt: time.Now(),
+	}
+	if req.Message != nil {
+		newEntry.Delivery = NewTelegramDelivery(q.bot, req.Message)
+		newEntry.UserID = req.Message.From.ID
+		newEntry.Username = req.Message.From.Username
+		newEntry.ChatID = req.Message.Chat.ID
+	}
+	if newEntry.TaskID == 0 {
+		newEntry.TaskID = NewTaskID()
+	}
+	// The entry is notified on shutdown after the queue context is canceled, see Shutdown.
+	newEntry.ctx = logging.WithTaskID(context.WithoutCancel(q.ctx), newEntry.TaskID)
 
-		bot:     q.bot,
-		Message: req.Message,
+	err := q.checkAccepting()
+	if err == nil {
+		err = q.moderate(&newEntry)
+	}
+	if err != nil {
+		metrics.Requests.WithLabelValues(newEntry.Type.String(), metrics.OutcomeRejected).Inc()
+		q.recordStats(&newEntry, metrics.OutcomeRejected)
+		newEntry.Delivery.Finished(newEntry.ctx, err)
+		return 0, err
 	}
 
-	if len(q.entries) > 0 {
-		fmt.Println("  queueing request at position #", len(q.entries))
-		newEntry.sendReply(q.ctx, q.getQueuePositionString(len(q.entries)))
+	// The status is sent after unlocking, as the delivery can block for long.
+	var status Status
+	q.mutex.Lock()
+	if q.maintenance {
+		slog.InfoContext(newEntry.ctx, "holding request for maintenance", "position", len(q.entries))
+		status = q.maintenanceStatus()
+	} else if q.paused {
+		slog.InfoContext(newEntry.ctx, "queueing request while paused", "position", len(q.entries))
+		status = Status{Text: consts.QueuePausedStr}
+	} else if len(q.entries) > 0 {
+		slog.InfoContext(newEntry.ctx, "queueing request", "position", len(q.entries))
+		status = q.queuePositionStatus(len(q.entries))
 	}
 
 	q.entries = append(q.entries, newEntry)
+	metrics.QueueLength.Set(float64(len(q.entries)))
 	q.mutex.Unlock()
 
-	select {
-	case q.processReqChan <- true:
-	default:
+	if status.Text != "" {
+		newEntry.Delivery.Status(newEntry.ctx, status)
 	}
+	q.notifyProcessor()
+	return newEntry.TaskID, nil
 }
 
 func (q *ReqQueue) CancelCurrentEntry(ctx context.Context) (err error) {
 	q.mutex.Lock()
-	if len(q.entries) > 0 {
+	if q.processing {
 		q.currentEntry.canceled = true
 		q.currentEntry.ctxCancel()
 	} else {
-		fmt.Println("  no active request to cancel")
+		slog.Info("no active request to cancel")
 		err = fmt.Errorf("no active request to cancel")
 	}
 	q.mutex.Unlock()
 	return
 }
 
-func (q *ReqQueue) getQueuePositionString(pos int) string {
-	return "👨‍👦‍👦 Request queued at position #" + fmt.Sprint(pos)
+// CancelEntry cancels the request with the given task ID, it's removed from the queue if it's not being
+// processed yet.
+func (q *ReqQueue) CancelEntry(taskID uint64) error {
+	q.mutex.Lock()
+	for i := range q.entries {
+		if q.entries[i].TaskID != taskID {
+			continue
+		}
+		if i == 0 && q.processing {
+			q.currentEntry.canceled = true
+			q.currentEntry.ctxCancel()
+			q.mutex.Unlock()
+			return nil
+		}
+		canceled := q.entries[i]
+		q.entries = slices.Delete(q.entries, i, i+1)
+		metrics.QueueLength.Set(float64(len(q.entries)))
+		q.mutex.Unlock()
+
+		q.finishEntries([]ReqQueueEntry{canceled}, ErrCanceled)
+		return nil
+	}
+	q.mutex.Unlock()
+	return fmt.Errorf("request not found in the queue")
+}
+
+func (q *ReqQueue) queuePositionStatus(pos int) Status {
+	return Status{
+		Text:          "👨‍👦‍👦 Request queued at position #" + fmt.Sprint(pos),
+		QueuePosition: pos,
+	}
 }
 
 func (q *ReqQueue) queryProgress(ctx context.Context, sdApi *sdapi.SdAPIType, prevProgressPercent int) (progressPercent int, eta time.Duration, err error) {
@@ -271,7 +344,7 @@ func (q *ReqQueue) queryProgress(ctx context.Context, sdApi *sdapi.SdAPIType, pr
 		} else if progressPercent < 0 {
 			progressPercent = 0
 		}
-		fmt.Print("    progress: ", progressPercent, "% eta: ", eta.Round(time.Second), "\n")
+		slog.DebugContext(ctx, "progress", "percent", progressPercent, "eta", eta.Round(time.Second))
 	}
 	return
 }
@@ -289,7 +362,7 @@ func (q *ReqQueue) runProcessThread(processCtx context.Context, processFn ReqQue
 	}
 
 	if errors.Is(err, syscall.ECONNREFUSED) { // Can't connect to Stable Diffusion?
-		fmt.Println("  error: Stable Diffusion is not running and start is disabled, waiting...")
+		slog.WarnContext(processCtx, "stable diffusion is not running and start is disabled, waiting")
 		time.Sleep(30 * time.Second)
 		if retryAllowed {
 			q.runProcessThread(processCtx, processFn, reqParams, imageData, false, imgsChan, errChan, stoppedChan)
@@ -297,7 +370,6 @@ func (q *ReqQueue) runProcessThread(processCtx context.Context, processFn ReqQue
 		}
 
 		err = fmt.Errorf("error: Stable Diffusion is not running and start is disabled")
-		fmt.Println("  error:", err)
 	}
 
 	errChan <- err
@@ -312,17 +384,26 @@ func (q *ReqQueue) runProcess(
 	imageData telegram.ImageFileData,
 	reqParamsText string,
 ) (imgs [][]byte, err error) {
-	q.currentEntry.entry.sendReply(q.ctx, consts.ProcessStartStr+"\n"+reqParamsText)
+	startedAt := time.Now()
+	defer func() {
+		if err == nil {
+			q.currentEntry.entry.processDuration += time.Since(startedAt)
+		}
+	}()
+	q.currentEntry.entry.Delivery.Status(q.currentEntry.entry.ctx, Status{
+		Text:    consts.ProcessStartStr + "\n" + reqParamsText,
+		Started: true,
+	})
 
 	q.currentEntry.imgsChan = make(chan [][]byte)
 	q.currentEntry.errChan = make(chan error, 1)
 	q.currentEntry.stoppedChan = make(chan bool, 1)
 
 	go q.runProcessThread(processCtx, processFn, reqParams, imageData, true, q.currentEntry.imgsChan, q.currentEntry.errChan, q.currentEntry.stoppedChan)
-	fmt.Println("  render started")
+	slog.InfoContext(processCtx, "render started")
 
 	progressUpdateInterval := consts.GroupChatProgressUpdateInterval
-	if q.currentEntry.entry.Message.Chat.ID >= 0 {
+	if q.currentEntry.entry.ChatID >= 0 {
 		progressUpdateInterval = consts.PrivateChatProgressUpdateInterval
 	}
 	progressPercentUpdateTicker := time.NewTicker(progressUpdateInterval)
@@ -349,8 +430,16 @@ func (q *ReqQueue) runProcess(
 		case <-processCtx.Done():
 			return nil, fmt.Errorf("timeout")
 		case <-progressPercentUpdateTicker.C:
-			q.currentEntry.entry.sendReply(q.ctx, consts.ProcessStr+" "+utils.GetProgressbar(progressPercent, consts.ProgressBarLength)+" ETA: "+fmt.Sprint(eta.Round(time.Second))+"\n"+reqParamsText)
+			q.currentEntry.entry.Delivery.Status(q.currentEntry.entry.ctx, Status{
+				Text:     consts.ProcessStr + " " + utils.GetProgressbar(progressPercent, consts.ProgressBarLength) + " ETA: " + fmt.Sprint(eta.Round(time.Second)) + "\n" + reqParamsText,
+				Started:  true,
+				Progress: progressPercent,
+				ETA:      eta,
+				Preview:  q.getNewPreview(processCtx, sdApi),
+				Spoiler:  q.safetyPolicy(q.currentEntry.entry) != safety.PolicyAllow,
+			})
 		case <-progressCheckTicker.C:
+			q.beat()
 			progressPercent, eta, _ = q.queryProgress(processCtx, sdApi, progressPercent)
 		case err = <-q.currentEntry.errChan:
 			return nil, err
@@ -368,23 +457,39 @@ func (q *ReqQueue) upscale(processCtx context.Context, sdApi *sdapi.SdAPIType, r
 		return err
 	}
 
-	fn := utils.FilenameWithoutExt(imageData.Filename) + "-upscaled"
-	if !reqParams.OutputPNG {
-		err = q.currentEntry.entry.convertImagesFromPNGToJPG(imgs)
-		if err != nil {
-			return err
-		}
-		fn += ".jpg"
-	} else {
-		fn += ".png"
+	// Keeping the params of the original image if it has them, nothing is embedded otherwise.
+	var infotexts []infotext.Infotext
+	if it, err := infotext.FromImage(imageData.Data); err == nil {
+		reqParams.AddToInfotext(&it)
+		infotexts = []infotext.Infotext{it}
+	} else if !errors.Is(err, infotext.ErrNotFound) {
+		slog.DebugContext(processCtx, "can't read the infotext of the upscaled image", "error", err)
 	}
 
-	fmt.Println("  uploading...")
-	q.currentEntry.entry.sendReply(q.ctx, consts.UploadingStr+"\n"+reqParamsText)
+	fn := utils.FilenameWithoutExt(imageData.Filename) + "-upscaled"
+	originals := slices.Clone(imgs)
+	spoiler, err := q.checkResultSafety(q.currentEntry.entry, originals)
+	if err != nil {
+		return err
+	}
+	err = q.currentEntry.entry.encodeImages(imgs, reqParams.Output, infotexts)
+	if err != nil {
+		return err
+	}
 
-	err = q.currentEntry.entry.uploadImages(q.ctx, 0, "", imgs, fn, true, reqParams.OutputPNG)
+	slog.InfoContext(processCtx, "uploading")
+	q.setUploading()
+	q.currentEntry.entry.sendStatus(q.currentEntry.entry.ctx, consts.UploadingStr+"\n"+reqParamsText)
+
+	err = q.currentEntry.entry.deliver(q.currentEntry.entry.ctx, Result{
+		TaskID:    q.currentEntry.entry.TaskID,
+		Imgs:      imgs,
+		Filenames: q.currentEntry.entry.resultFilenames(len(imgs), 0, fn+"."+reqParams.Output.Ext(), reqParams.Output),
+		Output:    reqParams.Output,
+		Spoiler:   spoiler,
+	})
 	if err == nil {
-		q.currentEntry.entry.deleteReply(q.ctx)
+		q.archiveResults(originals, archiveFilenames(fmt.Sprintf("%s-%d", fn, q.currentEntry.entry.TaskID), len(originals)), infotexts)
 	}
 	return err
 }
@@ -403,7 +508,7 @@ func (q *ReqQueue) render(processCtx context.Context, sdApi *sdapi.SdAPIType, re
 			OriginalPromptText: reqParams.OriginalPrompt(),
 			Scale:              reqParams.Upscale.Scale,
 			Upscaler:           reqParams.Upscale.Upscaler,
-			OutputPNG:          reqParams.OutputPNG,
+			Output:             reqParams.Output,
 		}
 		imgs, err = q.runProcess(processCtx, sdApi, sdApi.Upscale, reqParamsUpscale, telegram.ImageFileData{Data: imgs[0], Filename: ""}, reqParamsUpscale.String())
 		if err != nil {
@@ -411,26 +516,55 @@ func (q *ReqQueue) render(processCtx context.Context, sdApi *sdapi.SdAPIType, re
 		}
 	}
 
-	if !reqParams.OutputPNG {
-		err = q.currentEntry.entry.convertImagesFromPNGToJPG(imgs)
-		if err != nil {
+	// The grid is composed from the rendered PNGs before they get converted.
+	var grid []byte
+	if reqParams.Grid && len(imgs) > 1 {
+		if grid, err = composeGrid(imgs, reqParams.Seed); err != nil {
 			return err
 		}
 	}
 
-	fmt.Println("  uploading...")
-	q.currentEntry.entry.sendReply(q.ctx, consts.UploadingStr+"\n"+reqParamsText)
+	infotexts := make([]infotext.Infotext, len(imgs))
+	for i := range imgs {
+		infotexts[i] = reqParams.Infotext(i)
+	}
+	originals := slices.Clone(imgs)
+	spoiler, err := q.checkResultSafety(q.currentEntry.entry, originals)
+	if err != nil {
+		return err
+	}
+	err = q.currentEntry.entry.encodeImages(imgs, reqParams.Output, infotexts)
+	if err != nil {
+		return err
+	}
 
-	err = q.currentEntry.entry.uploadImages(q.ctx, reqParams.Seed, reqParams.OriginalPrompt()+"\n"+reqParamsText, imgs, "", true, reqParams.OutputPNG)
+	slog.InfoContext(processCtx, "uploading")
+	q.setUploading()
+	q.currentEntry.entry.sendStatus(q.currentEntry.entry.ctx, consts.UploadingStr+"\n"+reqParamsText)
+
+	r := Result{
+		TaskID:      q.currentEntry.entry.TaskID,
+		Imgs:        imgs,
+		Filenames:   q.currentEntry.entry.resultFilenames(len(imgs), reqParams.Seed, "", reqParams.Output),
+		Output:      reqParams.Output,
+		Description: reqParams.OriginalPrompt() + "\n" + reqParamsText,
+		Grid:        grid,
+		Spoiler:     spoiler,
+	}
+	if grid != nil {
+		q.storeGridResult(GridResult{TaskID: r.TaskID, Imgs: r.Imgs, Filenames: r.Filenames, Output: r.Output, Spoiler: r.Spoiler})
+	}
+	err = q.currentEntry.entry.deliver(q.currentEntry.entry.ctx, r)
 	if err == nil {
-		q.currentEntry.entry.deleteReply(q.ctx)
+		q.archiveResults(originals, archiveFilenames(fmt.Sprintf("sd-image-%d-%d", reqParams.Seed, q.currentEntry.entry.TaskID), len(originals)), infotexts)
 	}
 	return err
 }
 
 func (q *ReqQueue) processQueueEntry(processCtx context.Context, sdApi *sdapi.SdAPIType, imageData telegram.ImageFileData) error {
-	fmt.Print("processing request from ", q.currentEntry.entry.Message.From.Username, "#",
-		q.currentEntry.entry.Message.From.ID, ": ", q.currentEntry.entry.Params.OriginalPrompt(), "\n")
+	e := q.currentEntry.entry
+	slog.InfoContext(processCtx, "processing request", "type", e.Type.String(), "user", e.Username, "user_id", e.UserID, "chat_id", e.ChatID)
+	slog.DebugContext(processCtx, "request prompt", "prompt", e.Params.OriginalPrompt())
 
 	switch q.currentEntry.entry.Type {
 	case ReqTypeRender:
@@ -455,45 +589,80 @@ func (q *ReqQueue) kukafy(processCtx context.Context, sdApi *sdapi.SdAPIType, re
 	}
 
 	fn := utils.FilenameWithoutExt(imageData.Filename) + "-kukafied"
-	if !reqParams.OutputPNG {
-		err = q.currentEntry.entry.convertImagesFromPNGToJPG(imgs)
-		if err != nil {
-			return err
-		}
-		fn += ".jpg"
-	} else {
-		fn += ".png"
+	originals := slices.Clone(imgs)
+	spoiler, err := q.checkResultSafety(q.currentEntry.entry, originals)
+	if err != nil {
+		return err
+	}
+	infotexts := []infotext.Infotext{reqParams.Infotext()}
+	err = q.currentEntry.entry.encodeImages(imgs, reqParams.Output, infotexts)
+	if err != nil {
+		return err
 	}
 
-	fmt.Println("  uploading...")
-	q.currentEntry.entry.sendReply(q.ctx, consts.UploadingStr+"\n"+reqParamsText)
-
-	err = q.currentEntry.entry.uploadImages(q.ctx, 0, "", imgs, fn, true, reqParams.OutputPNG)
+	slog.InfoContext(processCtx, "uploading")
+	q.setUploading()
+	q.currentEntry.entry.sendStatus(q.currentEntry.entry.ctx, consts.UploadingStr+"\n"+reqParamsText)
+
+	err = q.currentEntry.entry.deliver(q.currentEntry.entry.ctx, Result{
+		TaskID:    q.currentEntry.entry.TaskID,
+		Imgs:      imgs,
+		Filenames: q.currentEntry.entry.resultFilenames(len(imgs), 0, fn+"."+reqParams.Output.Ext(), reqParams.Output),
+		Output:    reqParams.Output,
+		Spoiler:   spoiler,
+	})
 	if err == nil {
-		q.currentEntry.entry.deleteReply(q.ctx)
+		q.archiveResults(originals, archiveFilenames(fmt.Sprintf("%s-%d", fn, q.currentEntry.entry.TaskID), len(originals)), infotexts)
 	}
 	return err
 }
+func (q *ReqQueue) beat() {
+	q.heartbeat.Store(time.Now().UnixNano())
+}
+
+// Alive returns an error if the processor goroutine didn't beat for longer than a request can take.
+func (q *ReqQueue) Alive() error {
+	if q.heartbeat.Load() == 0 {
+		return fmt.Errorf("processor not started")
+	}
+	since := time.Since(time.Unix(0, q.heartbeat.Load()))
+	if since > q.ProcessTimeout+consts.ProcessorStallGrace {
+		return fmt.Errorf("processor stalled, last heartbeat %v ago", since.Round(time.Second))
+	}
+	return nil
+}
+
 func (q *ReqQueue) processor(sdApi *sdapi.SdAPIType) {
+	heartbeatTicker := time.NewTicker(consts.ProcessorHeartbeatInterval)
+	defer heartbeatTicker.Stop()
+
 	for {
+		q.beat()
 		q.mutex.Lock()
-		if (len(q.entries)) == 0 {
+		if len(q.entries) == 0 || q.held() {
 			q.mutex.Unlock()
-			<-q.processReqChan
+			select {
+			case <-q.processReqChan:
+			case <-heartbeatTicker.C:
+			}
 			continue
 		}
 
-		// Updating queue positions for all waiting entries.
-		for i := 1; i < len(q.entries); i++ {
-			q.bot.SendReplyToMessage(q.ctx, q.entries[i].Message, q.getQueuePositionString(i))
-		}
+		// The queue positions of the waiting entries are updated after unlocking.
+		waiting := slices.Clone(q.entries[1:])
 
 		q.currentEntry = ReqQueueCurrentEntry{
 			entry: &q.entries[0],
 		}
+		q.processing = true
 		var processCtx context.Context
-		processCtx, q.currentEntry.ctxCancel = context.WithTimeout(q.ctx, q.ProcessTimeout)
+		processCtx, q.currentEntry.ctxCancel = context.WithTimeout(q.currentEntry.entry.ctx, q.ProcessTimeout)
 		q.mutex.Unlock()
+		for i := range waiting {
+			waiting[i].Delivery.Status(waiting[i].ctx, q.queuePositionStatus(i+1))
+		}
+		q.currentEntry.entry.queueWait = time.Since(q.currentEntry.entry.queuedAt)
+		metrics.QueueWait.Observe(q.currentEntry.entry.queueWait.Seconds())
 
 		var err error
 		var imageData telegram.ImageFileData
@@ -504,16 +673,21 @@ func (q *ReqQueue) processor(sdApi *sdapi.SdAPIType) {
 		case ReqTypeKuka:
 			imageNeededFirst = true
 		}
-		if imageNeededFirst {
-			fmt.Println("  waiting for image file...")
-			q.currentEntry.entry.sendReply(q.ctx, consts.ImageReqStr)
+		if q.currentEntry.entry.image != nil {
+			imageData = *q.currentEntry.entry.image
+			imageNeededFirst = false
+		}
+		err = q.checkPromptSafety(q.currentEntry.entry)
+		if err == nil && imageNeededFirst {
+			slog.InfoContext(processCtx, "waiting for image file")
+			q.currentEntry.entry.Delivery.AskForImage(q.currentEntry.entry.ctx)
 			q.currentEntry.gotImageChan = make(chan telegram.ImageFileData)
 			select {
 			case imageData = <-q.currentEntry.gotImageChan:
 			case <-processCtx.Done():
 				q.currentEntry.canceled = true
 			case <-time.NewTimer(3 * time.Minute).C:
-				fmt.Println("  waiting for image file timeout")
+				slog.InfoContext(processCtx, "waiting for image file timeout")
 				err = fmt.Errorf("waiting for image data timeout")
 			}
 			close(q.currentEntry.gotImageChan)
@@ -525,22 +699,40 @@ func (q *ReqQueue) processor(sdApi *sdapi.SdAPIType) {
 		}
 
 		if err == nil {
+			processStartedAt := time.Now()
 			err = q.processQueueEntry(processCtx, sdApi, imageData)
+			if err == nil && !q.currentEntry.canceled {
+				q.addToHistory(time.Since(processStartedAt))
+			}
 		}
 
 		q.mutex.Lock()
-		if q.currentEntry.canceled {
-			fmt.Print("  canceled\n")
-			err = sdApi.Interrupt(q.ctx)
-			if err != nil {
-				fmt.Println("  can't interrupt:", err)
+		canceled, restarting := q.currentEntry.canceled, q.currentEntry.restarting
+		q.mutex.Unlock()
+
+		// The entry stays in the queue until it's finished, the delivery is called unlocked as it can
+		// block for long.
+		if canceled {
+			slog.InfoContext(q.currentEntry.entry.ctx, "canceled")
+			if interruptErr := sdApi.Interrupt(q.currentEntry.entry.ctx); interruptErr != nil {
+				slog.ErrorContext(q.currentEntry.entry.ctx, "can't interrupt", "error", interruptErr)
+			}
+			if restarting {
+				q.currentEntry.entry.Delivery.Finished(q.currentEntry.entry.ctx, ErrRestarting)
+			} else {
+				q.currentEntry.entry.Delivery.Finished(q.currentEntry.entry.ctx, ErrCanceled)
 			}
-			q.currentEntry.entry.sendReply(q.ctx, consts.CanceledStr)
 		} else if err != nil {
-			fmt.Println("  error:", err)
-			q.currentEntry.entry.sendReply(q.ctx, consts.ErrorStr+": "+err.Error())
+			slog.ErrorContext(q.currentEntry.entry.ctx, "request failed", "error", err)
+			q.currentEntry.entry.Delivery.Finished(q.currentEntry.entry.ctx, err)
+		} else {
+			q.currentEntry.entry.Delivery.Finished(q.currentEntry.entry.ctx, nil)
 		}
+		outcome := outcomeOf(canceled, err)
+		q.currentEntry.entry.observeMetrics(outcome)
+		q.recordStats(q.currentEntry.entry, outcome)
 
+		q.mutex.Lock()
 		q.currentEntry.ctxCancel()
 
 		if q.currentEntry.stoppedChan != nil {
@@ -552,16 +744,83 @@ func (q *ReqQueue) processor(sdApi *sdapi.SdAPIType) {
 		}
 
 		q.entries = q.entries[1:]
+		q.processing = false
+		metrics.QueueLength.Set(float64(len(q.entries)))
 		if len(q.entries) == 0 {
-			fmt.Print("finished queue processing\n")
+			slog.Info("finished queue processing")
 		}
 		q.mutex.Unlock()
 	}
 }
 
+func outcomeOf(canceled bool, err error) string {
+	switch {
+	case canceled:
+		return metrics.OutcomeCanceled
+	case errors.Is(err, ErrBlocked):
+		return metrics.OutcomeBlocked
+	case err != nil:
+		return metrics.OutcomeFailed
+	}
+	return metrics.OutcomeDone
+}
+
+func (e *ReqQueueEntry) modelAndSampler() (model, sampler string) {
+	switch p := e.Params.(type) {
+	case reqparams.ReqParamsRender:
+		return p.ModelName, p.SamplerName
+	case reqparams.ReqParamsKuka:
+		return p.ModelName, p.SamplerName
+	}
+	return "", ""
+}
+
+func (e *ReqQueueEntry) observeMetrics(outcome string) {
+	metrics.Requests.WithLabelValues(e.Type.String(), outcome).Inc()
+	if outcome != metrics.OutcomeDone {
+		return
+	}
+
+	model, sampler := e.modelAndSampler()
+	metrics.RenderDuration.WithLabelValues(e.Type.String(), model, sampler).Observe(e.processDuration.Seconds())
+}
+
+func (q *ReqQueue) addToHistory(duration time.Duration) {
+	if q.History == nil {
+		return
+	}
+
+	e := q.currentEntry.entry
+	h := history.Entry{
+		Time:     time.Now(),
+		UserID:   e.UserID,
+		Username: e.Username,
+		ChatID:   e.ChatID,
+		Type:     e.Type.String(),
+		Prompt:   e.Params.OriginalPrompt(),
+		Duration: duration,
+		FileIDs:  e.resultFileIDs,
+	}
+	switch p := e.Params.(type) {
+	case reqparams.ReqParamsRender:
+		h.Seed = p.Seed
+		h.Model = p.ModelName
+		h.RenderParams = &p
+	case reqparams.ReqParamsKuka:
+		h.Seed = p.Seed
+		h.Model = p.ModelName
+	}
+
+	if _, err := q.History.Add(h); err != nil {
+		slog.ErrorContext(e.ctx, "history error", "error", err)
+	}
+}
+
 func (q *ReqQueue) Init(ctx context.Context, sdApi *sdapi.SdAPIType, bot *telegram.SDBot) {
 	q.ctx = ctx
 	q.processReqChan = make(chan bool)
+	q.drained = make(chan struct{})
 	q.bot = bot
+	q.beat()
 	go q.processor(sdApi)
 }
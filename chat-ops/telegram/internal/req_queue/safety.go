@@ -0,0 +1,77 @@
+package reqqueue
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/consts"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/reqparams"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/safety"
+)
+
+// ErrBlocked is passed to Delivery.Finished for requests blocked by the safety policy of the chat.
+var ErrBlocked = errors.New("blocked by the safety policy of the chat")
+
+// Negative prompts often list NSFW keywords, so only the prompt is checked.
+func promptOf(params reqparams.ReqParams) string {
+	switch p := params.(type) {
+	case reqparams.ReqParamsRender:
+		return p.Prompt
+	case reqparams.ReqParamsKuka:
+		return p.Prompt
+	}
+	return ""
+}
+
+func (q *ReqQueue) safetyPolicy(e *ReqQueueEntry) safety.Policy {
+	if q.Safety == nil {
+		return safety.PolicyAllow
+	}
+	return q.Safety.Policy(e.ChatID)
+}
+
+// Checks the prompt before processing, requests which would be blocked anyway are not rendered.
+func (q *ReqQueue) checkPromptSafety(e *ReqQueueEntry) error {
+	if q.safetyPolicy(e) == safety.PolicyAllow {
+		return nil
+	}
+	if keyword, found := q.Safety.CheckPrompt(promptOf(e.Params)); found {
+		e.nsfwReason = "prompt contains " + strconv.Quote(keyword)
+		slog.InfoContext(e.ctx, "request flagged as nsfw", "reason", e.nsfwReason)
+	}
+	if e.nsfwReason != "" && q.safetyPolicy(e) == safety.PolicyBlock {
+		q.notifyBlocked(e)
+		return ErrBlocked
+	}
+	return nil
+}
+
+// Returns true if the results should be hidden as spoilers, or ErrBlocked if they shouldn't be sent. The
+// classifiers get the original images.
+func (q *ReqQueue) checkResultSafety(e *ReqQueueEntry, originals [][]byte) (spoiler bool, err error) {
+	policy := q.safetyPolicy(e)
+	if policy == safety.PolicyAllow {
+		return false, nil
+	}
+	if e.nsfwReason == "" {
+		if reason, flagged := q.Safety.CheckImages(e.ctx, originals); flagged {
+			e.nsfwReason = reason
+			slog.InfoContext(e.ctx, "request flagged as nsfw", "reason", e.nsfwReason)
+		}
+	}
+	if e.nsfwReason == "" {
+		return false, nil
+	}
+	if policy == safety.PolicyBlock {
+		q.notifyBlocked(e)
+		return false, ErrBlocked
+	}
+	return true, nil
+}
+
+func (q *ReqQueue) notifyBlocked(e *ReqQueueEntry) {
+	q.bot.SendTextToAdmins(e.ctx, q.AdminUserIDs, fmt.Sprintf("%s\nUser: @%s #%d\nChat: #%d\nReason: %s\nPrompt: %s",
+		consts.SafetyBlockedAdminStr, e.Username, e.UserID, e.ChatID, e.nsfwReason, promptOf(e.Params)))
+}
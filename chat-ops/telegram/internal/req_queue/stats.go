@@ -0,0 +1,32 @@
+package reqqueue
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/stats"
+)
+
+func (q *ReqQueue) recordStats(e *ReqQueueEntry, outcome string) {
+	if q.Stats == nil {
+		return
+	}
+
+	model, sampler := e.modelAndSampler()
+	err := q.Stats.Add(stats.Record{
+		Time:      time.Now(),
+		UserID:    e.UserID,
+		Username:  e.Username,
+		ChatID:    e.ChatID,
+		Type:      e.Type.String(),
+		Outcome:   outcome,
+		Model:     model,
+		Sampler:   sampler,
+		Images:    e.imageCount,
+		QueueWait: e.queueWait,
+		Duration:  e.processDuration,
+	})
+	if err != nil {
+		slog.ErrorContext(e.ctx, "stats error", "error", err)
+	}
+}
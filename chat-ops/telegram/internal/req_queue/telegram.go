@@ -0,0 +1,359 @@
+package reqqueue
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"image"
+	_ "image/jpeg"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-telegram/bot/models"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/consts"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/metrics"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/telegram"
+)
+
+// TelegramDelivery replies to the message of the request. The status is shown in a reply which is edited
+// on each update, and deleted when the results are sent.
+type TelegramDelivery struct {
+	// The queue calls the delivery without holding its own mutex, so updates can come concurrently.
+	mutex        sync.Mutex
+	bot          *telegram.SDBot
+	message      *models.Message
+	replyMessage *models.Message
+
+	previewsDisabled bool
+}
+
+func NewTelegramDelivery(bot *telegram.SDBot, msg *models.Message) *TelegramDelivery {
+	return &TelegramDelivery{
+		bot:     bot,
+		message: msg,
+	}
+}
+
+// ReplyTo makes the delivery reply to the given message instead, the current status reply is left as is.
+func (d *TelegramDelivery) ReplyTo(msg *models.Message) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.message = msg
+	d.replyMessage = nil
+}
+
+// Returns the wait needed because of Telegram flood control, the waits are counted in the metrics.
+func checkWaitError(err error) time.Duration {
+	var retryRegex = regexp.MustCompile(`{"retry_after":([0-9]+)}`)
+	match := retryRegex.FindStringSubmatch(err.Error())
+	if len(match) < 2 {
+		return 0
+	}
+
+	retryAfter, err := strconv.Atoi(match[1])
+	if err != nil {
+		return 0
+	}
+	metrics.TelegramRetryAfterWaits.Inc()
+	metrics.TelegramRetryAfterWaitSeconds.Add(float64(retryAfter))
+	return time.Duration(retryAfter) * time.Second
+}
+
+func (d *TelegramDelivery) Status(ctx context.Context, s Status) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if s.Preview != nil {
+		d.sendPreview(ctx, s.Preview, s.Text, s.Spoiler)
+	} else {
+		d.sendReply(ctx, s.Text)
+	}
+}
+
+func (d *TelegramDelivery) Previews() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return !d.previewsDisabled
+}
+
+func (d *TelegramDelivery) AskForImage(ctx context.Context) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.sendReply(ctx, consts.ImageReqStr)
+}
+
+func (d *TelegramDelivery) Deliver(ctx context.Context, r Result) ([]string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if r.Grid != nil {
+		return d.uploadGrid(ctx, r)
+	}
+	return d.uploadImages(ctx, r, true)
+}
+
+func (d *TelegramDelivery) Finished(ctx context.Context, err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	switch {
+	case err == nil:
+		d.deleteReply(ctx)
+	case errors.Is(err, ErrCanceled):
+		d.sendReply(ctx, consts.CanceledStr)
+	case errors.Is(err, ErrRestarting):
+		d.sendReply(ctx, consts.RestartingStr)
+	default:
+		d.sendReply(ctx, consts.ErrorStr+": "+html.EscapeString(err.Error()))
+	}
+}
+
+func (d *TelegramDelivery) sendReply(ctx context.Context, text string) {
+	if d.replyMessage == nil {
+		d.replyMessage = d.bot.SendReplyToMessage(ctx, d.message, text)
+	} else if d.replyMessage.Photo != nil { // The reply shows a live preview.
+		caption := truncateCaption(text)
+		if d.replyMessage.Caption == caption {
+			return
+		}
+		d.replyMessage.Caption = caption
+		err := d.bot.EditMessageCaption(ctx, d.replyMessage, caption)
+		if err != nil {
+			slog.ErrorContext(ctx, "reply edit error", "error", err)
+
+			waitNeeded := checkWaitError(err)
+			if waitNeeded > 0 {
+				slog.InfoContext(ctx, "waiting for flood control", "wait", waitNeeded)
+			}
+			time.Sleep(waitNeeded)
+		}
+	} else if d.replyMessage.Text != text {
+		d.replyMessage.Text = text
+		err := d.bot.EditMessage(ctx, d.replyMessage, text)
+		if err != nil {
+			slog.ErrorContext(ctx, "reply edit error", "error", err)
+
+			waitNeeded := checkWaitError(err)
+			if waitNeeded > 0 {
+				slog.InfoContext(ctx, "waiting for flood control", "wait", waitNeeded)
+			}
+			time.Sleep(waitNeeded)
+		}
+	}
+}
+
+// Shows the preview in the status message. A text message can't be edited into a photo, so the first
+// preview replaces the text reply with a new photo reply, later ones edit the photo. Previews are disabled
+// on errors, and the status falls back to text updates.
+func (d *TelegramDelivery) sendPreview(ctx context.Context, preview []byte, text string, spoiler bool) {
+	caption := truncateCaption(text)
+	filename := fmt.Sprintf("sd-preview-%d.jpg", time.Now().Unix())
+
+	if d.replyMessage != nil && d.replyMessage.Photo != nil {
+		d.replyMessage.Caption = caption
+		err := d.bot.EditMessagePhoto(ctx, d.replyMessage, filename, preview, caption, spoiler)
+		if err != nil {
+			slog.ErrorContext(ctx, "preview edit error", "error", err)
+
+			if waitNeeded := checkWaitError(err); waitNeeded > 0 {
+				slog.InfoContext(ctx, "waiting for flood control", "wait", waitNeeded)
+				time.Sleep(waitNeeded)
+			}
+		}
+		return
+	}
+
+	msg, err := d.bot.SendPhoto(ctx, d.message, filename, preview, caption, nil, spoiler)
+	if err != nil {
+		slog.ErrorContext(ctx, "preview send error", "error", err)
+		d.previewsDisabled = true
+		d.sendReply(ctx, text)
+		return
+	}
+	d.deleteReply(ctx)
+	d.replyMessage = msg
+}
+
+func (d *TelegramDelivery) deleteReply(ctx context.Context) {
+	if d.replyMessage == nil {
+		return
+	}
+
+	_ = d.bot.DeleteMessage(ctx, d.replyMessage)
+	d.replyMessage = nil
+}
+
+// Returns false if Telegram would refuse the image as a photo.
+func fitsPhotoLimits(img []byte) bool {
+	if len(img) > consts.TelegramPhotoMaxSize {
+		return false
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(img))
+	if err != nil || cfg.Width == 0 || cfg.Height == 0 {
+		return false
+	}
+	if cfg.Width+cfg.Height > consts.TelegramPhotoMaxDimensionsSum {
+		return false
+	}
+	return max(cfg.Width, cfg.Height) <= consts.TelegramPhotoMaxAspectRatio*min(cfg.Width, cfg.Height)
+}
+
+func truncateCaption(s string) string {
+	if len(s) > consts.TelegramCaptionMaxLength {
+		return s[:consts.TelegramCaptionMaxLength-3] + "..."
+	}
+	return s
+}
+
+type uploadItem struct {
+	data     []byte
+	filename string
+	document bool
+}
+
+// Splits the items into albums which Telegram accepts: at most 10 items, not mixing photos and documents
+// and not exceeding the upload size limit. Photos go first, then documents. Album sizes are balanced, so 11
+// images are sent as 6+5, not 10+1.
+func splitToAlbums(items []uploadItem) (albums [][]uploadItem) {
+	var photos, documents []uploadItem
+	for _, item := range items {
+		if item.document {
+			documents = append(documents, item)
+		} else {
+			photos = append(photos, item)
+		}
+	}
+
+	for _, group := range [][]uploadItem{photos, documents} {
+		if len(group) == 0 {
+			continue
+		}
+		albumCount := (len(group) + consts.TelegramMediaGroupMaxItems - 1) / consts.TelegramMediaGroupMaxItems
+		albumMaxItems := (len(group) + albumCount - 1) / albumCount
+
+		var album []uploadItem
+		var albumSize int
+		for _, item := range group {
+			if len(album) > 0 && (len(album) >= albumMaxItems || albumSize+len(item.data) > consts.TelegramDocumentMaxSize) {
+				albums = append(albums, album)
+				album = nil
+				albumSize = 0
+			}
+			album = append(album, item)
+			albumSize += len(item.data)
+		}
+		albums = append(albums, album)
+	}
+	return albums
+}
+
+func (d *TelegramDelivery) sendAlbum(ctx context.Context, album []uploadItem, caption string, spoiler bool, retryAllowed bool) (fileIDs []string, err error) {
+	var media []models.InputMedia
+	for i, item := range album {
+		itemCaption := ""
+		if i == 0 {
+			itemCaption = caption
+		}
+		if item.document {
+			media = append(media, &models.InputMediaDocument{
+				Media:           "attach://" + item.filename,
+				MediaAttachment: bytes.NewReader(item.data),
+				ParseMode:       models.ParseModeHTML,
+				Caption:         itemCaption,
+			})
+		} else {
+			photo := &models.InputMediaPhoto{
+				Media:           "attach://" + item.filename,
+				MediaAttachment: bytes.NewReader(item.data),
+				ParseMode:       models.ParseModeHTML,
+				Caption:         itemCaption,
+			}
+			if spoiler {
+				media = append(media, telegram.SpoilerPhoto(photo))
+			} else {
+				media = append(media, photo)
+			}
+		}
+	}
+
+	msgs, err := d.bot.SendMediaGroup(ctx, d.message, media)
+	for _, msg := range msgs {
+		if fileID := telegram.FileIDOf(msg); fileID != "" {
+			fileIDs = append(fileIDs, fileID)
+		}
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "send images error", "error", err)
+
+		retryAfter := checkWaitError(err)
+		if !retryAllowed || retryAfter == 0 {
+			return fileIDs, fmt.Errorf("send images error: %w", err)
+		}
+
+		slog.InfoContext(ctx, "retrying after flood control wait", "wait", retryAfter)
+		time.Sleep(retryAfter)
+		return d.sendAlbum(ctx, album, caption, spoiler, false)
+	}
+	return fileIDs, nil
+}
+
+// Images are sent in multiple albums if needed, the description is used as the caption of the first one.
+func (d *TelegramDelivery) uploadImages(ctx context.Context, r Result, retryAllowed bool) (fileIDs []string, err error) {
+	if len(r.Imgs) == 0 {
+		return nil, fmt.Errorf("nothing to upload")
+	}
+
+	items := make([]uploadItem, len(r.Imgs))
+	for i := range r.Imgs {
+		items[i] = uploadItem{data: r.Imgs[i], filename: r.Filenames[i]}
+		// Other formats would be recompressed by Telegram, so they are sent as documents. Spoilers are sent
+		// as photos anyway, as documents can't be hidden.
+		if !r.Output.IsPhoto() && !r.Spoiler {
+			items[i].document = true
+		} else if !fitsPhotoLimits(r.Imgs[i]) {
+			slog.InfoContext(ctx, "image exceeds telegram photo limits, sending as document", "index", i)
+			items[i].document = true
+		}
+	}
+
+	caption := truncateCaption(r.Description)
+	albums := splitToAlbums(items)
+	for i, album := range albums {
+		if len(albums) > 1 {
+			slog.InfoContext(ctx, "sending album", "album", i+1, "albums", len(albums))
+		}
+		albumFileIDs, err := d.sendAlbum(ctx, album, caption, r.Spoiler, retryAllowed)
+		fileIDs = append(fileIDs, albumFileIDs...)
+		if err != nil {
+			return fileIDs, err
+		}
+		caption = ""
+	}
+	return fileIDs, nil
+}
+
+// Sends the grid as a single photo with buttons for getting the originals, which are stored by the queue.
+func (d *TelegramDelivery) uploadGrid(ctx context.Context, r Result) ([]string, error) {
+	caption := truncateCaption(r.Description)
+	filename := fmt.Sprintf("sd-grid-%d.jpg", r.TaskID)
+	msg, err := d.bot.SendPhoto(ctx, d.message, filename, r.Grid, caption, gridMarkup(r.TaskID, len(r.Imgs)), r.Spoiler)
+	if err != nil {
+		slog.ErrorContext(ctx, "send grid error", "error", err)
+
+		retryAfter := checkWaitError(err)
+		if retryAfter == 0 {
+			return nil, fmt.Errorf("send grid error: %w", err)
+		}
+		slog.InfoContext(ctx, "retrying after flood control wait", "wait", retryAfter)
+		time.Sleep(retryAfter)
+		if msg, err = d.bot.SendPhoto(ctx, d.message, filename, r.Grid, caption, gridMarkup(r.TaskID, len(r.Imgs)), r.Spoiler); err != nil {
+			return nil, fmt.Errorf("send grid error: %w", err)
+		}
+	}
+	if fileID := telegram.FileIDOf(msg); fileID != "" {
+		return []string{fileID}, nil
+	}
+	return nil, nil
+}
@@ -2,6 +2,10 @@ package reqparams
 
 import (
 	"fmt"
+	"strconv"
+
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/imgenc"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/infotext"
 )
 
 type ReqParamsKuka struct {
@@ -15,7 +19,7 @@ type ReqParamsKuka struct {
 	BatchSize          int
 	Steps              int
 	NumOutputs         int
-	OutputPNG          bool
+	Output             imgenc.Options
 	CFGScale           float64
 	SamplerName        string
 	ModelName          string
@@ -29,8 +33,8 @@ func (r ReqParamsKuka) String() string {
 	}
 
 	var outFormatText string
-	if r.OutputPNG {
-		outFormatText = "/PNG"
+	if r.Output.Format != imgenc.FormatJPEG {
+		outFormatText = "/" + r.Output.String()
 	}
 
 	res := fmt.Sprintf("🌱<code>%d</code> 👟%d 🕹%.1f 🖼%dx%d%s%s 🔭%s 🧩%s",
@@ -60,17 +64,29 @@ func (r ReqParamsKuka) OriginalPrompt() string {
 	return r.OriginalPromptText
 }
 
+func (r ReqParamsKuka) Infotext() infotext.Infotext {
+	it := infotext.Infotext{Prompt: r.Prompt, NegativePrompt: r.NegativePrompt}
+	it.Add("Steps", fmt.Sprint(r.Steps))
+	it.Add("Sampler", r.SamplerName)
+	it.Add("CFG scale", fmt.Sprint(r.CFGScale))
+	it.Add("Seed", fmt.Sprint(r.Seed))
+	it.Add("Size", fmt.Sprintf("%dx%d", r.Width, r.Height))
+	it.Add("Model", r.ModelName)
+	it.Add("Denoising strength", strconv.FormatFloat(float64(r.DenoisingStrength), 'f', -1, 32))
+	return it
+}
+
 type ReqParamsUpscale struct {
 	OriginalPromptText string
 	Scale              float32
 	Upscaler           string
-	OutputPNG          bool
+	Output             imgenc.Options
 }
 
 func (r ReqParamsUpscale) String() string {
 	res := "🔎 " + r.Upscaler + "x" + fmt.Sprint(r.Scale)
-	if r.OutputPNG {
-		res += "/PNG"
+	if r.Output.Format != imgenc.FormatJPEG {
+		res += "/" + r.Output.String()
 	}
 	return res
 }
@@ -79,6 +95,12 @@ func (r ReqParamsUpscale) OriginalPrompt() string {
 	return r.OriginalPromptText
 }
 
+// AddToInfotext appends the upscale params to the infotext of the upscaled image.
+func (r ReqParamsUpscale) AddToInfotext(it *infotext.Infotext) {
+	it.Add("Postprocess upscale by", strconv.FormatFloat(float64(r.Scale), 'f', -1, 32))
+	it.Add("Postprocess upscaler", r.Upscaler)
+}
+
 type ReqParamsRenderHR struct {
 	DenoisingStrength float32
 	Scale             float32
@@ -96,7 +118,8 @@ type ReqParamsRender struct {
 	BatchSize          int
 	Steps              int
 	NumOutputs         int
-	OutputPNG          bool
+	Output             imgenc.Options
+	Grid               bool
 	CFGScale           float64
 	SamplerName        string
 	ModelName          string
@@ -119,8 +142,11 @@ func (r ReqParamsRender) String() string {
 	}
 
 	var outFormatText string
-	if r.OutputPNG {
-		outFormatText = "/PNG"
+	if r.Output.Format != imgenc.FormatJPEG {
+		outFormatText = "/" + r.Output.String()
+	}
+	if r.Grid && r.NumOutputs > 1 {
+		outFormatText += "/grid"
 	}
 
 	res := fmt.Sprintf("🌱<code>%d</code> 👟%d 🕹%.1f 🖼%dx%d%s%s 🔭%s 🧩%s",
@@ -155,6 +181,29 @@ func (r ReqParamsRender) OriginalPrompt() string {
 	return r.OriginalPromptText
 }
 
+// Infotext returns the params of the imageIdx-th output image, seeds are incremented for each image.
+func (r ReqParamsRender) Infotext(imageIdx int) infotext.Infotext {
+	it := infotext.Infotext{Prompt: r.Prompt, NegativePrompt: r.NegativePrompt}
+	it.Add("Steps", fmt.Sprint(r.Steps))
+	it.Add("Sampler", r.SamplerName)
+	it.Add("CFG scale", fmt.Sprint(r.CFGScale))
+	it.Add("Seed", fmt.Sprint(r.Seed+uint32(imageIdx)))
+	it.Add("Size", fmt.Sprintf("%dx%d", r.Width, r.Height))
+	it.Add("Model", r.ModelName)
+	if r.BatchSize > 1 {
+		it.Add("Batch size", fmt.Sprint(r.BatchSize))
+	}
+	if r.HR.Scale > 0 {
+		it.Add("Denoising strength", strconv.FormatFloat(float64(r.HR.DenoisingStrength), 'f', -1, 32))
+		it.Add("Hires upscale", strconv.FormatFloat(float64(r.HR.Scale), 'f', -1, 32))
+		it.Add("Hires steps", fmt.Sprint(r.HR.SecondPassSteps))
+		it.Add("Hires upscaler", r.HR.Upscaler)
+	} else if r.Upscale.Scale > 0 {
+		r.Upscale.AddToInfotext(&it)
+	}
+	return it
+}
+
 type ReqParams interface {
 	String() string
 	OriginalPrompt() string
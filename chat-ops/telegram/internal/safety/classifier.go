@@ -0,0 +1,108 @@
+package safety
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/infotext"
+)
+
+const httpClassifierTimeout = 30 * time.Second
+
+// Classifier decides if an image is NSFW. The images are the originals returned by AUTOMATIC1111.
+type Classifier interface {
+	Name() string
+	IsNSFW(ctx context.Context, img []byte) (bool, error)
+}
+
+// Returns true if the value is a true boolean or a score reaching the threshold.
+func isFlagged(value string, threshold float64) bool {
+	value = strings.TrimSpace(value)
+	if b, err := strconv.ParseBool(value); err == nil {
+		return b
+	}
+	if strings.EqualFold(value, "yes") {
+		return true
+	}
+	score, err := strconv.ParseFloat(value, 64)
+	return err == nil && score >= threshold
+}
+
+// InfotextClassifier reads the result of an AUTOMATIC1111 NSFW checker extension from the generation
+// parameters embedded in the image, like "NSFW: True" or "NSFW score: 0.93".
+type InfotextClassifier struct {
+	Param     string
+	Threshold float64
+}
+
+func (c InfotextClassifier) Name() string {
+	return "the " + c.Param + " generation parameter"
+}
+
+func (c InfotextClassifier) IsNSFW(ctx context.Context, img []byte) (bool, error) {
+	it, err := infotext.FromImage(img)
+	if errors.Is(err, infotext.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	value, found := it.Get(c.Param)
+	return found && isFlagged(value, c.Threshold), nil
+}
+
+// HTTPClassifier posts the image to a local classifier service, which should respond with
+// {"nsfw": true} or {"score": 0.93}.
+type HTTPClassifier struct {
+	URL       string
+	Threshold float64
+}
+
+func (c HTTPClassifier) Name() string {
+	return "the classifier"
+}
+
+func (c HTTPClassifier) IsNSFW(ctx context.Context, img []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, httpClassifierTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(img))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", http.DetectContentType(img))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("classifier response status %d", resp.StatusCode)
+	}
+	var res struct {
+		NSFW  *bool    `json:"nsfw"`
+		Score *float64 `json:"score"`
+	}
+	if err = json.Unmarshal(body, &res); err != nil {
+		return false, fmt.Errorf("invalid classifier response: %w", err)
+	}
+	switch {
+	case res.NSFW != nil:
+		return *res.NSFW, nil
+	case res.Score != nil:
+		return *res.Score >= c.Threshold, nil
+	}
+	return false, fmt.Errorf("classifier response has no nsfw or score field")
+}
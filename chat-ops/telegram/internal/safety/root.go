@@ -0,0 +1,90 @@
+package safety
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+// Policy is what happens with the NSFW results in a chat.
+type Policy string
+
+const (
+	PolicyAllow   Policy = "allow"
+	PolicySpoiler Policy = "spoiler"
+	// The results are not sent and the admins are notified.
+	PolicyBlock Policy = "block"
+)
+
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(strings.ToLower(s)); p {
+	case PolicyAllow, PolicySpoiler, PolicyBlock:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid safety policy, valid values are allow, spoiler and block")
+}
+
+// Checker flags the requests by their prompt and the results by the classifiers.
+type Checker struct {
+	keywords      *regexp.Regexp
+	classifiers   []Classifier
+	defaultPolicy Policy
+	// Returns the policy set for the chat, or an empty string if it's not set.
+	chatPolicy func(chatID int64) Policy
+}
+
+// New creates a checker, keywords are matched as whole words case insensitively.
+func New(keywords []string, classifiers []Classifier, defaultPolicy Policy, chatPolicy func(chatID int64) Policy) *Checker {
+	c := &Checker{
+		classifiers:   classifiers,
+		defaultPolicy: defaultPolicy,
+		chatPolicy:    chatPolicy,
+	}
+	var quoted []string
+	for _, k := range keywords {
+		if k = strings.TrimSpace(k); k != "" {
+			quoted = append(quoted, regexp.QuoteMeta(k))
+		}
+	}
+	if len(quoted) > 0 {
+		c.keywords = regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b`)
+	}
+	return c
+}
+
+// Policy returns the policy of the chat, the default one if it's not set for the chat.
+func (c *Checker) Policy(chatID int64) Policy {
+	if p := c.chatPolicy(chatID); p != "" {
+		return p
+	}
+	return c.defaultPolicy
+}
+
+// CheckPrompt returns the first keyword found in the prompt.
+func (c *Checker) CheckPrompt(prompt string) (keyword string, found bool) {
+	if c.keywords == nil {
+		return "", false
+	}
+	keyword = c.keywords.FindString(prompt)
+	return keyword, keyword != ""
+}
+
+// CheckImages runs the classifiers on the images and returns the reason if any of them is flagged. Images
+// which can't be classified are flagged too, so a failing classifier can't let them through.
+func (c *Checker) CheckImages(ctx context.Context, imgs [][]byte) (reason string, flagged bool) {
+	for i, img := range imgs {
+		for _, classifier := range c.classifiers {
+			nsfw, err := classifier.IsNSFW(ctx, img)
+			if err != nil {
+				slog.ErrorContext(ctx, "nsfw classifier error", "classifier", classifier.Name(), "error", err)
+				return fmt.Sprintf("image #%d can't be classified: %s", i+1, err), true
+			}
+			if nsfw {
+				return fmt.Sprintf("image #%d flagged by %s", i+1, classifier.Name()), true
+			}
+		}
+	}
+	return "", false
+}
@@ -7,12 +7,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"math"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/logging"
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/metrics"
 	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/reqparams"
 )
 
@@ -20,8 +23,21 @@ type SdAPIType struct {
 	SdHost string
 }
 
-func (a *SdAPIType) req(ctx context.Context, path, service string, postData []byte) (string, error) {
-	path, err := url.JoinPath(a.SdHost, "/sdapi/v1", path)
+func (a *SdAPIType) req(ctx context.Context, path, service string, postData []byte) (res string, err error) {
+	return a.request(ctx, "/sdapi/v1"+path, service, postData)
+}
+
+// Sends the request to the endpoint, which is the full path of the WebUI API endpoint.
+func (a *SdAPIType) request(ctx context.Context, endpoint, service string, postData []byte) (res string, err error) {
+	startedAt := time.Now()
+	defer func() {
+		metrics.SDAPIDuration.WithLabelValues(endpoint).Observe(time.Since(startedAt).Seconds())
+		if err != nil {
+			metrics.SDAPIErrors.WithLabelValues(endpoint).Inc()
+		}
+	}()
+
+	path, err := url.JoinPath(a.SdHost, endpoint)
 	if err != nil {
 		return "", err
 	}
@@ -45,8 +61,12 @@ func (a *SdAPIType) req(ctx context.Context, path, service string, postData []by
 	client := http.Client{}
 	resp, err := client.Do(request)
 	if err != nil {
+		if ctx.Err() == nil {
+			metrics.BackendUp.Set(0)
+		}
 		return "", err
 	}
+	metrics.BackendUp.Set(1)
 	defer resp.Body.Close()
 
 	bodyBytes, err := io.ReadAll(resp.Body)
@@ -55,11 +75,10 @@ func (a *SdAPIType) req(ctx context.Context, path, service string, postData []by
 	}
 
 	if resp.StatusCode != 200 {
-		log.Printf("Error on request: %s", path)
-		log.Printf("Request body: %s", string(postData))
-		log.Printf("Response status: %d", resp.StatusCode)
-		log.Printf("Response body: %s", string(bodyBytes))
-		return "", fmt.Errorf("api status code: %d (%s to %s)\nResponse body: %s", resp.StatusCode, request.Method, path, string(bodyBytes))
+		slog.ErrorContext(ctx, "sd api request failed", "method", request.Method, "endpoint", endpoint, "status", resp.StatusCode,
+			"response", logging.Redact(string(bodyBytes)))
+		slog.DebugContext(ctx, "sd api request body", "endpoint", endpoint, "body", logging.Redact(string(postData)))
+		return "", fmt.Errorf("api status code: %d (%s to %s)\nResponse body: %s", resp.StatusCode, request.Method, endpoint, logging.Redact(string(bodyBytes)))
 	}
 
 	return string(bodyBytes), nil
@@ -179,7 +198,7 @@ type img2imgReq struct {
 
 func (a *SdAPIType) Img2Img(ctx context.Context, p reqparams.ReqParams, imageData []byte) (imgs [][]byte, err error) {
 	params := p.(reqparams.ReqParamsKuka)
-	log.Println("Img2Img params:", params)
+	slog.DebugContext(ctx, "img2img params", "params", fmt.Sprintf("%+v", params))
 
 	// Ensure we're not sending any zero values
 	if params.Width == 0 {
@@ -232,8 +251,6 @@ func (a *SdAPIType) Img2Img(ctx context.Context, p reqparams.ReqParams, imageDat
 		return nil, fmt.Errorf("error marshalling request: %w", err)
 	}
 
-	log.Printf("Img2Img request: %s", string(postData))
-
 	res, err := a.req(ctx, "/img2img", "", postData)
 	if err != nil {
 		return nil, fmt.Errorf("error making request: %w", err)
@@ -248,7 +265,7 @@ func (a *SdAPIType) Img2Img(ctx context.Context, p reqparams.ReqParams, imageDat
 		return nil, fmt.Errorf("error unmarshalling response: %w", err)
 	}
 	if len(renderResp.Images) == 0 {
-		log.Printf("Img2Img response info: %s", renderResp.Info)
+		slog.WarnContext(ctx, "img2img returned no images", "info", renderResp.Info)
 		return nil, fmt.Errorf("no images returned")
 	}
 
@@ -324,8 +341,14 @@ func (a *SdAPIType) Interrupt(ctx context.Context) error {
 	return nil
 }
 
+// Ping returns an error if the API can't be reached, the progress endpoint is used as it's cheap.
+func (a *SdAPIType) Ping(ctx context.Context) error {
+	_, err := a.req(ctx, "/progress", "?skip_current_image=true", nil)
+	return err
+}
+
 func (a *SdAPIType) GetProgress(ctx context.Context) (progressPercent int, eta time.Duration, err error) {
-	res, err := a.req(ctx, "/progress", "?skip_current_image=false", nil)
+	res, err := a.req(ctx, "/progress", "?skip_current_image=true", nil)
 	if err != nil {
 		return 0, 0, err
 	}
@@ -347,6 +370,32 @@ func (a *SdAPIType) GetProgress(ctx context.Context) (progressPercent int, eta t
 	return int(progressRes.Progress * 100), time.Duration(progressRes.ETA * float32(time.Second)), nil
 }
 
+// GetCurrentImage returns the live preview of the ongoing render, or nil if it's not available yet or live
+// previews are disabled in the WebUI settings.
+func (a *SdAPIType) GetCurrentImage(ctx context.Context) (img []byte, err error) {
+	res, err := a.req(ctx, "/progress", "?skip_current_image=false", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var progressRes struct {
+		CurrentImage string `json:"current_image"`
+	}
+	err = json.Unmarshal([]byte(res), &progressRes)
+	if err != nil {
+		return nil, err
+	}
+	if progressRes.CurrentImage == "" {
+		return nil, nil
+	}
+
+	// Newer versions may send a data URL.
+	if _, data, found := strings.Cut(progressRes.CurrentImage, ";base64,"); found {
+		progressRes.CurrentImage = data
+	}
+	return base64.StdEncoding.DecodeString(progressRes.CurrentImage)
+}
+
 func (a *SdAPIType) GetModels(ctx context.Context) (models []string, err error) {
 	res, err := a.req(ctx, "/sd-models", "", nil)
 	if err != nil {
@@ -466,3 +515,68 @@ func (a *SdAPIType) GetVAEs(ctx context.Context) (vaes []string, err error) {
 	}
 	return
 }
+
+// GPUMemory is the VRAM usage of the GPU used by the WebUI, in bytes.
+type GPUMemory struct {
+	Used  int64
+	Total int64
+}
+
+func (a *SdAPIType) GetGPUMemory(ctx context.Context) (mem GPUMemory, err error) {
+	res, err := a.req(ctx, "/memory", "", nil)
+	if err != nil {
+		return mem, err
+	}
+
+	var memoryRes struct {
+		CUDA struct {
+			System struct {
+				Used  float64 `json:"used"`
+				Total float64 `json:"total"`
+			} `json:"system"`
+			Error string `json:"error"`
+		} `json:"cuda"`
+	}
+	err = json.Unmarshal([]byte(res), &memoryRes)
+	if err != nil {
+		return mem, err
+	}
+	if memoryRes.CUDA.Error != "" {
+		return mem, fmt.Errorf("cuda %s", memoryRes.CUDA.Error)
+	}
+	return GPUMemory{Used: int64(memoryRes.CUDA.System.Used), Total: int64(memoryRes.CUDA.System.Total)}, nil
+}
+
+// GetGPUModels returns the names of the GPUs of the WebUI host from its system info.
+func (a *SdAPIType) GetGPUModels(ctx context.Context) (gpus []string, err error) {
+	res, err := a.request(ctx, "/internal/sysinfo", "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var sysInfoRes struct {
+		TorchEnvInfo json.RawMessage `json:"Torch env info"`
+	}
+	err = json.Unmarshal([]byte(res), &sysInfoRes)
+	if err != nil {
+		return nil, err
+	}
+	var torchEnvInfo struct {
+		GPUModels string `json:"nvidia_gpu_models"`
+	}
+	// It's an error string if the WebUI couldn't collect it.
+	if err = json.Unmarshal(sysInfoRes.TorchEnvInfo, &torchEnvInfo); err != nil {
+		return nil, fmt.Errorf("no torch env info in sysinfo")
+	}
+
+	// A single GPU is listed by its name, multiple ones like "GPU 0: name".
+	for _, line := range strings.Split(torchEnvInfo.GPUModels, "\n") {
+		if _, name, found := strings.Cut(line, ": "); found && strings.HasPrefix(line, "GPU ") {
+			line = name
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			gpus = append(gpus, line)
+		}
+	}
+	return gpus, nil
+}
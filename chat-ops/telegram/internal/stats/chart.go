@@ -0,0 +1,106 @@
+package stats
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"time"
+
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/metrics"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	chartWidth  = 800
+	chartHeight = 400
+	chartMargin = 40
+)
+
+var (
+	chartBackground = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	chartText       = color.RGBA{0x33, 0x33, 0x33, 0xff}
+	chartAxis       = color.RGBA{0xaa, 0xaa, 0xaa, 0xff}
+	chartDone       = color.RGBA{0x4c, 0xaf, 0x50, 0xff}
+	chartNotDone    = color.RGBA{0xe5, 0x39, 0x35, 0xff}
+)
+
+func drawText(img draw.Image, x, y int, c color.Color, s string) {
+	d := font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(c),
+		Face: basicfont.Face7x13,
+		Dot:  fixed.P(x, y),
+	}
+	d.DrawString(s)
+}
+
+func fillRect(img draw.Image, r image.Rectangle, c color.Color) {
+	draw.Draw(img, r, image.NewUniform(c), image.Point{}, draw.Src)
+}
+
+// Chart draws a PNG bar chart of the requests in each bucket of the period ending at now, the done requests
+// are stacked under the other outcomes.
+func Chart(records []Record, period Period, now time.Time) ([]byte, error) {
+	bucketCount := int(period.Duration / period.Bucket)
+	since := now.Add(-period.Duration)
+	done := make([]int, bucketCount)
+	notDone := make([]int, bucketCount)
+	for _, r := range records {
+		i := int(r.Time.Sub(since) / period.Bucket)
+		if i < 0 || i >= bucketCount {
+			continue
+		}
+		if r.Outcome == metrics.OutcomeDone {
+			done[i]++
+		} else {
+			notDone[i]++
+		}
+	}
+	maxCount := 1
+	for i := range done {
+		maxCount = max(maxCount, done[i]+notDone[i])
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, chartWidth, chartHeight))
+	fillRect(img, img.Bounds(), chartBackground)
+	drawText(img, chartMargin, chartMargin/2+4, chartText, fmt.Sprintf("Requests of the last %s, max %d", period.Name, maxCount))
+	fillRect(img, image.Rect(chartWidth-220, chartMargin/2-6, chartWidth-210, chartMargin/2+4), chartDone)
+	drawText(img, chartWidth-205, chartMargin/2+4, chartText, "done")
+	fillRect(img, image.Rect(chartWidth-160, chartMargin/2-6, chartWidth-150, chartMargin/2+4), chartNotDone)
+	drawText(img, chartWidth-145, chartMargin/2+4, chartText, "failed/other")
+
+	plot := image.Rect(chartMargin, chartMargin, chartWidth-chartMargin, chartHeight-chartMargin)
+	fillRect(img, image.Rect(plot.Min.X, plot.Max.Y, plot.Max.X, plot.Max.Y+1), chartAxis)
+
+	barSpace := plot.Dx() / bucketCount
+	barWidth := max(barSpace*3/4, 1)
+	// Labels are 5 characters at most, only every labelEvery-th bucket is labeled so they don't overlap.
+	labelEvery := max(1, (5*7+10)/barSpace+1)
+	for i := 0; i < bucketCount; i++ {
+		x := plot.Min.X + i*barSpace + (barSpace-barWidth)/2
+		doneHeight := done[i] * plot.Dy() / maxCount
+		totalHeight := (done[i] + notDone[i]) * plot.Dy() / maxCount
+		fillRect(img, image.Rect(x, plot.Max.Y-doneHeight, x+barWidth, plot.Max.Y), chartDone)
+		fillRect(img, image.Rect(x, plot.Max.Y-totalHeight, x+barWidth, plot.Max.Y-doneHeight), chartNotDone)
+
+		if i%labelEvery == 0 {
+			bucketStart := since.Add(time.Duration(i) * period.Bucket)
+			label := bucketStart.Format("01-02")
+			if period.Bucket < 24*time.Hour {
+				label = bucketStart.Format("15h")
+			}
+			drawText(img, x, plot.Max.Y+16, chartText, label)
+		}
+	}
+
+	var b bytes.Buffer
+	if err := png.Encode(&b, img); err != nil {
+		return nil, fmt.Errorf("can't encode chart: %w", err)
+	}
+	return b.Bytes(), nil
+}
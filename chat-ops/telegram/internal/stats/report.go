@@ -0,0 +1,191 @@
+package stats
+
+import (
+	"cmp"
+	"fmt"
+	"html"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/metrics"
+)
+
+const nameMaxLen = 14
+
+// Period is the time span of a report, its chart has a bar for each bucket.
+type Period struct {
+	Name     string
+	Duration time.Duration
+	Bucket   time.Duration
+}
+
+var periods = []Period{
+	{Name: "day", Duration: 24 * time.Hour, Bucket: time.Hour},
+	{Name: "week", Duration: 7 * 24 * time.Hour, Bucket: 24 * time.Hour},
+	{Name: "month", Duration: 30 * 24 * time.Hour, Bucket: 24 * time.Hour},
+}
+
+// MaxPeriod is the longest period, records older than this are not needed.
+const MaxPeriod = 30 * 24 * time.Hour
+
+func ParsePeriod(s string) (Period, error) {
+	for _, p := range periods {
+		if p.Name == s {
+			return p, nil
+		}
+	}
+	return Period{}, fmt.Errorf("invalid period, valid values are day, week and month")
+}
+
+// Row is a line of a per user, chat, model or sampler table.
+type Row struct {
+	Name     string
+	Requests int
+	Images   int
+	Duration time.Duration
+}
+
+type Summary struct {
+	Requests int
+	Outcomes map[string]int
+	Images   int
+	Duration time.Duration
+	// Average of the requests which got out of the queue.
+	QueueWait time.Duration
+
+	// Sorted by the request count, descending.
+	Users    []Row
+	Chats    []Row
+	Models   []Row
+	Samplers []Row
+}
+
+type rows map[string]*Row
+
+func (rs rows) add(name string, r Record) {
+	if name == "" {
+		return
+	}
+	row := rs[name]
+	if row == nil {
+		row = &Row{Name: name}
+		rs[name] = row
+	}
+	row.Requests++
+	row.Images += r.Images
+	row.Duration += r.Duration
+}
+
+func (rs rows) sorted() (res []Row) {
+	for _, row := range rs {
+		res = append(res, *row)
+	}
+	slices.SortFunc(res, func(a, b Row) int {
+		if a.Requests != b.Requests {
+			return cmp.Compare(b.Requests, a.Requests)
+		}
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return res
+}
+
+func userName(r Record) string {
+	if r.Username != "" {
+		return "@" + r.Username
+	}
+	return strconv.FormatInt(r.UserID, 10)
+}
+
+func Summarize(records []Record) (s Summary) {
+	s.Outcomes = map[string]int{}
+	users, chats, models, samplers := rows{}, rows{}, rows{}, rows{}
+	var queueWait time.Duration
+	var queued int
+	for _, r := range records {
+		s.Requests++
+		s.Outcomes[r.Outcome]++
+		s.Images += r.Images
+		s.Duration += r.Duration
+		if r.Outcome != metrics.OutcomeRejected {
+			queueWait += r.QueueWait
+			queued++
+		}
+
+		users.add(userName(r), r)
+		chats.add(strconv.FormatInt(r.ChatID, 10), r)
+		models.add(r.Model, r)
+		samplers.add(r.Sampler, r)
+	}
+	if queued > 0 {
+		s.QueueWait = queueWait / time.Duration(queued)
+	}
+	s.Users, s.Chats, s.Models, s.Samplers = users.sorted(), chats.sorted(), models.sorted(), samplers.sorted()
+	return s
+}
+
+func formatDuration(d time.Duration) string {
+	if d < time.Minute {
+		return d.Round(time.Second).String()
+	}
+	return strings.TrimSuffix(d.Round(time.Minute).String(), "0s")
+}
+
+func truncateName(s string) string {
+	if r := []rune(s); len(r) > nameMaxLen {
+		return string(r[:nameMaxLen-1]) + "…"
+	}
+	return s
+}
+
+func (s Summary) rate(outcome string) string {
+	if s.Requests == 0 {
+		return "0%"
+	}
+	return fmt.Sprintf("%.1f%%", float64(s.Outcomes[outcome])/float64(s.Requests)*100)
+}
+
+func writeTable(b *strings.Builder, title string, rows []Row, topCount int, withImages bool) {
+	if len(rows) == 0 {
+		return
+	}
+	if withImages {
+		fmt.Fprintf(b, "\n%-*s %5s %5s %7s\n", nameMaxLen, title, "Req", "Img", "GPU")
+	} else {
+		fmt.Fprintf(b, "\n%-*s %5s\n", nameMaxLen, title, "Req")
+	}
+	for _, row := range rows[:min(len(rows), topCount)] {
+		name := html.EscapeString(truncateName(row.Name))
+		// The padding is counted in runes, as the escaped name may be longer.
+		pad := strings.Repeat(" ", max(nameMaxLen-len([]rune(truncateName(row.Name))), 0))
+		if withImages {
+			fmt.Fprintf(b, "%s%s %5d %5d %7s\n", name, pad, row.Requests, row.Images, formatDuration(row.Duration))
+		} else {
+			fmt.Fprintf(b, "%s%s %5d\n", name, pad, row.Requests)
+		}
+	}
+}
+
+// Format returns the summary as HTML, the tables list the top topCount rows.
+func (s Summary) Format(title string, topCount int) string {
+	var b strings.Builder
+	b.WriteString(title + "\n")
+	fmt.Fprintf(&b, "Requests: %d (done %d, failed %d, canceled %d, rejected %d, blocked %d)\n", s.Requests,
+		s.Outcomes[metrics.OutcomeDone], s.Outcomes[metrics.OutcomeFailed], s.Outcomes[metrics.OutcomeCanceled],
+		s.Outcomes[metrics.OutcomeRejected], s.Outcomes[metrics.OutcomeBlocked])
+	fmt.Fprintf(&b, "Error rate: %s, cancel rate: %s\n", s.rate(metrics.OutcomeFailed), s.rate(metrics.OutcomeCanceled))
+	fmt.Fprintf(&b, "Images: %d\n", s.Images)
+	fmt.Fprintf(&b, "GPU time: %s\n", formatDuration(s.Duration))
+	fmt.Fprintf(&b, "Average queue wait: %s\n", formatDuration(s.QueueWait))
+
+	var tables strings.Builder
+	writeTable(&tables, "User", s.Users, topCount, true)
+	writeTable(&tables, "Chat", s.Chats, topCount, true)
+	writeTable(&tables, "Model", s.Models, topCount, false)
+	writeTable(&tables, "Sampler", s.Samplers, topCount, false)
+	if tables.Len() > 0 {
+		b.WriteString("<pre>" + strings.TrimSpace(tables.String()) + "</pre>")
+	}
+	return b.String()
+}
@@ -0,0 +1,57 @@
+// Package stats records the outcomes of the requests for the usage statistics.
+package stats
+
+import (
+	"time"
+
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/jsonl"
+)
+
+// Record is the outcome of a request, see the outcomes in the metrics package.
+type Record struct {
+	Time     time.Time `json:"time"`
+	UserID   int64     `json:"user_id"`
+	Username string    `json:"username,omitempty"`
+	ChatID   int64     `json:"chat_id"`
+	Type     string    `json:"type"`
+	Outcome  string    `json:"outcome"`
+	Model    string    `json:"model,omitempty"`
+	Sampler  string    `json:"sampler,omitempty"`
+	Images   int       `json:"images,omitempty"`
+	// Zero for requests rejected before queueing.
+	QueueWait time.Duration `json:"queue_wait,omitempty"`
+	// Time the backend spent processing the request.
+	Duration time.Duration `json:"duration,omitempty"`
+}
+
+// Store keeps the records of the last maxAge in memory. If filename is set, records are appended to the file
+// as JSON lines and the ones not older than maxAge are loaded on startup.
+type Store struct {
+	records *jsonl.Store[Record]
+}
+
+func NewStore(filename string, maxAge time.Duration) (*Store, error) {
+	records, err := jsonl.Open[Record]("stats", filename, jsonl.Options[Record]{
+		Expired: func(r Record) bool { return time.Since(r.Time) > maxAge },
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Store{records: records}, nil
+}
+
+func (s *Store) Add(r Record) error {
+	return s.records.Add(r)
+}
+
+// Since returns the records since t, oldest first.
+func (s *Store) Since(t time.Time) (res []Record) {
+	s.records.View(func(records []Record) {
+		for _, r := range records {
+			if !r.Time.Before(t) {
+				res = append(res, r)
+			}
+		}
+	})
+	return res
+}
@@ -1,9 +1,13 @@
 package telegram
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 
 	"github.com/go-telegram/bot"
@@ -16,7 +20,8 @@ type SDBot struct {
 }
 
 func NewBot(botToken string, defailtHandlerFunc bot.HandlerFunc) (*SDBot, error) {
-	botInternal, err := bot.New(botToken, bot.WithDefaultHandler(defailtHandlerFunc))
+	client := &http.Client{Timeout: pollTimeout, Transport: metricsTransport{next: http.DefaultTransport}}
+	botInternal, err := bot.New(botToken, bot.WithDefaultHandler(defailtHandlerFunc), bot.WithHTTPClient(pollTimeout, client))
 	if err != nil {
 		return nil, fmt.Errorf("cannot create telegram bot with token: %w", err)
 	}
@@ -29,24 +34,75 @@ func (b *SDBot) RegisterPrefixHandler(pattern string, handlerFunc bot.HandlerFun
 	return b.bot.RegisterHandler(bot.HandlerTypeMessageText, pattern, bot.MatchTypePrefix, handlerFunc)
 }
 
+func (b *SDBot) RegisterCallbackPrefixHandler(pattern string, handlerFunc bot.HandlerFunc) string {
+	return b.bot.RegisterHandler(bot.HandlerTypeCallbackQueryData, pattern, bot.MatchTypePrefix, handlerFunc)
+}
+
+// Start receives the updates with long polling. A webhook left set by an earlier run would make polling
+// fail, so it's deleted first.
 func (b *SDBot) Start(ctx context.Context) {
+	if _, err := b.bot.DeleteWebhook(ctx, &bot.DeleteWebhookParams{}); err != nil {
+		slog.ErrorContext(ctx, "delete webhook error", "error", err)
+	}
 	b.bot.Start(ctx)
 }
 
+// GetMe returns an error if the Telegram API can't be reached or the token is invalid.
+func (b *SDBot) GetMe(ctx context.Context) error {
+	_, err := b.bot.GetMe(ctx)
+	return err
+}
+
+// TopicOf returns the forum topic ID of the message, replies are sent to the same topic. It's 0 for the
+// General topic and for chats without topics.
+func TopicOf(msg *models.Message) int {
+	if msg.IsTopicMessage {
+		return msg.MessageThreadID
+	}
+	return 0
+}
+
 func (b *SDBot) SendReplyToMessage(ctx context.Context, replyToMsg *models.Message, text string) (msg *models.Message) {
 	var err error
 	msg, err = b.bot.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:           replyToMsg.Chat.ID,
+		MessageThreadID:  TopicOf(replyToMsg),
 		ReplyToMessageID: replyToMsg.ID,
+		ParseMode:        models.ParseModeHTML,
+		Text:             text,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "reply send error", "error", err)
+	}
+	return
+}
+
+func (b *SDBot) SendReplyWithMarkup(ctx context.Context, replyToMsg *models.Message, text string, markup models.ReplyMarkup) (msg *models.Message) {
+	var err error
+	msg, err = b.bot.SendMessage(ctx, &bot.SendMessageParams{
 		ChatID:           replyToMsg.Chat.ID,
+		MessageThreadID:  TopicOf(replyToMsg),
+		ReplyToMessageID: replyToMsg.ID,
 		ParseMode:        models.ParseModeHTML,
 		Text:             text,
+		ReplyMarkup:      markup,
 	})
 	if err != nil {
-		fmt.Println("  reply send error:", err)
+		slog.ErrorContext(ctx, "reply send error", "error", err)
 	}
 	return
 }
 
+func (b *SDBot) AnswerCallbackQuery(ctx context.Context, callbackQueryID string, text string) {
+	_, err := b.bot.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
+		CallbackQueryID: callbackQueryID,
+		Text:            text,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "callback answer error", "error", err)
+	}
+}
+
 func (b *SDBot) EditMessage(ctx context.Context, editableMsg *models.Message, newText string) error {
 	_, err := b.bot.EditMessageText(ctx, &bot.EditMessageTextParams{
 		MessageID: editableMsg.ID,
@@ -57,6 +113,57 @@ func (b *SDBot) EditMessage(ctx context.Context, editableMsg *models.Message, ne
 	return err
 }
 
+func (b *SDBot) EditMessageCaption(ctx context.Context, editableMsg *models.Message, newCaption string) error {
+	_, err := b.bot.EditMessageCaption(ctx, &bot.EditMessageCaptionParams{
+		MessageID: editableMsg.ID,
+		ChatID:    editableMsg.Chat.ID,
+		ParseMode: models.ParseModeHTML,
+		Caption:   newCaption,
+	})
+	return err
+}
+
+// EditMessagePhoto replaces the photo of a photo message.
+func (b *SDBot) EditMessagePhoto(ctx context.Context, editableMsg *models.Message, filename string, data []byte, caption string, spoiler bool) error {
+	var media models.InputMedia = &models.InputMediaPhoto{
+		Media:           "attach://" + filename,
+		MediaAttachment: bytes.NewReader(data),
+		Caption:         caption,
+		ParseMode:       models.ParseModeHTML,
+	}
+	if spoiler {
+		media = SpoilerPhoto(media.(*models.InputMediaPhoto))
+	}
+	_, err := b.bot.EditMessageMedia(ctx, &bot.EditMessageMediaParams{
+		MessageID: editableMsg.ID,
+		ChatID:    editableMsg.Chat.ID,
+		Media:     media,
+	})
+	return err
+}
+
+// The InputMediaPhoto of the library has no has_spoiler field, so it's added when marshaling.
+type spoilerInputMediaPhoto struct {
+	*models.InputMediaPhoto
+}
+
+func (m spoilerInputMediaPhoto) MarshalInputMedia() ([]byte, error) {
+	return json.Marshal(struct {
+		Type string `json:"type"`
+		*models.InputMediaPhoto
+		HasSpoiler bool `json:"has_spoiler"`
+	}{
+		Type:            "photo",
+		InputMediaPhoto: m.InputMediaPhoto,
+		HasSpoiler:      true,
+	})
+}
+
+// SpoilerPhoto marks the photo to be hidden as a spoiler.
+func SpoilerPhoto(m *models.InputMediaPhoto) models.InputMedia {
+	return spoilerInputMediaPhoto{m}
+}
+
 func (b *SDBot) DeleteMessage(ctx context.Context, deletingMessage *models.Message) error {
 	_, err := b.bot.DeleteMessage(ctx, &bot.DeleteMessageParams{
 		MessageID: deletingMessage.ID,
@@ -65,6 +172,15 @@ func (b *SDBot) DeleteMessage(ctx context.Context, deletingMessage *models.Messa
 	return err
 }
 
+// SendText sends the plain text to the chat, not as a reply.
+func (b *SDBot) SendText(ctx context.Context, chatID int64, s string) error {
+	_, err := b.bot.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID: chatID,
+		Text:   s,
+	})
+	return err
+}
+
 func (b *SDBot) SendTextToAdmins(ctx context.Context, adminUserIds []int64, s string) {
 	for _, chatID := range adminUserIds {
 		_, _ = b.bot.SendMessage(ctx, &bot.SendMessageParams{
@@ -74,17 +190,119 @@ func (b *SDBot) SendTextToAdmins(ctx context.Context, adminUserIds []int64, s st
 	}
 }
 
-func (b *SDBot) SendMediaGroup(ctx context.Context, replyToMsg *models.Message, media []models.InputMedia) error {
-	_, err := b.bot.SendMediaGroup(ctx, &bot.SendMediaGroupParams{
+func (b *SDBot) SendMediaGroup(ctx context.Context, replyToMsg *models.Message, media []models.InputMedia) ([]*models.Message, error) {
+	return b.bot.SendMediaGroup(ctx, &bot.SendMediaGroupParams{
 		ChatID:           replyToMsg.Chat.ID,
+		MessageThreadID:  TopicOf(replyToMsg),
 		ReplyToMessageID: replyToMsg.ID,
 		Media:            media,
 	})
+}
+
+// FileIDOf returns the file ID of the photo or document in the message, or an empty string if it has none.
+func FileIDOf(msg *models.Message) string {
+	if msg == nil {
+		return ""
+	}
+	if len(msg.Photo) > 0 {
+		return msg.Photo[len(msg.Photo)-1].FileID
+	}
+	if msg.Document != nil {
+		return msg.Document.FileID
+	}
+	return ""
+}
+
+// SendPhoto sends the image as a photo, the markup is optional.
+func (b *SDBot) SendPhoto(ctx context.Context, replyToMsg *models.Message, filename string, data []byte, caption string, markup models.ReplyMarkup, spoiler bool) (*models.Message, error) {
+	return b.bot.SendPhoto(ctx, &bot.SendPhotoParams{
+		ChatID:           replyToMsg.Chat.ID,
+		MessageThreadID:  TopicOf(replyToMsg),
+		ReplyToMessageID: replyToMsg.ID,
+		Photo:            &models.InputFileUpload{Filename: filename, Data: bytes.NewReader(data)},
+		Caption:          caption,
+		ParseMode:        models.ParseModeHTML,
+		HasSpoiler:       spoiler,
+		ReplyMarkup:      markup,
+	})
+}
+
+// SendPhotoToChat sends the image as a photo to the chat, not as a reply.
+func (b *SDBot) SendPhotoToChat(ctx context.Context, chatID int64, filename string, data []byte, spoiler bool) (*models.Message, error) {
+	return b.bot.SendPhoto(ctx, &bot.SendPhotoParams{
+		ChatID:     chatID,
+		Photo:      &models.InputFileUpload{Filename: filename, Data: bytes.NewReader(data)},
+		HasSpoiler: spoiler,
+	})
+}
+
+// AnswerInlineQuery answers with personal results, the optional button is shown above them.
+func (b *SDBot) AnswerInlineQuery(ctx context.Context, inlineQueryID string, results []models.InlineQueryResult, button *models.InlineQueryResultsButton, cacheTime int) {
+	_, err := b.bot.AnswerInlineQuery(ctx, &bot.AnswerInlineQueryParams{
+		InlineQueryID: inlineQueryID,
+		Results:       results,
+		CacheTime:     cacheTime,
+		IsPersonal:    true,
+		Button:        button,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "inline query answer error", "error", err)
+	}
+}
+
+// Telegram returns true instead of the message for inline message edits, which the library fails to decode.
+func inlineEditError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Value == "bool" {
+		return nil
+	}
 	return err
+}
+
+// EditInlineMessage replaces the inline message with the text, the markup should be given again to keep it.
+func (b *SDBot) EditInlineMessage(ctx context.Context, inlineMessageID string, newText string, markup models.ReplyMarkup) error {
+	_, err := b.bot.EditMessageText(ctx, &bot.EditMessageTextParams{
+		InlineMessageID: inlineMessageID,
+		ParseMode:       models.ParseModeHTML,
+		Text:            newText,
+		ReplyMarkup:     markup,
+	})
+	return inlineEditError(err)
+}
+
+// EditInlineMessagePhoto replaces the inline message with a photo. Files can't be uploaded when editing
+// inline messages, so the photo should be an already uploaded one.
+func (b *SDBot) EditInlineMessagePhoto(ctx context.Context, inlineMessageID string, fileID string, caption string, markup models.ReplyMarkup, spoiler bool) error {
+	var media models.InputMedia = &models.InputMediaPhoto{
+		Media:     fileID,
+		Caption:   caption,
+		ParseMode: models.ParseModeHTML,
+	}
+	if spoiler {
+		media = SpoilerPhoto(media.(*models.InputMediaPhoto))
+	}
+	_, err := b.bot.EditMessageMedia(ctx, &bot.EditMessageMediaParams{
+		InlineMessageID: inlineMessageID,
+		Media:           media,
+		ReplyMarkup:     markup,
+	})
+	return inlineEditError(err)
+}
 
+func (b *SDBot) SendDocument(ctx context.Context, replyToMsg *models.Message, filename string, data []byte, caption string) error {
+	_, err := b.bot.SendDocument(ctx, &bot.SendDocumentParams{
+		ChatID:           replyToMsg.Chat.ID,
+		MessageThreadID:  TopicOf(replyToMsg),
+		ReplyToMessageID: replyToMsg.ID,
+		Document:         &models.InputFileUpload{Filename: filename, Data: bytes.NewReader(data)},
+		Caption:          caption,
+		ParseMode:        models.ParseModeHTML,
+	})
+	return err
 }
+
 func (b *SDBot) GetFile(ctx context.Context, fileId string, getWriterFunc func(fileSize int64) io.Writer) (d []byte, err error) {
-	fmt.Println("  downloading...")
+	slog.DebugContext(ctx, "downloading file", "file_id", fileId)
 
 	fileInfo, err := b.bot.GetFile(ctx, &bot.GetFileParams{
 		FileID: fileId,
@@ -109,7 +327,7 @@ func (b *SDBot) GetFile(ctx context.Context, fileId string, getWriterFunc func(f
 		return nil, err
 	}
 
-	fmt.Println("  downloading done")
+	slog.DebugContext(ctx, "downloading done", "bytes", len(d))
 	return d, nil
 }
 
@@ -0,0 +1,34 @@
+package telegram
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/metrics"
+)
+
+// The default of the library.
+const pollTimeout = time.Minute
+
+// metricsTransport counts the failed Bot API calls, except the ones canceled by the context. The method is
+// the last element of the request path.
+type metricsTransport struct {
+	next http.RoundTripper
+}
+
+func (t metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	method := path.Base(req.URL.Path)
+	if err != nil {
+		if req.Context().Err() == nil {
+			metrics.TelegramAPIErrors.WithLabelValues(method, "").Inc()
+		}
+		return resp, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		metrics.TelegramAPIErrors.WithLabelValues(method, strconv.Itoa(resp.StatusCode)).Inc()
+	}
+	return resp, err
+}
@@ -0,0 +1,67 @@
+package telegram
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kanootoko/stable-diffusion-telegram-bot/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsTransportCanceled(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+"/bot123/getUpdates", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := testutil.ToFloat64(metrics.TelegramAPIErrors.WithLabelValues("getUpdates", ""))
+	resp, err := metricsTransport{next: http.DefaultTransport}.RoundTrip(req)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("expected an error")
+	}
+	if after := testutil.ToFloat64(metrics.TelegramAPIErrors.WithLabelValues("getUpdates", "")); after != before {
+		t.Errorf("canceled call counted as an error")
+	}
+}
+
+func TestMetricsTransportErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/bot123/sendMessage", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := testutil.ToFloat64(metrics.TelegramAPIErrors.WithLabelValues("sendMessage", "429"))
+	resp, err := metricsTransport{next: http.DefaultTransport}.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if after := testutil.ToFloat64(metrics.TelegramAPIErrors.WithLabelValues("sendMessage", "429")); after != before+1 {
+		t.Errorf("got %v errors, expected %v", after, before+1)
+	}
+
+	unreachable, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:1/bot123/getMe", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before = testutil.ToFloat64(metrics.TelegramAPIErrors.WithLabelValues("getMe", ""))
+	if _, err = (metricsTransport{next: http.DefaultTransport}).RoundTrip(unreachable); err == nil {
+		t.Fatal("expected an error")
+	}
+	if after := testutil.ToFloat64(metrics.TelegramAPIErrors.WithLabelValues("getMe", "")); after != before+1 {
+		t.Errorf("got %v errors, expected %v", after, before+1)
+	}
+}
@@ -0,0 +1,72 @@
+package telegram
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+const webhookDeleteTimeout = 10 * time.Second
+
+// WebhookParams are used for receiving the updates with a webhook instead of long polling.
+type WebhookParams struct {
+	URL         string
+	SecretToken string
+	// Optional self-signed certificate file, it's uploaded to Telegram.
+	CertFile string
+}
+
+// WebhookHandler passes the updates to the bot, requests without the secret token are refused.
+func (b *SDBot) WebhookHandler(secretToken string) http.Handler {
+	handler := b.bot.WebhookHandler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Telegram-Bot-Api-Secret-Token")), []byte(secretToken)) != 1 {
+			slog.Warn("webhook request with invalid secret token", "remote_addr", r.RemoteAddr)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	})
+}
+
+// StartWebhook sets the webhook and processes the updates until the context is done, then the webhook is
+// deleted. The handler returned by WebhookHandler should be served on the webhook URL.
+func (b *SDBot) StartWebhook(ctx context.Context, p WebhookParams) error {
+	params := &bot.SetWebhookParams{
+		URL:         p.URL,
+		SecretToken: p.SecretToken,
+	}
+	if p.CertFile != "" {
+		cert, err := os.ReadFile(p.CertFile)
+		if err != nil {
+			return fmt.Errorf("can't read webhook cert: %w", err)
+		}
+		params.Certificate = &models.InputFileUpload{Filename: filepath.Base(p.CertFile), Data: bytes.NewReader(cert)}
+	}
+	if _, err := b.bot.SetWebhook(ctx, params); err != nil {
+		return fmt.Errorf("set webhook error: %w", err)
+	}
+	slog.InfoContext(ctx, "webhook set", "url", p.URL)
+
+	b.bot.StartWebhook(ctx)
+
+	deleteCtx, cancel := context.WithTimeout(context.Background(), webhookDeleteTimeout)
+	defer cancel()
+	if _, err := b.bot.DeleteWebhook(deleteCtx, &bot.DeleteWebhookParams{}); err != nil {
+		slog.Error("delete webhook error", "error", err)
+	}
+	return nil
+}